@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/urfave/cli/v2"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/flaggedproducer"
+	"github.com/panoptisDev/lachesis-base/kvdb/leveldb"
+	"github.com/panoptisDev/lachesis-base/kvdb/multidb"
+	"github.com/panoptisDev/lachesis-base/kvdb/pebble"
+)
+
+var (
+	ConfigFlag = cli.StringFlag{
+		Name:     "config",
+		Usage:    "JSON file with DB producers, old and new routing tables",
+		Required: true,
+	}
+	ProgressFlag = cli.StringFlag{
+		Name:     "progress",
+		Usage:    "directory of migration progress DB, which is used to resume an interrupted migration",
+		Required: true,
+	}
+	DryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "print the migration plan without moving the tables",
+	}
+)
+
+// ProducerConfig is a location of DBs of a type
+type ProducerConfig struct {
+	// Backend is either "leveldb" or "pebble"
+	Backend string
+	Datadir string
+}
+
+// Config is the migration config, which is read from JSON file
+type Config struct {
+	Producers       map[multidb.TypeName]ProducerConfig
+	OldRoutingTable map[string]multidb.Route
+	NewRoutingTable map[string]multidb.Route
+	TableRecordsKey hexutil.Bytes
+	FlushIDKey      hexutil.Bytes
+}
+
+func main() {
+	app := &cli.App{
+		Name:        "DB Migrator",
+		Description: "Moves the tables of multidb according to a new routing table",
+		Flags:       []cli.Flag{&ConfigFlag, &ProgressFlag, &DryRunFlag},
+		Action:      run,
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func readConfig(path string) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(b, &cfg)
+	return cfg, err
+}
+
+func cacheFdLimit(string) (int, int) {
+	return 64 * 1024 * 1024, 256
+}
+
+func openProducers(cfg Config) (map[multidb.TypeName]kvdb.FullDBProducer, error) {
+	producers := make(map[multidb.TypeName]kvdb.FullDBProducer, len(cfg.Producers))
+	for typ, pcfg := range cfg.Producers {
+		var backend kvdb.IterableDBProducer
+		switch pcfg.Backend {
+		case "leveldb":
+			backend = leveldb.NewProducer(pcfg.Datadir, cacheFdLimit)
+		case "pebble":
+			backend = pebble.NewProducer(pcfg.Datadir, cacheFdLimit)
+		default:
+			return nil, fmt.Errorf("unknown backend '%s' of DB type '%s'", pcfg.Backend, typ)
+		}
+		producers[typ] = flaggedproducer.Wrap(backend, cfg.FlushIDKey)
+	}
+	return producers, nil
+}
+
+func run(ctx *cli.Context) error {
+	cfg, err := readConfig(ctx.String(ConfigFlag.Name))
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	producers, err := openProducers(cfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, producer := range producers {
+			_ = producer.Close()
+		}
+	}()
+
+	// all the DBs must be in a clean state with the same flush ID, which is kept during the migration
+	var flushID []byte
+	for typ, producer := range producers {
+		flushID, err = producer.Initialize(producer.Names(), flushID)
+		if err != nil {
+			return fmt.Errorf("DBs of type '%s' aren't synced: %w", typ, err)
+		}
+	}
+	if len(flushID) > 0 {
+		// strip the clean prefix
+		flushID = flushID[1:]
+	}
+
+	progressPath := ctx.String(ProgressFlag.Name)
+	progressProducer := leveldb.NewProducer(filepath.Dir(progressPath), cacheFdLimit)
+	progress, err := progressProducer.OpenDB(filepath.Base(progressPath))
+	if err != nil {
+		return fmt.Errorf("failed to open progress DB: %w", err)
+	}
+	defer progress.Close()
+
+	migration, err := multidb.NewMigration(multidb.MigrationConfig{
+		Producers:       producers,
+		OldRoutingTable: cfg.OldRoutingTable,
+		NewRoutingTable: cfg.NewRoutingTable,
+		TableRecordsKey: cfg.TableRecordsKey,
+		FlushIDKey:      cfg.FlushIDKey,
+		FlushID:         flushID,
+		Progress:        progress,
+	})
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool(DryRunFlag.Name) {
+		plan, err := migration.Plan()
+		if err != nil {
+			return err
+		}
+		for _, move := range plan {
+			fmt.Println(move.String())
+		}
+		return nil
+	}
+	return migration.Run(func(move multidb.TableMove) {
+		fmt.Println("moving", move.String())
+	})
+}
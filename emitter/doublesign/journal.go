@@ -0,0 +1,198 @@
+package doublesign
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+var (
+	ErrJournalFork          = errors.New("event would fork the journaled self-event")
+	ErrJournalStale         = errors.New("event is older than the journaled self-event")
+	ErrJournaledEventLost   = errors.New("journaled self-event isn't found")
+	errJournalMalformedData = errors.New("malformed journal record")
+)
+
+const journalRecordSize = 4 + 4 + 32
+
+// JournalRecord is the last self-event released by this instance.
+type JournalRecord struct {
+	Epoch idx.Epoch
+	Seq   idx.Event
+	ID    hash.Event
+}
+
+func (r JournalRecord) bytes() []byte {
+	b := make([]byte, 0, journalRecordSize)
+	b = append(b, r.Epoch.Bytes()...)
+	b = append(b, r.Seq.Bytes()...)
+	b = append(b, r.ID.Bytes()...)
+	return b
+}
+
+func journalRecordFromBytes(b []byte) (JournalRecord, error) {
+	if len(b) != journalRecordSize {
+		return JournalRecord{}, errJournalMalformedData
+	}
+	return JournalRecord{
+		Epoch: idx.BytesToEpoch(b[0:4]),
+		Seq:   idx.BytesToEvent(b[4:8]),
+		ID:    hash.BytesToEvent(b[8:]),
+	}, nil
+}
+
+// Journal is a persistent record of the last self-event released by every local validator.
+// Unlike SyncedToEmit and DetectParallelInstance, it doesn't rely on timing,
+// so it protects against an equivocation after a crash between signing and broadcasting.
+type Journal struct {
+	db kvdb.Store
+
+	mu    sync.Mutex
+	cache map[idx.ValidatorID]JournalRecord
+}
+
+// NewJournal creates journal over key-value db.
+// The db is supposed to be a dedicated table, and must persist writes before Record returns.
+func NewJournal(db kvdb.Store) *Journal {
+	return &Journal{
+		db:    db,
+		cache: make(map[idx.ValidatorID]JournalRecord),
+	}
+}
+
+// Last returns the last journaled self-event of the creator, if any.
+func (j *Journal) Last(creator idx.ValidatorID) (JournalRecord, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.last(creator)
+}
+
+func (j *Journal) last(creator idx.ValidatorID) (JournalRecord, bool, error) {
+	if r, ok := j.cache[creator]; ok {
+		return r, true, nil
+	}
+	b, err := j.db.Get(creator.Bytes())
+	if err != nil {
+		return JournalRecord{}, false, err
+	}
+	if b == nil {
+		return JournalRecord{}, false, nil
+	}
+	r, err := journalRecordFromBytes(b)
+	if err != nil {
+		return JournalRecord{}, false, err
+	}
+	j.cache[creator] = r
+	return r, true, nil
+}
+
+// Check returns an error if the event would create a fork against the journal.
+func (j *Journal) Check(e dag.Event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, err := j.check(e)
+	return err
+}
+
+func (j *Journal) check(e dag.Event) (same bool, err error) {
+	last, ok, err := j.last(e.Creator())
+	if err != nil || !ok {
+		return false, err
+	}
+	if e.Epoch() < last.Epoch {
+		return false, ErrJournalStale
+	}
+	if e.Epoch() > last.Epoch {
+		return false, nil
+	}
+	if e.Seq() < last.Seq {
+		return false, ErrJournalStale
+	}
+	if e.Seq() == last.Seq {
+		if e.ID() != last.ID {
+			return false, fmt.Errorf("%w: seq=%d journaled=%s new=%s", ErrJournalFork, e.Seq(), last.ID, e.ID())
+		}
+		return true, nil
+	}
+	if e.Seq() != last.Seq+1 {
+		// the skipped self-events were released without being journaled, so they may be forked
+		return false, fmt.Errorf("%w: seq=%d skips journaled seq=%d", ErrJournalFork, e.Seq(), last.Seq)
+	}
+	if sp := e.SelfParent(); sp == nil || *sp != last.ID {
+		return false, fmt.Errorf("%w: self-parent of seq=%d isn't journaled %s", ErrJournalFork, e.Seq(), last.ID)
+	}
+	return false, nil
+}
+
+// Record checks the event against the journal and persists it as the last self-event.
+// It must be called after the event is signed and before it's released to peers.
+func (j *Journal) Record(e dag.Event) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	same, err := j.check(e)
+	if err != nil || same {
+		return err
+	}
+	r := JournalRecord{
+		Epoch: e.Epoch(),
+		Seq:   e.Seq(),
+		ID:    e.ID(),
+	}
+	err = j.db.Put(e.Creator().Bytes(), r.bytes())
+	if err != nil {
+		return err
+	}
+	j.cache[e.Creator()] = r
+	return nil
+}
+
+// Recover re-broadcasts the journaled self-events of the creators.
+// It should be called on startup, before any emission.
+// Returns ErrJournaledEventLost if the journaled event isn't available locally,
+// in which case the node must not emit until the event is downloaded from peers.
+// The callbacks are called without the journal lock, so they may use the journal.
+func (j *Journal) Recover(creators []idx.ValidatorID, get func(hash.Event) dag.Event, broadcast func(dag.Event)) error {
+	records, err := j.lastRecords(creators)
+	if err != nil {
+		return err
+	}
+	for _, last := range records {
+		e := get(last.ID)
+		if e == nil {
+			return fmt.Errorf("%w: validator=%d id=%s", ErrJournaledEventLost, last.creator, last.ID)
+		}
+		broadcast(e)
+	}
+	return nil
+}
+
+type creatorRecord struct {
+	JournalRecord
+	creator idx.ValidatorID
+}
+
+// lastRecords returns the last journaled self-events of the creators which have any
+func (j *Journal) lastRecords(creators []idx.ValidatorID) ([]creatorRecord, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	records := make([]creatorRecord, 0, len(creators))
+	for _, creator := range creators {
+		last, ok, err := j.last(creator)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			records = append(records, creatorRecord{last, creator})
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,89 @@
+package doublesign
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+)
+
+func fakeSelfEvent(epoch idx.Epoch, seq idx.Event, selfParent *hash.Event, rID byte) dag.Event {
+	e := &dag.MutableBaseEvent{}
+	e.SetEpoch(epoch)
+	e.SetSeq(seq)
+	e.SetCreator(1)
+	e.SetLamport(idx.Lamport(seq))
+	if selfParent != nil {
+		e.SetParents(hash.Events{*selfParent})
+	}
+	e.SetID([24]byte{rID})
+	return &e.BaseEvent
+}
+
+func TestJournal(t *testing.T) {
+	db := memorydb.New()
+	j := NewJournal(db)
+
+	_, ok, err := j.Last(1)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	e1 := fakeSelfEvent(1, 1, nil, 1)
+	require.NoError(t, j.Record(e1))
+	// recording the same event again is idempotent
+	require.NoError(t, j.Record(e1))
+
+	// same seq, different ID
+	e1fork := fakeSelfEvent(1, 1, nil, 2)
+	require.True(t, errors.Is(j.Check(e1fork), ErrJournalFork))
+
+	// next seq with a wrong self-parent
+	other := e1fork.ID()
+	require.True(t, errors.Is(j.Check(fakeSelfEvent(1, 2, &other, 3)), ErrJournalFork))
+
+	// a gap means that skipped self-events weren't journaled
+	id1 := e1.ID()
+	require.True(t, errors.Is(j.Check(fakeSelfEvent(1, 3, &id1, 3)), ErrJournalFork))
+
+	e2 := fakeSelfEvent(1, 2, &id1, 3)
+	require.NoError(t, j.Record(e2))
+	require.True(t, errors.Is(j.Check(e1), ErrJournalStale))
+
+	// journal survives a restart
+	j = NewJournal(db)
+	last, ok, err := j.Last(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, JournalRecord{Epoch: 1, Seq: 2, ID: e2.ID()}, last)
+	require.True(t, errors.Is(j.Check(fakeSelfEvent(1, 2, &id1, 4)), ErrJournalFork))
+
+	// new epoch starts from scratch
+	require.NoError(t, j.Check(fakeSelfEvent(2, 1, nil, 5)))
+	require.True(t, errors.Is(j.Check(fakeSelfEvent(0, 5, nil, 6)), ErrJournalStale))
+
+	// recovery
+	var broadcasted []dag.Event
+	get := func(id hash.Event) dag.Event {
+		if id == e2.ID() {
+			return e2
+		}
+		return nil
+	}
+	require.NoError(t, j.Recover([]idx.ValidatorID{1, 2}, get, func(e dag.Event) {
+		broadcasted = append(broadcasted, e)
+	}))
+	require.Equal(t, []dag.Event{e2}, broadcasted)
+
+	// the broadcast may use the journal
+	require.NoError(t, j.Recover([]idx.ValidatorID{1}, get, func(e dag.Event) {
+		require.NoError(t, j.Record(e))
+	}))
+
+	err = j.Recover([]idx.ValidatorID{1}, func(hash.Event) dag.Event { return nil }, func(dag.Event) {})
+	require.True(t, errors.Is(err, ErrJournaledEventLost))
+}
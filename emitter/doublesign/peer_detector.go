@@ -0,0 +1,155 @@
+package doublesign
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/panoptisDev/lachesis-base/gossip/dagprocessor"
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+var (
+	ErrEquivocationDetected = errors.New("equivocation detected")
+)
+
+// EquivocationError is a fatal error which contains both conflicting self-events.
+type EquivocationError struct {
+	Creator idx.ValidatorID
+	Epoch   idx.Epoch
+	Seq     idx.Event
+	A, B    hash.Event
+}
+
+func (e *EquivocationError) Error() string {
+	return fmt.Sprintf("%s: validator=%d epoch=%d seq=%d %s != %s", ErrEquivocationDetected, e.Creator, e.Epoch, e.Seq, e.A, e.B)
+}
+
+func (e *EquivocationError) Unwrap() error {
+	return ErrEquivocationDetected
+}
+
+type selfSeqKey struct {
+	creator idx.ValidatorID
+	seq     idx.Event
+}
+
+// PeerDetector detects a parallel instance by comparing self-events received from peers with self-events created locally.
+// Unlike DetectParallelInstance, it doesn't rely on timing, and reports an equivocation as soon as it's observed.
+type PeerDetector struct {
+	isSelf func(idx.ValidatorID) bool
+
+	mu       sync.RWMutex
+	epoch    idx.Epoch
+	created  map[selfSeqKey]hash.Event
+	external map[selfSeqKey]hash.Event
+	fatal    *EquivocationError
+}
+
+// NewPeerDetector creates a detector. isSelf returns true if validator is operated by this instance.
+func NewPeerDetector(isSelf func(idx.ValidatorID) bool) *PeerDetector {
+	d := &PeerDetector{
+		isSelf: isSelf,
+	}
+	d.reset(0)
+	return d
+}
+
+func (d *PeerDetector) reset(epoch idx.Epoch) {
+	d.epoch = epoch
+	d.created = make(map[selfSeqKey]hash.Event)
+	d.external = make(map[selfSeqKey]hash.Event)
+}
+
+// switchEpoch drops self-events of previous epochs, as seq numbering restarts every epoch.
+// Returns false if event is from an obsolete epoch.
+func (d *PeerDetector) switchEpoch(epoch idx.Epoch) bool {
+	if epoch < d.epoch {
+		return false
+	}
+	if epoch > d.epoch {
+		d.reset(epoch)
+	}
+	return true
+}
+
+func (d *PeerDetector) check(e dag.Event, key selfSeqKey) *EquivocationError {
+	if id, ok := d.created[key]; ok && id != e.ID() {
+		return &EquivocationError{Creator: key.creator, Epoch: e.Epoch(), Seq: key.seq, A: id, B: e.ID()}
+	}
+	if id, ok := d.external[key]; ok && id != e.ID() {
+		return &EquivocationError{Creator: key.creator, Epoch: e.Epoch(), Seq: key.seq, A: id, B: e.ID()}
+	}
+	return nil
+}
+
+// OnCreated should be called for every self-event created by this instance.
+func (d *PeerDetector) OnCreated(e dag.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.switchEpoch(e.Epoch()) {
+		return
+	}
+	key := selfSeqKey{e.Creator(), e.Seq()}
+	if err := d.check(e, key); err != nil && d.fatal == nil {
+		d.fatal = err
+	}
+	d.created[key] = e.ID()
+}
+
+// OnReceived should be called for every event received from peers.
+// Returns a fatal EquivocationError if event conflicts with a known self-event.
+func (d *PeerDetector) OnReceived(e dag.Event) error {
+	if !d.isSelf(e.Creator()) {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.switchEpoch(e.Epoch()) {
+		return nil
+	}
+	key := selfSeqKey{e.Creator(), e.Seq()}
+	if err := d.check(e, key); err != nil {
+		if d.fatal == nil {
+			d.fatal = err
+		}
+		return err
+	}
+	if _, ok := d.created[key]; !ok {
+		d.external[key] = e.ID()
+	}
+	return nil
+}
+
+// Status returns nil if no equivocation was detected, and the first detected EquivocationError otherwise.
+// Emitter should check it before every emission.
+func (d *PeerDetector) Status() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.fatal == nil {
+		return nil
+	}
+	return d.fatal
+}
+
+// Wrap returns dagprocessor callbacks which feed every event which passed CheckParentless to the detector.
+// Events which failed the check aren't fed, as otherwise a peer could halt the emission with a forged self-event.
+// Events are not rejected, because a fork is a valid part of the DAG for other nodes;
+// only the emission is halted via Status.
+func (d *PeerDetector) Wrap(cb dagprocessor.EventCallback) dagprocessor.EventCallback {
+	checkParentless := cb.CheckParentless
+	cb.CheckParentless = func(e dag.Event, checked func(error)) {
+		checkParentless(e, func(err error) {
+			if err == nil {
+				_ = d.OnReceived(e)
+			}
+			checked(err)
+		})
+	}
+	return cb
+}
@@ -0,0 +1,101 @@
+package doublesign
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/gossip/dagprocessor"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+func TestPeerDetector(t *testing.T) {
+	d := NewPeerDetector(func(v idx.ValidatorID) bool {
+		return v == 1
+	})
+
+	e1 := fakeSelfEvent(1, 1, nil, 1)
+	d.OnCreated(e1)
+	// own event echoed back by peers
+	require.NoError(t, d.OnReceived(e1))
+	require.NoError(t, d.Status())
+
+	// external self-event with a new seq
+	id1 := e1.ID()
+	e2 := fakeSelfEvent(1, 2, &id1, 2)
+	require.NoError(t, d.OnReceived(e2))
+	require.NoError(t, d.OnReceived(e2))
+	require.NoError(t, d.Status())
+
+	// conflicting external self-event
+	e2fork := fakeSelfEvent(1, 2, &id1, 3)
+	err := d.OnReceived(e2fork)
+	require.True(t, errors.Is(err, ErrEquivocationDetected))
+	var eqErr *EquivocationError
+	require.True(t, errors.As(err, &eqErr))
+	require.Equal(t, e2.ID(), eqErr.A)
+	require.Equal(t, e2fork.ID(), eqErr.B)
+	require.Equal(t, idx.Event(2), eqErr.Seq)
+	require.Equal(t, err, d.Status())
+
+	// status is sticky
+	require.NoError(t, d.OnReceived(fakeSelfEvent(2, 1, nil, 4)))
+	require.Equal(t, err, d.Status())
+}
+
+func TestPeerDetectorCreatedConflict(t *testing.T) {
+	d := NewPeerDetector(func(v idx.ValidatorID) bool {
+		return v == 1
+	})
+
+	// event of other validators are ignored
+	other := &dag.MutableBaseEvent{}
+	other.SetCreator(2)
+	other.SetSeq(1)
+	require.NoError(t, d.OnReceived(&other.BaseEvent))
+
+	require.NoError(t, d.OnReceived(fakeSelfEvent(1, 1, nil, 1)))
+	d.OnCreated(fakeSelfEvent(1, 1, nil, 2))
+	require.True(t, errors.Is(d.Status(), ErrEquivocationDetected))
+}
+
+func TestPeerDetectorWrap(t *testing.T) {
+	d := NewPeerDetector(func(v idx.ValidatorID) bool {
+		return v == 1
+	})
+	d.OnCreated(fakeSelfEvent(1, 1, nil, 1))
+
+	passed := 0
+	cb := d.Wrap(dagprocessor.EventCallback{
+		CheckParentless: func(e dag.Event, checked func(error)) {
+			passed++
+			checked(nil)
+		},
+	})
+	cb.CheckParentless(fakeSelfEvent(1, 1, nil, 2), func(err error) {
+		require.NoError(t, err)
+	})
+	require.Equal(t, 1, passed)
+	require.True(t, errors.Is(d.Status(), ErrEquivocationDetected))
+}
+
+func TestPeerDetectorWrapInvalid(t *testing.T) {
+	d := NewPeerDetector(func(v idx.ValidatorID) bool {
+		return v == 1
+	})
+	d.OnCreated(fakeSelfEvent(1, 1, nil, 1))
+
+	errSig := errors.New("invalid signature")
+	cb := d.Wrap(dagprocessor.EventCallback{
+		CheckParentless: func(e dag.Event, checked func(error)) {
+			checked(errSig)
+		},
+	})
+	// forged self-event with a conflicting seq
+	cb.CheckParentless(fakeSelfEvent(1, 1, nil, 2), func(err error) {
+		require.Equal(t, errSig, err)
+	})
+	require.NoError(t, d.Status())
+}
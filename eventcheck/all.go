@@ -3,6 +3,7 @@ package eventcheck
 import (
 	"github.com/panoptisDev/lachesis-base/eventcheck/basiccheck"
 	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/framecheck"
 	"github.com/panoptisDev/lachesis-base/eventcheck/parentscheck"
 	"github.com/panoptisDev/lachesis-base/inter/dag"
 )
@@ -12,6 +13,7 @@ type Checkers struct {
 	Basiccheck   *basiccheck.Checker
 	Epochcheck   *epochcheck.Checker
 	Parentscheck *parentscheck.Checker
+	Framecheck   *framecheck.Checker // optional
 }
 
 // Validate runs all the checks except Lachesis-related
@@ -25,5 +27,23 @@ func (v *Checkers) Validate(e dag.Event, parents dag.Events) error {
 	if err := v.Parentscheck.Validate(e, parents); err != nil {
 		return err
 	}
+	if v.Framecheck != nil {
+		if err := v.Framecheck.Validate(e, parents); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Pipeline returns a pipeline which runs the same checks as Validate, in the same order.
+// More checkers may be appended to it.
+func (v *Checkers) Pipeline(parallel bool) *Pipeline {
+	p := NewPipeline(parallel).
+		AddParentless("basiccheck", v.Basiccheck).
+		AddParentless("epochcheck", v.Epochcheck).
+		AddParents("parentscheck", v.Parentscheck)
+	if v.Framecheck != nil {
+		p.AddParents("framecheck", v.Framecheck)
+	}
+	return p
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/panoptisDev/lachesis-base/eventcheck/basiccheck"
 	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/framecheck"
 	"github.com/panoptisDev/lachesis-base/eventcheck/parentscheck"
 	"github.com/panoptisDev/lachesis-base/hash"
 	"github.com/panoptisDev/lachesis-base/inter/dag"
@@ -101,6 +102,47 @@ func TestEpochEventValidation(t *testing.T) {
 	}
 }
 
+type testNextEpochReader struct {
+	testReader
+	next *pos.Validators
+}
+
+func (tr *testNextEpochReader) GetNextEpochValidators() *pos.Validators {
+	return tr.next
+}
+
+func TestNextEpochEventValidation(t *testing.T) {
+	newEvent := func(epoch idx.Epoch, creator idx.ValidatorID) dag.Event {
+		e := &tdag.TestEvent{}
+		e.SetEpoch(epoch)
+		e.SetCreator(creator)
+		return e
+	}
+	vb := pos.NewBuilder()
+	vb.Set(2, 1)
+	nextValidators := vb.Build()
+
+	var tests = []struct {
+		e       dag.Event
+		next    *pos.Validators
+		wantErr error
+	}{
+		{newEvent(1, 1), nil, nil},
+		{newEvent(2, 1), nil, epochcheck.ErrNextEpoch},
+		{newEvent(2, 2), nil, epochcheck.ErrNextEpoch},
+		{newEvent(2, 2), nextValidators, epochcheck.ErrNextEpoch},
+		{newEvent(2, 1), nextValidators, epochcheck.ErrAuth},
+		{newEvent(3, 2), nextValidators, epochcheck.ErrNotRelevant},
+	}
+
+	for _, tt := range tests {
+		epochCheck := epochcheck.New(&testNextEpochReader{next: tt.next})
+		assert.Equal(t, tt.wantErr, epochCheck.Validate(tt.e))
+	}
+	// without the extension
+	assert.Equal(t, epochcheck.ErrNotRelevant, epochcheck.New(new(testReader)).Validate(newEvent(2, 1)))
+}
+
 func TestParentsEventValidation(t *testing.T) {
 	var tests = []struct {
 		e         dag.Event
@@ -228,6 +270,54 @@ func TestParentsEventValidation(t *testing.T) {
 	}
 }
 
+func TestFrameEventValidation(t *testing.T) {
+	newEvent := func(seq idx.Event, frame idx.Frame, lamport idx.Lamport, parents dag.Events) dag.Event {
+		e := &tdag.TestEvent{}
+		e.SetSeq(seq)
+		e.SetFrame(frame)
+		e.SetLamport(lamport)
+		e.SetCreator(1)
+		for _, p := range parents {
+			e.AddParent(p.ID())
+		}
+		e.SetID([24]byte{byte(seq), byte(frame), byte(lamport)})
+		return e
+	}
+	newParent := func(creator idx.ValidatorID, seq idx.Event, frame idx.Frame, lamport idx.Lamport) dag.Event {
+		e := &tdag.TestEvent{}
+		e.SetSeq(seq)
+		e.SetFrame(frame)
+		e.SetLamport(lamport)
+		e.SetCreator(creator)
+		e.SetID([24]byte{byte(creator), byte(seq), byte(frame), byte(lamport)})
+		return e
+	}
+	selfParent := newParent(1, 1, 3, 10)
+	otherParent := newParent(2, 5, 4, 12)
+
+	var tests = []struct {
+		e       dag.Event
+		pe      dag.Events
+		wantErr error
+	}{
+		{newEvent(1, 1, 1, nil), nil, nil},
+		{newEvent(1, 2, 1, nil), nil, framecheck.ErrWrongFirstFrame},
+		{newEvent(2, 3, 11, dag.Events{selfParent}), dag.Events{selfParent}, nil},
+		{newEvent(2, 4, 11, dag.Events{selfParent}), dag.Events{selfParent}, nil},
+		{newEvent(2, 5, 11, dag.Events{selfParent}), dag.Events{selfParent}, framecheck.ErrFrameTooHigh},
+		{newEvent(2, 2, 11, dag.Events{selfParent}), dag.Events{selfParent}, framecheck.ErrFrameDecreased},
+		{newEvent(2, 5, 13, dag.Events{selfParent, otherParent}), dag.Events{selfParent, otherParent}, nil},
+		{newEvent(2, 6, 13, dag.Events{selfParent, otherParent}), dag.Events{selfParent, otherParent}, framecheck.ErrFrameTooHigh},
+		{newEvent(2, 3, 16, dag.Events{selfParent}), dag.Events{selfParent}, framecheck.ErrLamportGap},
+		{newEvent(2, 3, 15, dag.Events{selfParent}), dag.Events{selfParent}, nil},
+	}
+
+	frameCheck := framecheck.New(framecheck.Config{MaxLamportGap: 5})
+	for _, tt := range tests {
+		assert.Equal(t, tt.wantErr, frameCheck.Validate(tt.e, tt.pe))
+	}
+}
+
 func TestAllEventValidation(t *testing.T) {
 	var tests = []struct {
 		e       dag.Event
@@ -13,6 +13,8 @@ var (
 	ErrNotRelevant = errors.New("event is too old or too new")
 	// ErrAuth indicates that event's creator isn't authorized to create events in current epoch.
 	ErrAuth = errors.New("event creator isn't a validator")
+	// ErrNextEpoch indicates the event is from the next epoch, and may be buffered until the current epoch is sealed.
+	ErrNextEpoch = errors.New("event is from the next epoch")
 )
 
 // Reader returns currents epoch and its validators group.
@@ -20,6 +22,13 @@ type Reader interface {
 	GetEpochValidators() (*pos.Validators, idx.Epoch)
 }
 
+// NextEpochReader is an optional extension of Reader, which enables tolerance to events of the next epoch.
+// GetNextEpochValidators returns validators group of the next epoch, or nil if it isn't known yet.
+type NextEpochReader interface {
+	Reader
+	GetNextEpochValidators() *pos.Validators
+}
+
 // Checker which require only current epoch info
 type Checker struct {
 	reader Reader
@@ -35,6 +44,9 @@ func New(reader Reader) *Checker {
 func (v *Checker) Validate(e dag.Event) error {
 	// check epoch first, because validators group is returned only for the current epoch
 	validators, epoch := v.reader.GetEpochValidators()
+	if e.Epoch() == epoch+1 {
+		return v.validateNextEpoch(e)
+	}
 	if e.Epoch() != epoch {
 		return ErrNotRelevant
 	}
@@ -43,3 +55,16 @@ func (v *Checker) Validate(e dag.Event) error {
 	}
 	return nil
 }
+
+// validateNextEpoch returns ErrNextEpoch if the event may be valid in the next epoch.
+// If next validators group isn't known yet, the event is fully validated only after the epoch is sealed.
+func (v *Checker) validateNextEpoch(e dag.Event) error {
+	reader, ok := v.reader.(NextEpochReader)
+	if !ok {
+		return ErrNotRelevant
+	}
+	if validators := reader.GetNextEpochValidators(); validators != nil && !validators.Exists(e.Creator()) {
+		return ErrAuth
+	}
+	return ErrNextEpoch
+}
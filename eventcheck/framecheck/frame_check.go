@@ -0,0 +1,83 @@
+package framecheck
+
+import (
+	"errors"
+
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+var (
+	// ErrFrameTooHigh indicates that event's frame is higher than any parent's frame + 1.
+	ErrFrameTooHigh = errors.New("claimed frame is too high")
+	// ErrFrameDecreased indicates that event's frame is lower than self-parent's frame.
+	ErrFrameDecreased = errors.New("claimed frame is lower than self-parent's frame")
+	// ErrWrongFirstFrame indicates that the first event of a validator in an epoch isn't of frame 1.
+	ErrWrongFirstFrame = errors.New("first event claims a frame other than 1")
+	// ErrLamportGap indicates that event's Lamport time is too far ahead of one of parents.
+	ErrLamportGap = errors.New("too big Lamport gap over a parent")
+)
+
+type Config struct {
+	// MaxLamportGap is the maximum difference between event's Lamport time and Lamport time of any of its parents.
+	// Zero disables the check.
+	MaxLamportGap idx.Lamport
+}
+
+// Checker performs cheap sanity checks of claimed frame and Lamport time, which require the parents list.
+// It rejects events whose frame cannot be correct regardless of the DAG, before the expensive consensus indexing.
+type Checker struct {
+	cfg Config
+}
+
+// New checker which performs frame and Lamport sanity checks
+func New(cfg Config) *Checker {
+	return &Checker{
+		cfg: cfg,
+	}
+}
+
+func (v *Checker) checkFrame(e dag.Event, parents dag.Events) error {
+	if e.SelfParent() == nil {
+		if e.Frame() != 1 {
+			return ErrWrongFirstFrame
+		}
+		return nil
+	}
+	maxFrame := idx.Frame(0)
+	for i, p := range parents {
+		if e.IsSelfParent(e.Parents()[i]) && e.Frame() < p.Frame() {
+			return ErrFrameDecreased
+		}
+		if maxFrame < p.Frame() {
+			maxFrame = p.Frame()
+		}
+	}
+	if e.Frame() > maxFrame+1 {
+		return ErrFrameTooHigh
+	}
+	return nil
+}
+
+func (v *Checker) checkLamport(e dag.Event, parents dag.Events) error {
+	if v.cfg.MaxLamportGap == 0 {
+		return nil
+	}
+	for _, p := range parents {
+		if e.Lamport() > p.Lamport() && e.Lamport()-p.Lamport() > v.cfg.MaxLamportGap {
+			return ErrLamportGap
+		}
+	}
+	return nil
+}
+
+// Validate event
+func (v *Checker) Validate(e dag.Event, parents dag.Events) error {
+	if len(e.Parents()) != len(parents) {
+		panic("framecheck: expected event's parents as an argument")
+	}
+	if err := v.checkFrame(e, parents); err != nil {
+		return err
+	}
+	return v.checkLamport(e, parents)
+}
@@ -0,0 +1,230 @@
+package eventcheck
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+)
+
+// Checker performs checks which don't require anything except event and a checker's own state
+type Checker interface {
+	Validate(e dag.Event) error
+}
+
+// ParentsChecker performs checks which require the parents list
+type ParentsChecker interface {
+	Validate(e dag.Event, parents dag.Events) error
+}
+
+// CheckerFunc is an adapter to allow the use of ordinary functions as a Checker
+type CheckerFunc func(e dag.Event) error
+
+func (f CheckerFunc) Validate(e dag.Event) error {
+	return f(e)
+}
+
+// ParentsCheckerFunc is an adapter to allow the use of ordinary functions as a ParentsChecker
+type ParentsCheckerFunc func(e dag.Event, parents dag.Events) error
+
+func (f ParentsCheckerFunc) Validate(e dag.Event, parents dag.Events) error {
+	return f(e, parents)
+}
+
+// CheckerStats is a snapshot of a checker's counters
+type CheckerStats struct {
+	Checked uint64
+	Failed  uint64
+	// Errors counts failures by message of the innermost wrapped error, i.e. usually by the sentinel error
+	Errors map[string]uint64
+}
+
+// maxErrorClasses limits the number of distinct errors counted by a checker.
+// Other errors are counted as otherErrors
+const maxErrorClasses = 64
+
+const otherErrors = "other"
+
+// errorClass returns the message of the innermost error in the chain of wrapped errors,
+// so errors which wrap the same sentinel with per-event details are counted together
+func errorClass(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return err.Error()
+		}
+		err = next
+	}
+}
+
+type checkerCounters struct {
+	name    string
+	checked uint64
+	failed  uint64
+
+	mu     sync.Mutex
+	errors map[string]uint64
+}
+
+func newCheckerCounters(name string) *checkerCounters {
+	return &checkerCounters{
+		name:   name,
+		errors: make(map[string]uint64),
+	}
+}
+
+func (c *checkerCounters) count(err error) error {
+	atomic.AddUint64(&c.checked, 1)
+	if err == nil {
+		return nil
+	}
+	atomic.AddUint64(&c.failed, 1)
+	c.mu.Lock()
+	class := errorClass(err)
+	if _, ok := c.errors[class]; !ok && len(c.errors) >= maxErrorClasses {
+		class = otherErrors
+	}
+	c.errors[class]++
+	c.mu.Unlock()
+	return err
+}
+
+func (c *checkerCounters) stats() CheckerStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CheckerStats{
+		Checked: atomic.LoadUint64(&c.checked),
+		Failed:  atomic.LoadUint64(&c.failed),
+		Errors:  make(map[string]uint64, len(c.errors)),
+	}
+	for msg, n := range c.errors {
+		s.Errors[msg] = n
+	}
+	return s
+}
+
+type pipelineChecker struct {
+	checker Checker
+	*checkerCounters
+}
+
+type pipelineParentsChecker struct {
+	checker ParentsChecker
+	*checkerCounters
+}
+
+// Pipeline composes any number of checkers.
+// Parentless checkers are run before the event is connected, parents checkers are run when all the parents are known.
+// Checkers are run in the order of addition, and the first error stops the pipeline.
+// Pipeline must be fully composed before the first validation.
+type Pipeline struct {
+	parallel   bool
+	parentless []pipelineChecker
+	parents    []pipelineParentsChecker
+}
+
+// NewPipeline creates an empty pipeline.
+// If parallel is true, parentless checkers of an event are run concurrently,
+// which is useful if some of them are expensive, e.g. signature verification.
+func NewPipeline(parallel bool) *Pipeline {
+	return &Pipeline{
+		parallel: parallel,
+	}
+}
+
+// AddParentless appends a checker which doesn't require event parents
+func (p *Pipeline) AddParentless(name string, c Checker) *Pipeline {
+	p.parentless = append(p.parentless, pipelineChecker{c, newCheckerCounters(name)})
+	return p
+}
+
+// AddParents appends a checker which requires event parents
+func (p *Pipeline) AddParents(name string, c ParentsChecker) *Pipeline {
+	p.parents = append(p.parents, pipelineParentsChecker{c, newCheckerCounters(name)})
+	return p
+}
+
+// ValidateParentless runs all the parentless checkers
+func (p *Pipeline) ValidateParentless(e dag.Event) error {
+	if !p.parallel || len(p.parentless) <= 1 {
+		for _, c := range p.parentless {
+			if err := c.count(c.checker.Validate(e)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// run concurrently, checkers which follow a failed one are skipped if they weren't started yet
+	var (
+		wg        sync.WaitGroup
+		firstFail = int32(len(p.parentless))
+		errs      = make([]error, len(p.parentless))
+	)
+	for i, c := range p.parentless {
+		wg.Add(1)
+		go func(i int, c pipelineChecker) {
+			defer wg.Done()
+			if int(atomic.LoadInt32(&firstFail)) < i {
+				return
+			}
+			if errs[i] = c.count(c.checker.Validate(e)); errs[i] != nil {
+				for {
+					prev := atomic.LoadInt32(&firstFail)
+					if int(prev) <= i || atomic.CompareAndSwapInt32(&firstFail, prev, int32(i)) {
+						break
+					}
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	// return the first error in order of addition, to make the result deterministic
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateParents runs all the parents checkers
+func (p *Pipeline) ValidateParents(e dag.Event, parents dag.Events) error {
+	for _, c := range p.parents {
+		if err := c.count(c.checker.Validate(e, parents)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate runs all the checkers
+func (p *Pipeline) Validate(e dag.Event, parents dag.Events) error {
+	if err := p.ValidateParentless(e); err != nil {
+		return err
+	}
+	return p.ValidateParents(e, parents)
+}
+
+// CheckParentless has the signature of dagprocessor.EventCallback.CheckParentless
+func (p *Pipeline) CheckParentless(e dag.Event, checked func(error)) {
+	checked(p.ValidateParentless(e))
+}
+
+// CheckParents has the signature of dagprocessor.EventCallback.CheckParents
+func (p *Pipeline) CheckParents(e dag.Event, parents dag.Events) error {
+	return p.ValidateParents(e, parents)
+}
+
+// Stats returns counters of every checker, by checker name
+func (p *Pipeline) Stats() map[string]CheckerStats {
+	res := make(map[string]CheckerStats, len(p.parentless)+len(p.parents))
+	for _, c := range p.parentless {
+		res[c.name] = c.stats()
+	}
+	for _, c := range p.parents {
+		res[c.name] = c.stats()
+	}
+	return res
+}
@@ -0,0 +1,117 @@
+package eventcheck
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/eventcheck/basiccheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/parentscheck"
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/dag/tdag"
+)
+
+var errTestSig = errors.New("bad signature")
+
+func TestPipelineMatchesCheckers(t *testing.T) {
+	checkers := Checkers{
+		Basiccheck:   basiccheck.New(),
+		Epochcheck:   epochcheck.New(new(testReader)),
+		Parentscheck: parentscheck.New(),
+	}
+	for _, parallel := range []bool{false, true} {
+		pipeline := checkers.Pipeline(parallel)
+
+		e := &tdag.TestEvent{}
+		e.SetSeq(2)
+		e.SetLamport(2)
+		e.SetCreator(1)
+		e.SetEpoch(1)
+		e.SetFrame(1)
+		e.SetParents(hash.Events{e.ID()})
+		parents := func() dag.Events {
+			p := &tdag.TestEvent{}
+			p.SetSeq(1)
+			p.SetLamport(1)
+			return dag.Events{p}
+		}()
+		require.Equal(t, checkers.Validate(e, parents), pipeline.Validate(e, parents))
+		require.Equal(t, parentscheck.ErrWrongSelfParent, pipeline.Validate(e, parents))
+
+		stats := pipeline.Stats()
+		require.Equal(t, uint64(2), stats["basiccheck"].Checked)
+		require.Equal(t, uint64(0), stats["basiccheck"].Failed)
+		require.Equal(t, uint64(2), stats["parentscheck"].Failed)
+		require.Equal(t, uint64(2), stats["parentscheck"].Errors[parentscheck.ErrWrongSelfParent.Error()])
+	}
+}
+
+func TestPipelineShortCircuit(t *testing.T) {
+	for _, parallel := range []bool{false, true} {
+		var sigChecked uint32
+		pipeline := NewPipeline(parallel).
+			AddParentless("basiccheck", basiccheck.New()).
+			AddParentless("sigcheck", CheckerFunc(func(e dag.Event) error {
+				atomic.AddUint32(&sigChecked, 1)
+				return errTestSig
+			})).
+			AddParents("parentscheck", ParentsCheckerFunc(func(e dag.Event, parents dag.Events) error {
+				t.Fatal("parents checker must not be called")
+				return nil
+			}))
+
+		e := &tdag.TestEvent{}
+		e.SetSeq(1)
+		e.SetLamport(1)
+		e.SetEpoch(1)
+		e.SetFrame(1)
+		require.Equal(t, errTestSig, pipeline.Validate(e, nil))
+
+		// the first error in order of addition is returned
+		e.SetSeq(0)
+		require.Equal(t, basiccheck.ErrNotInited, pipeline.Validate(e, nil))
+		if !parallel {
+			require.Equal(t, uint32(1), atomic.LoadUint32(&sigChecked))
+		}
+
+		var checkedErr error
+		pipeline.CheckParentless(e, func(err error) {
+			checkedErr = err
+		})
+		require.Equal(t, basiccheck.ErrNotInited, checkedErr)
+
+		stats := pipeline.Stats()
+		require.Equal(t, uint64(3), stats["basiccheck"].Checked)
+		require.Equal(t, uint64(2), stats["basiccheck"].Errors[basiccheck.ErrNotInited.Error()])
+		require.Equal(t, uint64(0), stats["parentscheck"].Checked)
+	}
+}
+
+func TestPipelineErrorClasses(t *testing.T) {
+	var n int
+	pipeline := NewPipeline(false).
+		AddParentless("sigcheck", CheckerFunc(func(e dag.Event) error {
+			n++
+			if n%2 == 0 {
+				return fmt.Errorf("event %d: %w", n, errTestSig)
+			}
+			return fmt.Errorf("unique error %d", n)
+		}))
+
+	e := &tdag.TestEvent{}
+	for i := 0; i < 1000; i++ {
+		require.Error(t, pipeline.Validate(e, nil))
+	}
+
+	stats := pipeline.Stats()["sigcheck"]
+	require.Equal(t, uint64(1000), stats.Failed)
+	// wrapped errors are counted by the sentinel, and distinct errors are capped
+	require.Equal(t, uint64(500), stats.Errors[errTestSig.Error()])
+	require.Len(t, stats.Errors, maxErrorClasses+1)
+	require.Equal(t, uint64(500-(maxErrorClasses-1)), stats.Errors[otherErrors])
+}
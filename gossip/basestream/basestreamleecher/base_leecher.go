@@ -21,6 +21,8 @@ type BaseLeecher struct {
 	Mu *sync.RWMutex
 
 	Terminated bool
+
+	progress sessionsProgress
 }
 
 // New creates a generic items downloader
@@ -31,6 +33,9 @@ func New(recheckInterval time.Duration, callback Callbacks) *BaseLeecher {
 		Peers:           make(map[string]struct{}),
 		Quit:            make(chan struct{}),
 		Mu:              new(sync.RWMutex),
+		progress: sessionsProgress{
+			sessions: make(map[uint32]*sessionProgress),
+		},
 	}
 }
 
@@ -101,7 +106,8 @@ func (d *BaseLeecher) PeersNum() int {
 	return len(d.Peers)
 }
 
-// UnregisterPeer removes a peer from the known list, preventing current or any future sessions with the peer
+// UnregisterPeer removes a peer from the known list, preventing current or any future sessions with the peer.
+// Progress of the terminated session is kept, so the next session may be resumed with ResumeSession.
 func (d *BaseLeecher) UnregisterPeer(peer string) error {
 	d.Mu.Lock()
 	defer d.Mu.Unlock()
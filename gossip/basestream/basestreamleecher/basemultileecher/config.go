@@ -0,0 +1,35 @@
+package basemultileecher
+
+import (
+	"time"
+)
+
+type Config struct {
+	RecheckInterval time.Duration
+	// Parallelism is the number of sub-ranges the locators range is split into,
+	// i.e. the maximum number of peers which download the range simultaneously
+	Parallelism int
+	// StallTimeout is the time allowance for a peer to respond, before its sub-range is reassigned to another peer
+	StallTimeout time.Duration
+
+	DefaultChunkItemsNum  uint32
+	DefaultChunkItemsSize uint64
+	// ChunksPerRequest is the number of chunks requested at once
+	ChunksPerRequest uint32
+
+	// MaxBufferedSize limits the size of payloads which arrived ahead of the delivery order.
+	// Sub-ranges ahead of the delivery order aren't requested further once the limit is reached.
+	MaxBufferedSize uint64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		RecheckInterval:       time.Second,
+		Parallelism:           4,
+		StallTimeout:          10 * time.Second,
+		DefaultChunkItemsNum:  500,
+		DefaultChunkItemsSize: 512 * 1024,
+		ChunksPerRequest:      4,
+		MaxBufferedSize:       64 * 1024 * 1024,
+	}
+}
@@ -0,0 +1,392 @@
+package basemultileecher
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/panoptisDev/lachesis-base/gossip/basestream"
+)
+
+/*
+ * Leecher downloads a range of locators from multiple peers in parallel.
+ * The range [Start, Stop) is split into sub-ranges, each of them is downloaded by a separate session with a peer.
+ * Payloads are delivered to the application in locator order, regardless of the order of their arrival.
+ * A sub-range is reassigned to another peer if its peer stalls or disconnects, continuing from the last received item.
+ */
+
+var (
+	ErrBusy       = errors.New("download is already in progress")
+	errTerminated = errors.New("terminated")
+)
+
+type Callbacks struct {
+	// Split returns up to n-1 ascending locators within (start, stop), which divide the range into sub-ranges
+	Split func(start, stop basestream.Locator, n int) []basestream.Locator
+	// LastLocator returns the locator of the last item in a non-empty payload
+	LastLocator func(payload basestream.Payload) basestream.Locator
+
+	RequestChunks func(peer string, r basestream.Request) error
+	// Deliver is called with payloads in locator order. Calls aren't concurrent, and it must not call the Leecher.
+	Deliver func(payload basestream.Payload)
+	// Done is called once the whole range is delivered. Optional.
+	Done func()
+}
+
+type subRange struct {
+	start basestream.Locator
+	stop  basestream.Locator
+	// next is the first locator which wasn't received yet
+	next basestream.Locator
+
+	peer    string
+	session uint32
+	// sessionStart is the start of the current session, the seeder doesn't allow to change it within a session
+	sessionStart  basestream.Locator
+	pendingChunks uint32
+	lastActivity  time.Time
+	done          bool
+
+	buffered     []basestream.Payload
+	bufferedSize uint64
+}
+
+// Leecher is a multi-peer downloader of a locators range
+type Leecher struct {
+	cfg      Config
+	callback Callbacks
+
+	mu          sync.Mutex
+	peers       []string // in order of preference, stalled peers are moved to the end
+	ranges      []*subRange
+	sessions    map[uint32]*subRange
+	rType       basestream.RequestType
+	current     int // index of the first sub-range which isn't fully delivered
+	buffered    uint64
+	sessionsSeq uint32
+	ready       []basestream.Payload
+	finished    bool
+
+	deliverMu sync.Mutex
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+	done bool
+}
+
+// New creates a multi-peer downloader
+func New(cfg Config, callback Callbacks) *Leecher {
+	return &Leecher{
+		cfg:      cfg,
+		callback: callback,
+		sessions: make(map[uint32]*subRange),
+		quit:     make(chan struct{}),
+		finished: true,
+	}
+}
+
+func (d *Leecher) Start() {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.loop()
+	}()
+}
+
+// Stop interrupts the leecher, canceling all the pending operations.
+// Stop waits until all the internal goroutines have finished.
+func (d *Leecher) Stop() {
+	d.mu.Lock()
+	if !d.done {
+		d.done = true
+		close(d.quit)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *Leecher) loop() {
+	ticker := time.NewTicker(d.cfg.RecheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+			d.update(func() {
+				d.reassignStalled()
+			})
+		}
+	}
+}
+
+// Download starts downloading of the locators range [start, stop)
+func (d *Leecher) Download(start, stop basestream.Locator, rType basestream.RequestType) error {
+	var err error
+	d.update(func() {
+		if d.done {
+			err = errTerminated
+			return
+		}
+		if !d.finished {
+			err = ErrBusy
+			return
+		}
+		bounds := append([]basestream.Locator{start}, d.callback.Split(start, stop, d.cfg.Parallelism)...)
+		bounds = append(bounds, stop)
+		d.ranges = d.ranges[:0]
+		for i := 0; i+1 < len(bounds); i++ {
+			d.ranges = append(d.ranges, &subRange{
+				start: bounds[i],
+				stop:  bounds[i+1],
+				next:  bounds[i],
+			})
+		}
+		d.rType = rType
+		d.current = 0
+		d.buffered = 0
+		d.finished = false
+	})
+	return err
+}
+
+// Finished returns true if no download is in progress
+func (d *Leecher) Finished() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.finished
+}
+
+// RegisterPeer adds a peer to download sub-ranges from
+func (d *Leecher) RegisterPeer(peer string) {
+	d.update(func() {
+		for _, p := range d.peers {
+			if p == peer {
+				return
+			}
+		}
+		d.peers = append(d.peers, peer)
+	})
+}
+
+// UnregisterPeer removes a peer, sub-ranges of the peer are reassigned to other peers
+func (d *Leecher) UnregisterPeer(peer string) {
+	d.update(func() {
+		for i, p := range d.peers {
+			if p == peer {
+				d.peers = append(d.peers[:i], d.peers[i+1:]...)
+				break
+			}
+		}
+		for _, r := range d.ranges {
+			if r.peer == peer {
+				d.unassign(r)
+			}
+		}
+	})
+}
+
+// PeersNum returns the number of registered peers
+func (d *Leecher) PeersNum() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.peers)
+}
+
+// NotifyChunkReceived injects a response of a peer
+func (d *Leecher) NotifyChunkReceived(peer string, resp basestream.Response) error {
+	var err error
+	d.update(func() {
+		if d.done {
+			err = errTerminated
+			return
+		}
+		r := d.sessions[resp.SessionID]
+		if r == nil || r.peer != peer {
+			// the session was reassigned or the download is finished
+			return
+		}
+		r.lastActivity = time.Now()
+		if r.pendingChunks > 0 {
+			r.pendingChunks--
+		}
+		if resp.Payload != nil && resp.Payload.Len() != 0 {
+			r.next = d.callback.LastLocator(resp.Payload).Inc()
+			d.push(r, resp.Payload)
+		}
+		if resp.Done {
+			r.done = true
+			d.unassign(r)
+			d.advance()
+		}
+	})
+	return err
+}
+
+// update applies the change under the lock, then sends the requests and delivers the payloads
+func (d *Leecher) update(change func()) {
+	d.mu.Lock()
+	change()
+	requests := d.schedule()
+	d.mu.Unlock()
+
+	for _, r := range requests {
+		if d.callback.RequestChunks(r.peer, r.request) != nil {
+			d.update(func() {
+				// the peer will get the sub-range again only after other peers
+				d.stalled(r.peer, r.request.Session.ID)
+			})
+		}
+	}
+	d.deliver()
+}
+
+func (d *Leecher) push(r *subRange, payload basestream.Payload) {
+	if d.ranges[d.current] == r {
+		d.ready = append(d.ready, payload)
+		return
+	}
+	r.buffered = append(r.buffered, payload)
+	r.bufferedSize += uint64(payload.TotalMemSize())
+	d.buffered += uint64(payload.TotalMemSize())
+}
+
+// advance moves the delivery position over the complete sub-ranges
+func (d *Leecher) advance() {
+	for d.current < len(d.ranges) && d.ranges[d.current].done {
+		d.current++
+		if d.current < len(d.ranges) {
+			r := d.ranges[d.current]
+			d.ready = append(d.ready, r.buffered...)
+			d.buffered -= r.bufferedSize
+			r.buffered = nil
+			r.bufferedSize = 0
+		}
+	}
+	if d.current == len(d.ranges) && !d.finished {
+		d.finished = true
+		d.ready = append(d.ready, nil) // marks the end of the download
+	}
+}
+
+func (d *Leecher) deliver() {
+	d.deliverMu.Lock()
+	defer d.deliverMu.Unlock()
+	for {
+		d.mu.Lock()
+		if len(d.ready) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		payload := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+		d.mu.Unlock()
+
+		if payload == nil {
+			if d.callback.Done != nil {
+				d.callback.Done()
+			}
+			continue
+		}
+		d.callback.Deliver(payload)
+	}
+}
+
+func (d *Leecher) unassign(r *subRange) {
+	delete(d.sessions, r.session)
+	r.peer = ""
+	r.pendingChunks = 0
+}
+
+// stalled unassigns the sub-range from the peer and moves the peer to the end of the preference order
+func (d *Leecher) stalled(peer string, session uint32) {
+	r := d.sessions[session]
+	if r == nil || r.peer != peer {
+		return
+	}
+	d.unassign(r)
+	for i, p := range d.peers {
+		if p == peer {
+			d.peers = append(append(d.peers[:i:i], d.peers[i+1:]...), peer)
+			break
+		}
+	}
+}
+
+func (d *Leecher) reassignStalled() {
+	now := time.Now()
+	for _, r := range d.ranges {
+		if r.peer != "" && r.pendingChunks > 0 && now.Sub(r.lastActivity) > d.cfg.StallTimeout {
+			d.stalled(r.peer, r.session)
+		}
+	}
+}
+
+type peerRequest struct {
+	peer    string
+	request basestream.Request
+}
+
+// schedule assigns sub-ranges to idle peers and returns the requests to send
+func (d *Leecher) schedule() []peerRequest {
+	if d.done || d.finished {
+		return nil
+	}
+	// sub-ranges ahead of the delivery order are paused if too many payloads are buffered
+	paused := func(i int) bool {
+		return i != d.current && d.buffered >= d.cfg.MaxBufferedSize
+	}
+	busy := make(map[string]bool, len(d.peers))
+	for i, r := range d.ranges {
+		if r.peer == "" {
+			continue
+		}
+		if r.pendingChunks == 0 && paused(i) {
+			// release the peer, the sub-range will be continued by a new session
+			d.unassign(r)
+			continue
+		}
+		busy[r.peer] = true
+	}
+	var requests []peerRequest
+	for i, r := range d.ranges {
+		if r.done || r.pendingChunks > 0 || paused(i) {
+			continue
+		}
+		if r.peer == "" {
+			// assign the sub-range to the most preferred idle peer
+			for _, p := range d.peers {
+				if !busy[p] {
+					busy[p] = true
+					d.sessionsSeq++
+					r.peer = p
+					r.session = d.sessionsSeq
+					r.sessionStart = r.next
+					d.sessions[r.session] = r
+					break
+				}
+			}
+			if r.peer == "" {
+				continue
+			}
+		}
+		r.pendingChunks = d.cfg.ChunksPerRequest
+		r.lastActivity = time.Now()
+		requests = append(requests, peerRequest{
+			peer: r.peer,
+			request: basestream.Request{
+				Session: basestream.Session{
+					ID:    r.session,
+					Start: r.sessionStart,
+					Stop:  r.stop,
+				},
+				Type:           d.rType,
+				MaxPayloadNum:  d.cfg.DefaultChunkItemsNum,
+				MaxPayloadSize: d.cfg.DefaultChunkItemsSize,
+				MaxChunks:      d.cfg.ChunksPerRequest,
+			},
+		})
+	}
+	return requests
+}
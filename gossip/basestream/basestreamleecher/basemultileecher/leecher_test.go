@@ -0,0 +1,154 @@
+package basemultileecher
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/gossip/basestream"
+	"github.com/panoptisDev/lachesis-base/gossip/basestream/basestreamseeder"
+)
+
+type testLocator uint64
+
+func (l testLocator) Compare(b basestream.Locator) int {
+	switch {
+	case l < b.(testLocator):
+		return -1
+	case l > b.(testLocator):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (l testLocator) Inc() basestream.Locator {
+	return l + 1
+}
+
+type testPayload []testLocator
+
+func (p testPayload) Len() int {
+	return len(p)
+}
+
+func (p testPayload) TotalSize() uint64 {
+	return uint64(len(p)) * 8
+}
+
+func (p testPayload) TotalMemSize() int {
+	return len(p) * 8
+}
+
+func TestLeecherParallelDownload(t *testing.T) {
+	for _, stalling := range []bool{false, true} {
+		testLeecherParallelDownload(t, 1000, stalling)
+	}
+}
+
+func testLeecherParallelDownload(t *testing.T, itemsNum testLocator, stalling bool) {
+	require := require.New(t)
+
+	seeder := basestreamseeder.New(basestreamseeder.Config{
+		SenderThreads:           4,
+		MaxSenderTasks:          128,
+		MaxPendingResponsesSize: 1024 * 1024,
+		MaxResponsePayloadNum:   1000,
+		MaxResponsePayloadSize:  1024 * 1024,
+		MaxResponseChunks:       8,
+	}, basestreamseeder.Callbacks{
+		ForEachItem: func(start basestream.Locator, _ basestream.RequestType, onKey func(basestream.Locator) bool, onAppended func(basestream.Payload) bool) basestream.Payload {
+			res := testPayload{}
+			for l := start.(testLocator); l < itemsNum; l++ {
+				if !onKey(l) {
+					break
+				}
+				res = append(res, l)
+				if !onAppended(res) {
+					break
+				}
+			}
+			return res
+		},
+	})
+	seeder.Start()
+	defer seeder.Stop()
+
+	var (
+		mu        sync.Mutex
+		delivered []testLocator
+		done      = make(chan struct{})
+		leecher   *Leecher
+	)
+	leecher = New(Config{
+		RecheckInterval:       5 * time.Millisecond,
+		Parallelism:           4,
+		StallTimeout:          50 * time.Millisecond,
+		DefaultChunkItemsNum:  17,
+		DefaultChunkItemsSize: 1024,
+		ChunksPerRequest:      3,
+		MaxBufferedSize:       512,
+	}, Callbacks{
+		Split: func(start, stop basestream.Locator, n int) []basestream.Locator {
+			from, to := start.(testLocator), stop.(testLocator)
+			var bounds []basestream.Locator
+			for i := 1; i < n; i++ {
+				bounds = append(bounds, from+(to-from)*testLocator(i)/testLocator(n))
+			}
+			return bounds
+		},
+		LastLocator: func(payload basestream.Payload) basestream.Locator {
+			items := payload.(testPayload)
+			return items[len(items)-1]
+		},
+		RequestChunks: func(peer string, r basestream.Request) error {
+			if stalling && peer == "stalled" {
+				// requests are never responded
+				return nil
+			}
+			err, peerErr := seeder.NotifyRequestReceived(basestreamseeder.Peer{
+				ID: peer,
+				SendChunk: func(resp basestream.Response) error {
+					return leecher.NotifyChunkReceived(peer, resp)
+				},
+				Misbehaviour: func(err error) {
+					t.Error("unexpected misbehaviour", err)
+				},
+			}, r)
+			require.NoError(peerErr)
+			return err
+		},
+		Deliver: func(payload basestream.Payload) {
+			mu.Lock()
+			defer mu.Unlock()
+			delivered = append(delivered, payload.(testPayload)...)
+		},
+		Done: func() {
+			close(done)
+		},
+	})
+	leecher.Start()
+	defer leecher.Stop()
+
+	leecher.RegisterPeer("stalled")
+	leecher.RegisterPeer("peer1")
+	leecher.RegisterPeer("peer2")
+	require.NoError(leecher.Download(testLocator(0), itemsNum, 0))
+	require.Equal(ErrBusy, leecher.Download(testLocator(0), itemsNum, 0))
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("download isn't finished")
+	}
+	require.True(leecher.Finished())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(delivered, int(itemsNum))
+	for i, l := range delivered {
+		require.Equal(testLocator(i), l)
+	}
+}
@@ -47,7 +47,7 @@ type BasePeerLeecher struct {
 	callback EpochDownloaderCallbacks
 }
 
-// New creates an items fetcher to retrieve items chunk-by-chunk. Works only with 1 peer.
+// New creates an items fetcher to retrieve items chunk-by-chunk. Works only with 1 peer, see basemultileecher for a multi-peer downloader.
 func New(wg *sync.WaitGroup, cfg EpochDownloaderConfig, callback EpochDownloaderCallbacks) *BasePeerLeecher {
 	quit := make(chan struct{})
 	return &BasePeerLeecher{
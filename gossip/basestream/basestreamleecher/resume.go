@@ -0,0 +1,105 @@
+package basestreamleecher
+
+import (
+	"sync"
+
+	"github.com/panoptisDev/lachesis-base/gossip/basestream"
+)
+
+// sessionProgress is the last fully processed locator of a session
+type sessionProgress struct {
+	// start is the first locator of the progress, items before it weren't downloaded by the session
+	start     basestream.Locator
+	processed basestream.Locator
+}
+
+// sessionsProgress keeps the progress of sessions, so a session which was interrupted
+// (e.g. because the peer was disconnected) may be resumed with another peer.
+// It's guarded by its own mutex, because sessions are started under BaseLeecher.Mu.
+type sessionsProgress struct {
+	mu       sync.Mutex
+	sessions map[uint32]*sessionProgress
+}
+
+// NotifyProcessed records that all the items of the session up to the locator (inclusive) are processed.
+// Locators must be reported in order, and the progress never goes backwards.
+func (d *BaseLeecher) NotifyProcessed(session basestream.Session, locator basestream.Locator) {
+	d.progress.mu.Lock()
+	defer d.progress.mu.Unlock()
+
+	p := d.progress.sessions[session.ID]
+	if p == nil {
+		p = &sessionProgress{
+			start: session.Start,
+		}
+		d.progress.sessions[session.ID] = p
+	}
+	if p.processed == nil || locator.Compare(p.processed) > 0 {
+		p.processed = locator
+	}
+}
+
+// Processed returns the last fully processed locator of the session, or nil if nothing was processed
+func (d *BaseLeecher) Processed(sessionID uint32) basestream.Locator {
+	d.progress.mu.Lock()
+	defer d.progress.mu.Unlock()
+
+	if p := d.progress.sessions[sessionID]; p != nil {
+		return p.processed
+	}
+	return nil
+}
+
+// ResumeSession adjusts Start of a new session to skip the items which were processed by previous sessions.
+// Start is set to Inc() of the highest processed locator within [Start, Stop] of the new session,
+// among the previous sessions which started at or before Start.
+// The new session replaces the previous ones, so their progress is dropped, and the resumed progress
+// is transferred to the new session.
+// It returns false if all the items of the new session are already processed, the progress is kept then.
+// It may be called from the StartSession callback.
+func (d *BaseLeecher) ResumeSession(session basestream.Session) (basestream.Session, bool) {
+	d.progress.mu.Lock()
+	defer d.progress.mu.Unlock()
+
+	var resumed basestream.Locator
+	for _, p := range d.progress.sessions {
+		if p.processed == nil || p.processed.Compare(session.Start) < 0 {
+			continue
+		}
+		if p.start == nil || p.start.Compare(session.Start) > 0 {
+			// items between Start and the start of the previous session weren't downloaded
+			continue
+		}
+		if session.Stop != nil && p.processed.Compare(session.Stop) > 0 {
+			// the previous session covers a different range
+			continue
+		}
+		if resumed == nil || p.processed.Compare(resumed) > 0 {
+			resumed = p.processed
+		}
+	}
+	if resumed != nil && session.Stop != nil && resumed.Compare(session.Stop) >= 0 {
+		// keep the progress, so the session isn't restarted until it's forgotten
+		return session, false
+	}
+	for id := range d.progress.sessions {
+		delete(d.progress.sessions, id)
+	}
+	if resumed == nil {
+		return session, true
+	}
+	d.progress.sessions[session.ID] = &sessionProgress{
+		start:     session.Start,
+		processed: resumed,
+	}
+	session.Start = resumed.Inc()
+	return session, true
+}
+
+// ForgetSession drops the progress of a session. It should be called once a session is complete.
+func (d *BaseLeecher) ForgetSession(sessionID uint32) {
+	d.progress.mu.Lock()
+	defer d.progress.mu.Unlock()
+
+	delete(d.progress.sessions, sessionID)
+}
@@ -0,0 +1,128 @@
+package basestreamleecher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/gossip/basestream"
+)
+
+type testLocator uint64
+
+func (l testLocator) Compare(b basestream.Locator) int {
+	switch {
+	case l < b.(testLocator):
+		return -1
+	case l > b.(testLocator):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func (l testLocator) Inc() basestream.Locator {
+	return l + 1
+}
+
+func TestLeecherResumeSession(t *testing.T) {
+	require := require.New(t)
+
+	var started []basestream.Session
+	ongoing := ""
+	sessionID := uint32(0)
+	var leecher *BaseLeecher
+	leecher = New(time.Hour, Callbacks{
+		SelectSessionPeerCandidates: func() []string {
+			var candidates []string
+			for peer := range leecher.Peers {
+				candidates = append(candidates, peer)
+			}
+			return candidates
+		},
+		ShouldTerminateSession: func() bool {
+			return false
+		},
+		StartSession: func(candidates []string) {
+			sessionID++
+			session, ok := leecher.ResumeSession(basestream.Session{
+				ID:    sessionID,
+				Start: testLocator(0),
+				Stop:  testLocator(100),
+			})
+			if ok {
+				ongoing = candidates[0]
+				started = append(started, session)
+			}
+		},
+		TerminateSession: func() {
+			ongoing = ""
+		},
+		OngoingSession: func() bool {
+			return ongoing != ""
+		},
+		OngoingSessionPeer: func() string {
+			return ongoing
+		},
+	})
+	defer leecher.Stop()
+
+	require.NoError(leecher.RegisterPeer("peer1"))
+	leecher.Mu.Lock()
+	leecher.Routine()
+	leecher.Mu.Unlock()
+	require.Len(started, 1)
+	require.Equal(testLocator(0), started[0].Start)
+
+	// the first session is interrupted in the middle
+	leecher.NotifyProcessed(started[0], testLocator(40))
+	leecher.NotifyProcessed(started[0], testLocator(30)) // progress doesn't go backwards
+	require.Equal(testLocator(40), leecher.Processed(started[0].ID))
+	require.NoError(leecher.RegisterPeer("peer2"))
+	require.NoError(leecher.UnregisterPeer(ongoing))
+
+	// the new session continues from the next locator
+	require.Len(started, 2)
+	require.Equal(testLocator(41), started[1].Start)
+	require.Equal(testLocator(100), started[1].Stop)
+	require.Nil(leecher.Processed(started[0].ID))
+	require.Equal(testLocator(40), leecher.Processed(started[1].ID))
+
+	// completed sessions aren't restarted
+	leecher.NotifyProcessed(started[1], testLocator(100))
+	require.NoError(leecher.UnregisterPeer(ongoing))
+	require.Len(started, 2)
+	require.Empty(ongoing)
+
+	leecher.ForgetSession(started[1].ID)
+	require.NoError(leecher.RegisterPeer("peer3"))
+	leecher.Mu.Lock()
+	leecher.Routine()
+	leecher.Mu.Unlock()
+	require.Len(started, 3)
+	require.Equal(testLocator(0), started[2].Start)
+}
+
+func TestLeecherResumeSessionRanges(t *testing.T) {
+	require := require.New(t)
+	leecher := New(time.Hour, Callbacks{})
+
+	// an earlier session started in the middle of the range
+	leecher.NotifyProcessed(basestream.Session{ID: 1, Start: testLocator(500), Stop: testLocator(1000)}, testLocator(600))
+
+	// a session which starts before it isn't resumed, because the items before 500 weren't downloaded
+	session, ok := leecher.ResumeSession(basestream.Session{ID: 2, Start: testLocator(0), Stop: testLocator(1000)})
+	require.True(ok)
+	require.Equal(testLocator(0), session.Start)
+	// the replaced session is dropped
+	require.Nil(leecher.Processed(1))
+
+	leecher.NotifyProcessed(session, testLocator(700))
+	session, ok = leecher.ResumeSession(basestream.Session{ID: 3, Start: testLocator(100), Stop: testLocator(1000)})
+	require.True(ok)
+	require.Equal(testLocator(701), session.Start)
+	require.Nil(leecher.Processed(2))
+	require.Equal(testLocator(700), leecher.Processed(3))
+	require.Len(leecher.progress.sessions, 1)
+}
@@ -1,5 +1,10 @@
 package basestreamseeder
 
+import "time"
+
+// DefaultMaxPeerSessions is the limit of sessions per peer if Config.MaxPeerSessions is zero
+const DefaultMaxPeerSessions = 3
+
 type Config struct {
 	SenderThreads           int
 	MaxSenderTasks          int
@@ -7,4 +12,20 @@ type Config struct {
 	MaxResponsePayloadNum   uint32
 	MaxResponsePayloadSize  uint64
 	MaxResponseChunks       uint32
+
+	// Per-peer rate limits of produced chunks. Zero disables a limit, zero burst defaults to the rate.
+	PeerBytesPerSec  uint64
+	PeerBytesBurst   uint64
+	PeerChunksPerSec uint32
+	PeerChunksBurst  uint32
+
+	// MaxPeerSessions limits the number of sessions of a peer, the oldest session of the peer is dropped to fit a new one.
+	// Zero means DefaultMaxPeerSessions.
+	MaxPeerSessions int
+	// MaxSessions limits the total number of sessions, the least recently active session is dropped to fit a new one.
+	// Zero disables the limit.
+	MaxSessions int
+	// SessionIdleTimeout is the time after which a session without queued chunks and new requests is dropped.
+	// Zero disables the expiry.
+	SessionIdleTimeout time.Duration
 }
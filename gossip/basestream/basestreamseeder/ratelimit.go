@@ -0,0 +1,59 @@
+package basestreamseeder
+
+import (
+	"time"
+)
+
+// tokenBucket is a rate limiter, which allows to go into debt, so a chunk of unknown size may be produced
+// whenever at least one token is available. The debt is paid off before the next chunk is allowed.
+type tokenBucket struct {
+	rate   float64 // tokens per second, zero disables the limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64, now time.Time) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += b.rate * elapsed.Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// wait returns the time until a token is available, or zero if it's available already
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1-b.tokens)/b.rate*float64(time.Second)) + time.Millisecond
+}
+
+func (b *tokenBucket) take(now time.Time, n float64) {
+	if b.rate <= 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= n
+}
@@ -2,6 +2,7 @@ package basestreamseeder
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,16 +17,23 @@ var (
 	errTerminated       = errors.New("terminated")
 )
 
+// maxQueuedRequests is the number of requests of a session, which chunks may be queued
+const maxQueuedRequests = 4
+
 type BaseSeeder struct {
 	callback Callbacks
 
-	peerSessions map[string][]uint32
-	sessions     map[sessionIDAndPeer]sessionState
+	peers    map[string]*peerState
+	sessions map[sessionIDAndPeer]*sessionState
+	// round-robin order of peers with queued chunks
+	activePeers []string
 
 	notifyUnregisteredPeer chan string
 	notifyReceivedRequest  chan *requestAndPeer
-	quit                   chan struct{}
-	done                   bool
+	notifySessionsQuery    chan chan []SessionInfo
+	// notifyResponseSent is signaled when pending responses size decreases
+	notifyResponseSent chan struct{}
+	quit               chan struct{}
 
 	cfg Config
 
@@ -34,18 +42,24 @@ type BaseSeeder struct {
 	senders              []*workers.Workers
 	pendingResponsesSize int64
 	sessionsCounter      uint32
+
+	usageMu sync.Mutex
+	usage   map[string]*PeerUsage
 }
 
 func New(cfg Config, callbacks Callbacks) *BaseSeeder {
 	s := &BaseSeeder{
 		callback:               callbacks,
-		peerSessions:           make(map[string][]uint32),
-		sessions:               make(map[sessionIDAndPeer]sessionState),
+		peers:                  make(map[string]*peerState),
+		sessions:               make(map[sessionIDAndPeer]*sessionState),
 		notifyUnregisteredPeer: make(chan string, 128),
 		notifyReceivedRequest:  make(chan *requestAndPeer, 16),
+		notifySessionsQuery:    make(chan chan []SessionInfo),
+		notifyResponseSent:     make(chan struct{}, 1),
 		senders:                make([]*workers.Workers, cfg.SenderThreads),
 		quit:                   make(chan struct{}),
 		cfg:                    cfg,
+		usage:                  make(map[string]*PeerUsage),
 	}
 	for i := 0; i < cfg.SenderThreads; i++ {
 		s.senders[i] = workers.New(&s.wg, s.quit, s.cfg.MaxSenderTasks)
@@ -80,6 +94,51 @@ type sessionState struct {
 	done         bool
 	senderI      int
 	sendChunk    func(basestream.Response) error
+
+	// parameters of the last request
+	rType          basestream.RequestType
+	maxPayloadNum  uint32
+	maxPayloadSize uint64
+	// queuedChunks is the number of requested chunks which aren't produced yet
+	queuedChunks uint32
+
+	created      time.Time
+	lastActivity time.Time
+	// updated atomically by senders
+	sentChunks uint64
+	sentBytes  uint64
+}
+
+type peerState struct {
+	sessions []uint32 // in order of creation
+	cursor   int      // round-robin position in sessions
+	bytes    *tokenBucket
+	chunks   *tokenBucket
+	usage    *PeerUsage
+}
+
+// PeerUsage is a seeding statistics of a peer
+type PeerUsage struct {
+	Sessions     int    // Number of sessions
+	QueuedChunks uint32 // Number of requested chunks which aren't produced yet
+	PendingSize  int64  // Memory size of produced chunks which aren't sent yet
+	SentChunks   uint64 // Total number of sent chunks
+	SentBytes    uint64 // Total size of sent payloads
+}
+
+// SessionInfo is a state of a seeding session
+type SessionInfo struct {
+	ID           uint32
+	Peer         string
+	Start        basestream.Locator
+	Stop         basestream.Locator
+	Next         basestream.Locator // Next locator to be produced
+	Done         bool               // All the items of the session are produced
+	QueuedChunks uint32             // Number of requested chunks which aren't produced yet
+	SentChunks   uint64
+	SentBytes    uint64
+	Created      time.Time
+	LastActivity time.Time // Time of the last request or produced chunk
 }
 
 func (s *BaseSeeder) Start() {
@@ -97,7 +156,6 @@ func (s *BaseSeeder) Start() {
 // Stop waits until all the internal goroutines have finished.
 func (s *BaseSeeder) Stop() {
 	close(s.quit)
-	s.done = true
 	for i := 0; i < s.cfg.SenderThreads; i++ {
 		s.senders[i].Drain()
 	}
@@ -137,97 +195,395 @@ func (s *BaseSeeder) UnregisterPeer(peer string) error {
 	}
 }
 
-func (s *BaseSeeder) waitPendingResponsesBelowLimit() {
-	for atomic.LoadInt64(&s.pendingResponsesSize) >= s.cfg.MaxPendingResponsesSize {
-		if s.done {
-			// terminating, abort all operations
-			return
-		}
-		// we shouldn't get here normally, so it's fine to spin instead of a conditional variable
-		time.Sleep(10 * time.Millisecond)
+// PeersUsage returns the seeding statistics of the peers with sessions
+func (s *BaseSeeder) PeersUsage() map[string]PeerUsage {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	res := make(map[string]PeerUsage, len(s.usage))
+	for peer, u := range s.usage {
+		res[peer] = *u
+	}
+	return res
+}
+
+// Sessions returns the active sessions, ordered by peer and session ID
+func (s *BaseSeeder) Sessions() ([]SessionInfo, error) {
+	res := make(chan []SessionInfo, 1)
+	select {
+	case s.notifySessionsQuery <- res:
+		return <-res, nil
+	case <-s.quit:
+		return nil, errTerminated
+	}
+}
+
+func (s *BaseSeeder) sessionsInfo() []SessionInfo {
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for key, session := range s.sessions {
+		infos = append(infos, SessionInfo{
+			ID:           key.id,
+			Peer:         key.peer,
+			Start:        session.origSelector,
+			Stop:         session.stop,
+			Next:         session.next,
+			Done:         session.done,
+			QueuedChunks: session.queuedChunks,
+			SentChunks:   atomic.LoadUint64(&session.sentChunks),
+			SentBytes:    atomic.LoadUint64(&session.sentBytes),
+			Created:      session.created,
+			LastActivity: session.lastActivity,
+		})
 	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Peer != infos[j].Peer {
+			return infos[i].Peer < infos[j].Peer
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+func (s *BaseSeeder) overloaded() bool {
+	return atomic.LoadInt64(&s.pendingResponsesSize) >= s.cfg.MaxPendingResponsesSize
 }
 
 func (s *BaseSeeder) readerLoop() {
+	// rateLimited is set if all the active peers are rate limited
+	var rateLimited <-chan time.Time
+	var expire <-chan time.Time
+	if s.cfg.SessionIdleTimeout > 0 {
+		ticker := time.NewTicker(s.cfg.SessionIdleTimeout / 2)
+		defer ticker.Stop()
+		expire = ticker.C
+	}
+
 	for {
+		// produce chunks while there's work and capacity, but check for new requests in between
+		if len(s.activePeers) != 0 && !s.overloaded() && rateLimited == nil {
+			select {
+			case <-s.quit:
+				return
+			case peerID := <-s.notifyUnregisteredPeer:
+				s.unregisterPeer(peerID)
+			case op := <-s.notifyReceivedRequest:
+				s.receiveRequest(op)
+			case res := <-s.notifySessionsQuery:
+				res <- s.sessionsInfo()
+			case <-expire:
+				s.expireIdleSessions()
+			default:
+				if wait := s.produceNext(); wait > 0 {
+					rateLimited = time.After(wait)
+				}
+			}
+			continue
+		}
+
 		// Wait for an outside event to occur
 		select {
 		case <-s.quit:
 			// terminating, abort all operations
 			return
-
 		case peerID := <-s.notifyUnregisteredPeer:
-			sessions := s.peerSessions[peerID]
-			for _, sid := range sessions {
-				delete(s.sessions, sessionIDAndPeer{sid, peerID})
-			}
-			delete(s.peerSessions, peerID)
-
+			s.unregisterPeer(peerID)
 		case op := <-s.notifyReceivedRequest:
-			s.waitPendingResponsesBelowLimit()
-
-			// prune oldest session
-			sessions := s.peerSessions[op.peer.ID]
-			if len(sessions) > 2 {
-				oldest := sessions[0]
-				sessions = sessions[1:]
-				delete(s.sessions, sessionIDAndPeer{oldest, op.peer.ID})
-			}
+			s.receiveRequest(op)
+			// the request may be of a peer which isn't rate limited
+			rateLimited = nil
+		case res := <-s.notifySessionsQuery:
+			res <- s.sessionsInfo()
+		case <-expire:
+			s.expireIdleSessions()
+		case <-s.notifyResponseSent:
+		case <-rateLimited:
+			rateLimited = nil
+		}
+	}
+}
 
-			// add session
-			session, ok := s.sessions[sessionIDAndPeer{op.request.Session.ID, op.peer.ID}]
-			if !ok {
-				session.origSelector = op.request.Session.Start
-				session.next = op.request.Session.Start
-				session.stop = op.request.Session.Stop
-				session.sendChunk = op.peer.SendChunk
-				session.senderI = int(s.sessionsCounter % uint32(s.cfg.SenderThreads))
-				sessions = append(sessions, op.request.Session.ID)
-				s.peerSessions[op.peer.ID] = sessions
-				s.sessionsCounter++
-			}
+func (s *BaseSeeder) unregisterPeer(peerID string) {
+	peer := s.peers[peerID]
+	if peer == nil {
+		return
+	}
+	for _, sid := range peer.sessions {
+		delete(s.sessions, sessionIDAndPeer{sid, peerID})
+	}
+	delete(s.peers, peerID)
+	s.deactivatePeer(peerID)
 
-			// sanity check (cannot change session parameters after it's created)
-			if session.origSelector.Compare(op.request.Session.Start) != 0 {
-				op.peer.Misbehaviour(ErrSelectorMismatch)
-				continue
-			}
+	s.usageMu.Lock()
+	delete(s.usage, peerID)
+	s.usageMu.Unlock()
+}
+
+func (s *BaseSeeder) deactivatePeer(peerID string) {
+	for i, p := range s.activePeers {
+		if p == peerID {
+			s.activePeers = append(s.activePeers[:i], s.activePeers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *BaseSeeder) activatePeer(peerID string) {
+	for _, p := range s.activePeers {
+		if p == peerID {
+			return
+		}
+	}
+	s.activePeers = append(s.activePeers, peerID)
+}
 
-			for i := uint32(0); i < op.request.MaxChunks && !session.done; i++ {
-				allConsumed := true
-				resp := basestream.Response{}
-				lastKey := session.next
-				resp.Payload = s.callback.ForEachItem(session.next, op.request.Type, func(key basestream.Locator) bool {
-					if key.Compare(session.stop) >= 0 {
-						return false
-					}
-					lastKey = key
-					return true
-				}, func(items basestream.Payload) bool {
-					numReached := uint32(items.Len()) >= op.request.MaxPayloadNum
-					sizeReached := items.TotalSize() >= op.request.MaxPayloadSize
-					if numReached || sizeReached {
-						allConsumed = false
-						return false
-					}
-					return true
-				})
-				// update session
-				session.next = lastKey.Inc()
-				session.done = allConsumed
-				s.sessions[sessionIDAndPeer{op.request.Session.ID, op.peer.ID}] = session
-
-				resp.Done = allConsumed
-				resp.SessionID = op.request.Session.ID
-
-				memSize := resp.Payload.TotalMemSize()
-				s.waitPendingResponsesBelowLimit()
-				atomic.AddInt64(&s.pendingResponsesSize, int64(memSize))
-				_ = s.senders[session.senderI].Enqueue(func() {
-					_ = session.sendChunk(resp)
-					atomic.AddInt64(&s.pendingResponsesSize, -int64(memSize))
-				})
+func (s *BaseSeeder) peer(peerID string) *peerState {
+	peer := s.peers[peerID]
+	if peer == nil {
+		now := time.Now()
+		peer = &peerState{
+			bytes:  newTokenBucket(float64(s.cfg.PeerBytesPerSec), float64(s.cfg.PeerBytesBurst), now),
+			chunks: newTokenBucket(float64(s.cfg.PeerChunksPerSec), float64(s.cfg.PeerChunksBurst), now),
+			usage:  &PeerUsage{},
+		}
+		s.peers[peerID] = peer
+		s.usageMu.Lock()
+		s.usage[peerID] = peer.usage
+		s.usageMu.Unlock()
+	}
+	return peer
+}
+
+func (s *BaseSeeder) removeSessionByID(peerID string, sid uint32) {
+	peer := s.peers[peerID]
+	if peer == nil {
+		return
+	}
+	for i, id := range peer.sessions {
+		if id == sid {
+			s.removeSession(peerID, peer, i)
+			return
+		}
+	}
+}
+
+func (s *BaseSeeder) removeSession(peerID string, peer *peerState, i int) {
+	key := sessionIDAndPeer{peer.sessions[i], peerID}
+	queuedDiff := int64(0)
+	if session := s.sessions[key]; session != nil {
+		queuedDiff = -int64(session.queuedChunks)
+	}
+	delete(s.sessions, key)
+	peer.sessions = append(peer.sessions[:i], peer.sessions[i+1:]...)
+	if peer.cursor > i {
+		peer.cursor--
+	}
+	s.updateUsage(peer, queuedDiff)
+}
+
+// updateUsage updates the number of sessions and queued chunks of the peer
+func (s *BaseSeeder) updateUsage(peer *peerState, queuedDiff int64) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	peer.usage.QueuedChunks = uint32(int64(peer.usage.QueuedChunks) + queuedDiff)
+	peer.usage.Sessions = len(peer.sessions)
+}
+
+// evictLeastActiveSession drops the session with the oldest activity among all the peers
+func (s *BaseSeeder) evictLeastActiveSession() {
+	var oldest *sessionIDAndPeer
+	var oldestActivity time.Time
+	for key, session := range s.sessions {
+		if oldest == nil || session.lastActivity.Before(oldestActivity) {
+			key := key
+			oldest = &key
+			oldestActivity = session.lastActivity
+		}
+	}
+	if oldest != nil {
+		s.removeSessionByID(oldest.peer, oldest.id)
+	}
+}
+
+// expireIdleSessions drops the sessions which have no queued chunks and weren't requested for SessionIdleTimeout
+func (s *BaseSeeder) expireIdleSessions() {
+	now := time.Now()
+	for key, session := range s.sessions {
+		if session.queuedChunks == 0 && now.Sub(session.lastActivity) >= s.cfg.SessionIdleTimeout {
+			s.removeSessionByID(key.peer, key.id)
+		}
+	}
+}
+
+func (s *BaseSeeder) maxPeerSessions() int {
+	if s.cfg.MaxPeerSessions > 0 {
+		return s.cfg.MaxPeerSessions
+	}
+	return DefaultMaxPeerSessions
+}
+
+func (s *BaseSeeder) receiveRequest(op *requestAndPeer) {
+	peer := s.peer(op.peer.ID)
+
+	// add session
+	key := sessionIDAndPeer{op.request.Session.ID, op.peer.ID}
+	session, ok := s.sessions[key]
+	now := time.Now()
+	if !ok {
+		// prune oldest sessions to fit the new one
+		if len(peer.sessions) >= s.maxPeerSessions() {
+			s.removeSession(op.peer.ID, peer, 0)
+		}
+		if s.cfg.MaxSessions > 0 && len(s.sessions) >= s.cfg.MaxSessions {
+			s.evictLeastActiveSession()
+		}
+		session = &sessionState{
+			origSelector: op.request.Session.Start,
+			next:         op.request.Session.Start,
+			stop:         op.request.Session.Stop,
+			sendChunk:    op.peer.SendChunk,
+			senderI:      int(s.sessionsCounter % uint32(s.cfg.SenderThreads)),
+			created:      now,
+		}
+		s.sessions[key] = session
+		peer.sessions = append(peer.sessions, op.request.Session.ID)
+		s.sessionsCounter++
+	}
+
+	// sanity check (cannot change session parameters after it's created)
+	if session.origSelector.Compare(op.request.Session.Start) != 0 {
+		op.peer.Misbehaviour(ErrSelectorMismatch)
+		s.updateUsage(peer, 0)
+		return
+	}
+
+	session.lastActivity = now
+	session.rType = op.request.Type
+	session.maxPayloadNum = op.request.MaxPayloadNum
+	session.maxPayloadSize = op.request.MaxPayloadSize
+	if session.done {
+		// all the items are produced already, there's nothing to queue
+		s.updateUsage(peer, 0)
+		return
+	}
+	queued := session.queuedChunks + op.request.MaxChunks
+	if limit := maxQueuedRequests * s.cfg.MaxResponseChunks; queued > limit {
+		queued = limit
+	}
+	s.updateUsage(peer, int64(queued)-int64(session.queuedChunks))
+	session.queuedChunks = queued
+	if queued != 0 {
+		s.activatePeer(op.peer.ID)
+	}
+}
+
+// produceNext produces a chunk of the next active peer in round-robin order, whose rate limit isn't exceeded.
+// It returns the time to wait if all the active peers are rate limited.
+func (s *BaseSeeder) produceNext() time.Duration {
+	now := time.Now()
+	minWait := time.Duration(0)
+	for i := 0; i < len(s.activePeers); i++ {
+		peerID := s.activePeers[0]
+		// move the peer to the end of the round-robin order
+		s.activePeers = append(s.activePeers[1:], peerID)
+
+		peer := s.peers[peerID]
+		wait := peer.bytes.wait(now)
+		if chunksWait := peer.chunks.wait(now); chunksWait > wait {
+			wait = chunksWait
+		}
+		if wait > 0 {
+			if minWait == 0 || wait < minWait {
+				minWait = wait
 			}
+			continue
+		}
+		session, sid := s.nextSession(peer, peerID)
+		if session == nil {
+			s.deactivatePeer(peerID)
+			i--
+			continue
 		}
+		s.produceChunk(peerID, peer, sid, session, now)
+		return 0
 	}
+	return minWait
+}
+
+// nextSession returns the next session of the peer with queued chunks, in round-robin order
+func (s *BaseSeeder) nextSession(peer *peerState, peerID string) (*sessionState, uint32) {
+	for i := 0; i < len(peer.sessions); i++ {
+		if peer.cursor >= len(peer.sessions) {
+			peer.cursor = 0
+		}
+		sid := peer.sessions[peer.cursor]
+		peer.cursor++
+		session := s.sessions[sessionIDAndPeer{sid, peerID}]
+		if session != nil && session.queuedChunks != 0 && !session.done {
+			return session, sid
+		}
+	}
+	return nil, 0
+}
+
+func (s *BaseSeeder) produceChunk(peerID string, peer *peerState, sid uint32, session *sessionState, now time.Time) {
+	allConsumed := true
+	resp := basestream.Response{}
+	lastKey := session.next
+	resp.Payload = s.callback.ForEachItem(session.next, session.rType, func(key basestream.Locator) bool {
+		if key.Compare(session.stop) >= 0 {
+			return false
+		}
+		lastKey = key
+		return true
+	}, func(items basestream.Payload) bool {
+		numReached := uint32(items.Len()) >= session.maxPayloadNum
+		sizeReached := items.TotalSize() >= session.maxPayloadSize
+		if numReached || sizeReached {
+			allConsumed = false
+			return false
+		}
+		return true
+	})
+	// update session
+	session.next = lastKey.Inc()
+	session.done = allConsumed
+	session.lastActivity = now
+	queuedDiff := int64(-1)
+	session.queuedChunks--
+	if session.done {
+		queuedDiff -= int64(session.queuedChunks)
+		session.queuedChunks = 0
+	}
+	s.updateUsage(peer, queuedDiff)
+
+	resp.Done = allConsumed
+	resp.SessionID = sid
+
+	size := resp.Payload.TotalSize()
+	peer.bytes.take(now, float64(size))
+	peer.chunks.take(now, 1)
+
+	memSize := int64(resp.Payload.TotalMemSize())
+	usage := peer.usage
+	s.usageMu.Lock()
+	usage.PendingSize += memSize
+	s.usageMu.Unlock()
+	atomic.AddInt64(&s.pendingResponsesSize, memSize)
+
+	sendChunk := session.sendChunk
+	_ = s.senders[session.senderI].Enqueue(func() {
+		_ = sendChunk(resp)
+		atomic.AddInt64(&s.pendingResponsesSize, -memSize)
+		s.usageMu.Lock()
+		usage.PendingSize -= memSize
+		usage.SentChunks++
+		usage.SentBytes += size
+		s.usageMu.Unlock()
+		atomic.AddUint64(&session.sentChunks, 1)
+		atomic.AddUint64(&session.sentBytes, size)
+		// wake up the reader if it waits for the pending responses to be sent
+		select {
+		case s.notifyResponseSent <- struct{}{}:
+		default:
+		}
+	})
 }
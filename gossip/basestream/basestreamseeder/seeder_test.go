@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"math/big"
 	"math/rand"
+	"reflect"
 	"sort"
 	"strconv"
 	"sync"
@@ -194,3 +195,236 @@ func testSeederResponsesOrder(t *testing.T, maxPeers int, maxEvents int) {
 		}
 	}
 }
+
+// seqForEachItem serves items with locators [0, itemsNum), each item is 100 bytes.
+// Locators are single-byte, so itemsNum must not exceed 255.
+func seqForEachItem(itemsNum int64) func(start basestream.Locator, _ basestream.RequestType, onKey func(basestream.Locator) bool, onAppended func(basestream.Payload) bool) basestream.Payload {
+	return func(start basestream.Locator, _ basestream.RequestType, onKey func(basestream.Locator) bool, onAppended func(basestream.Payload) bool) basestream.Payload {
+		res := testPayload{}
+		for i := new(big.Int).SetBytes(start.(testLocator).B).Int64(); i < itemsNum; i++ {
+			if !onKey(testLocator{big.NewInt(i).Bytes()}) {
+				break
+			}
+			res.IDs = append(res.IDs, hash.Event{})
+			res.Size += 100
+			if !onAppended(res) {
+				break
+			}
+		}
+		return res
+	}
+}
+
+func seqRequest(sessionID uint32, chunks uint32) basestream.Request {
+	return basestream.Request{
+		Session: basestream.Session{
+			ID:    sessionID,
+			Start: testLocator{},
+			Stop:  testLocator{[]byte{255}},
+		},
+		MaxPayloadNum:  1,
+		MaxPayloadSize: 1000,
+		MaxChunks:      chunks,
+	}
+}
+
+func TestSeederRateLimit(t *testing.T) {
+	config := defaultConfig()
+	config.PeerChunksPerSec = 50
+	config.PeerChunksBurst = 1
+	seeder := New(config, Callbacks{
+		ForEachItem: seqForEachItem(255),
+	})
+	seeder.Start()
+	defer seeder.Stop()
+
+	const chunks = 10
+	received := make(chan struct{}, chunks)
+	start := time.Now()
+	err, peerErr := seeder.NotifyRequestReceived(Peer{
+		ID: "peer",
+		SendChunk: func(basestream.Response) error {
+			received <- struct{}{}
+			return nil
+		},
+		Misbehaviour: func(err error) {
+			t.Error("unexpected misbehaviour", err)
+		},
+	}, seqRequest(1, chunks))
+	require.NoError(t, err)
+	require.NoError(t, peerErr)
+	for i := 0; i < chunks; i++ {
+		<-received
+	}
+	// the first chunk is allowed by the burst
+	require.GreaterOrEqual(t, time.Since(start), (chunks-1)*time.Second/50)
+
+	require.Eventually(t, func() bool {
+		usage := seeder.PeersUsage()["peer"]
+		return usage.SentChunks == chunks && usage.SentBytes == chunks*100 && usage.PendingSize == 0 && usage.QueuedChunks == 0
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, 1, seeder.PeersUsage()["peer"].Sessions)
+}
+
+func TestSeederRoundRobin(t *testing.T) {
+	config := defaultConfig()
+	config.SenderThreads = 4
+	config.MaxPendingResponsesSize = 1 // only one chunk may be pending
+	seeder := New(config, Callbacks{
+		ForEachItem: seqForEachItem(255),
+	})
+	seeder.Start()
+	defer seeder.Stop()
+
+	release := make(chan struct{})
+	defer close(release)
+	greedy := Peer{
+		ID: "greedy",
+		SendChunk: func(basestream.Response) error {
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+			return nil
+		},
+		Misbehaviour: func(err error) {},
+	}
+	modestDone := make(chan struct{}, 1)
+	modest := Peer{
+		ID: "modest",
+		SendChunk: func(resp basestream.Response) error {
+			if resp.SessionID == 3 && len(resp.Payload.(testPayload).IDs) != 0 {
+				select {
+				case modestDone <- struct{}{}:
+				default:
+				}
+			}
+			return nil
+		},
+		Misbehaviour: func(err error) {},
+	}
+
+	for sid := uint32(0); sid < 3; sid++ {
+		_, _ = seeder.NotifyRequestReceived(greedy, seqRequest(sid, config.MaxResponseChunks))
+	}
+	// wait until the greedy peer occupies the seeder
+	require.Eventually(t, func() bool {
+		return seeder.PeersUsage()["greedy"].PendingSize != 0
+	}, 5*time.Second, time.Millisecond)
+	_, _ = seeder.NotifyRequestReceived(modest, seqRequest(3, 1))
+	time.Sleep(10 * time.Millisecond)
+
+	// the modest peer is served within a round of the greedy peer, despite the queued greedy chunks
+	served := false
+	for i := 0; i < 2 && !served; i++ {
+		release <- struct{}{}
+		select {
+		case <-modestDone:
+			served = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if !served {
+		t.Fatal("modest peer isn't served")
+	}
+	require.Greater(t, seeder.PeersUsage()["greedy"].QueuedChunks, uint32(2*config.MaxResponseChunks))
+}
+
+func TestSeederSessionsLimits(t *testing.T) {
+	config := defaultConfig()
+	config.MaxPeerSessions = 2
+	config.MaxSessions = 3
+	seeder := New(config, Callbacks{
+		ForEachItem: seqForEachItem(255),
+	})
+	seeder.Start()
+	defer seeder.Stop()
+
+	peer := func(id string) Peer {
+		return Peer{
+			ID:           id,
+			SendChunk:    func(basestream.Response) error { return nil },
+			Misbehaviour: func(err error) { t.Error("unexpected misbehaviour", err) },
+		}
+	}
+	type sessionKey struct {
+		peer string
+		id   uint32
+	}
+	request := func(peerID string, sid uint32, expected ...sessionKey) {
+		_, _ = seeder.NotifyRequestReceived(peer(peerID), seqRequest(sid, 0))
+		require.Eventually(t, func() bool {
+			sessions, err := seeder.Sessions()
+			require.NoError(t, err)
+			got := make([]sessionKey, len(sessions))
+			for i, s := range sessions {
+				got[i] = sessionKey{s.Peer, s.ID}
+			}
+			return reflect.DeepEqual(expected, got)
+		}, 5*time.Second, time.Millisecond)
+	}
+
+	request("a", 1, sessionKey{"a", 1})
+	request("a", 2, sessionKey{"a", 1}, sessionKey{"a", 2})
+	// the oldest session of the peer is dropped
+	request("a", 3, sessionKey{"a", 2}, sessionKey{"a", 3})
+	request("b", 1, sessionKey{"a", 2}, sessionKey{"a", 3}, sessionKey{"b", 1})
+	// the least recently active session is dropped
+	request("a", 2, sessionKey{"a", 2}, sessionKey{"a", 3}, sessionKey{"b", 1})
+	request("b", 2, sessionKey{"a", 2}, sessionKey{"b", 1}, sessionKey{"b", 2})
+}
+
+func TestSeederSessionsExpiry(t *testing.T) {
+	config := defaultConfig()
+	config.SessionIdleTimeout = 200 * time.Millisecond
+	seeder := New(config, Callbacks{
+		ForEachItem: seqForEachItem(10),
+	})
+	seeder.Start()
+	defer seeder.Stop()
+
+	sent := make(chan struct{}, 1)
+	peer := Peer{
+		ID: "peer",
+		SendChunk: func(resp basestream.Response) error {
+			if resp.Done {
+				sent <- struct{}{}
+			}
+			return nil
+		},
+		Misbehaviour: func(err error) { t.Error("unexpected misbehaviour", err) },
+	}
+	_, _ = seeder.NotifyRequestReceived(peer, seqRequest(1, config.MaxResponseChunks))
+	<-sent
+
+	sessions, err := seeder.Sessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	info := sessions[0]
+	require.Equal(t, "peer", info.Peer)
+	require.Equal(t, uint32(1), info.ID)
+	require.True(t, info.Done)
+	require.Equal(t, uint32(0), info.QueuedChunks)
+	require.Equal(t, testLocator{}, info.Start)
+	require.Equal(t, testLocator{[]byte{255}}, info.Stop)
+
+	// chunks aren't queued for a finished session
+	_, _ = seeder.NotifyRequestReceived(peer, seqRequest(1, config.MaxResponseChunks))
+	require.Eventually(t, func() bool {
+		sessions, err := seeder.Sessions()
+		require.NoError(t, err)
+		return len(sessions) == 1 && sessions[0].LastActivity.After(info.LastActivity)
+	}, 5*time.Second, time.Millisecond)
+	sessions, err = seeder.Sessions()
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), sessions[0].QueuedChunks)
+	require.Equal(t, uint32(0), seeder.PeersUsage()["peer"].QueuedChunks)
+
+	// the session is dropped once it's idle
+	require.Eventually(t, func() bool {
+		sessions, err := seeder.Sessions()
+		require.NoError(t, err)
+		return len(sessions) == 0
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, 0, seeder.PeersUsage()["peer"].Sessions)
+}
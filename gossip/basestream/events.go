@@ -0,0 +1,100 @@
+package basestream
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+// EventLocator is a position in a stream of events, ordered by epoch, Lamport time and ID.
+// Event IDs are epoch+lamport prefixed, so it's the binary order of IDs.
+type EventLocator hash.Event
+
+// LamportLocator returns the lowest locator of the events with the specified epoch and Lamport time
+func LamportLocator(epoch idx.Epoch, lamport idx.Lamport) EventLocator {
+	var l EventLocator
+	binary.BigEndian.PutUint32(l[0:4], uint32(epoch))
+	binary.BigEndian.PutUint32(l[4:8], uint32(lamport))
+	return l
+}
+
+func (l EventLocator) Compare(b Locator) int {
+	r := b.(EventLocator)
+	return bytes.Compare(l[:], r[:])
+}
+
+// Inc returns the next locator, i.e. the locator incremented as a big-endian number
+func (l EventLocator) Inc() Locator {
+	for i := len(l) - 1; i >= 0; i-- {
+		l[i]++
+		if l[i] != 0 {
+			break
+		}
+	}
+	return l
+}
+
+func (l EventLocator) ID() hash.Event {
+	return hash.Event(l)
+}
+
+func (l EventLocator) Epoch() idx.Epoch {
+	return hash.Event(l).Epoch()
+}
+
+func (l EventLocator) Lamport() idx.Lamport {
+	return hash.Event(l).Lamport()
+}
+
+// SplitByLamport returns up to n-1 ascending locators within (start, stop), which divide
+// a range of EventLocators of a single epoch into sub-ranges of equal Lamport intervals
+func SplitByLamport(start, stop Locator, n int) []Locator {
+	from, to := start.(EventLocator), stop.(EventLocator)
+	if from.Epoch() != to.Epoch() || to.Lamport() <= from.Lamport() {
+		return nil
+	}
+	var bounds []Locator
+	for i := 1; i < n; i++ {
+		lamport := from.Lamport() + (to.Lamport()-from.Lamport())*idx.Lamport(i)/idx.Lamport(n)
+		bound := LamportLocator(from.Epoch(), lamport)
+		if bound.Compare(from) > 0 && (len(bounds) == 0 || bound.Compare(bounds[len(bounds)-1]) > 0) {
+			bounds = append(bounds, bound)
+		}
+	}
+	return bounds
+}
+
+// EventsPayload is a chunk of a stream of events
+type EventsPayload struct {
+	Events dag.Events
+	Size   uint64 // Total Size() of the events
+}
+
+// eventMemOverhead is an approximate memory size of an event, besides its serialized size
+const eventMemOverhead = 128
+
+func (p *EventsPayload) AddEvent(e dag.Event) {
+	p.Events = append(p.Events, e)
+	p.Size += uint64(e.Size())
+}
+
+func (p *EventsPayload) Len() int {
+	return len(p.Events)
+}
+
+func (p *EventsPayload) TotalSize() uint64 {
+	return p.Size
+}
+
+func (p *EventsPayload) TotalMemSize() int {
+	return int(p.Size) + len(p.Events)*eventMemOverhead
+}
+
+// LastEventLocator returns the locator of the last event in a non-empty EventsPayload
+func LastEventLocator(payload Payload) Locator {
+	events := payload.(*EventsPayload).Events
+	return EventLocator(events[len(events)-1].ID())
+}
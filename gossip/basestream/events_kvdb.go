@@ -0,0 +1,37 @@
+package basestream
+
+import (
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+// ForEachItemFn is the type of basestreamseeder.Callbacks.ForEachItem
+type ForEachItemFn func(start Locator, rType RequestType, onKey func(key Locator) bool, onAppended func(items Payload) bool) Payload
+
+// EventsTableForEachItem returns a seeder ForEachItem callback, which streams events from a table keyed by hash.Event bytes.
+// Events are streamed as EventsPayload starting from an EventLocator, the request type is ignored.
+// decode unmarshals an event from a table value, the value must be copied if it's retained.
+// Records which are decoded as nil are skipped.
+func EventsTableForEachItem(table kvdb.Iteratee, decode func(id hash.Event, b []byte) dag.Event) ForEachItemFn {
+	return func(start Locator, _ RequestType, onKey func(Locator) bool, onAppended func(Payload) bool) Payload {
+		res := &EventsPayload{}
+		it := table.NewIterator(nil, start.(EventLocator).ID().Bytes())
+		defer it.Release()
+		for it.Next() {
+			id := hash.BytesToEvent(it.Key())
+			if !onKey(EventLocator(id)) {
+				break
+			}
+			e := decode(id, it.Value())
+			if e == nil {
+				continue
+			}
+			res.AddEvent(e)
+			if !onAppended(res) {
+				break
+			}
+		}
+		return res
+	}
+}
@@ -0,0 +1,115 @@
+package basestream
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/dag/tdag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+)
+
+func TestEventLocator(t *testing.T) {
+	require := require.New(t)
+
+	a := LamportLocator(2, 5)
+	require.Equal(idx.Epoch(2), a.Epoch())
+	require.Equal(idx.Lamport(5), a.Lamport())
+	require.Equal(hash.Event{}, LamportLocator(0, 0).ID())
+
+	// ordered by epoch, then by lamport, then by ID
+	require.Equal(-1, LamportLocator(1, 100).Compare(LamportLocator(2, 1)))
+	require.Equal(-1, LamportLocator(2, 4).Compare(a))
+	require.Equal(-1, a.Compare(a.Inc()))
+	require.Equal(0, a.Compare(LamportLocator(2, 5)))
+	require.Equal(1, LamportLocator(2, 6).Compare(a))
+
+	// the increment is carried over
+	var l EventLocator
+	for i := 8; i < len(l); i++ {
+		l[i] = 0xff
+	}
+	require.Equal(LamportLocator(0, 1), l.Inc())
+	require.Equal(-1, l.Compare(l.Inc()))
+}
+
+func TestSplitByLamport(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]Locator{
+		LamportLocator(1, 25),
+		LamportLocator(1, 50),
+		LamportLocator(1, 75),
+	}, SplitByLamport(LamportLocator(1, 0), LamportLocator(1, 100), 4))
+	// sub-ranges are never empty
+	require.Equal([]Locator{
+		LamportLocator(1, 11),
+	}, SplitByLamport(LamportLocator(1, 10), LamportLocator(1, 12), 4))
+	require.Empty(SplitByLamport(LamportLocator(1, 10), LamportLocator(2, 12), 4))
+	require.Empty(SplitByLamport(LamportLocator(1, 10), LamportLocator(1, 10), 4))
+}
+
+func TestEventsTableForEachItem(t *testing.T) {
+	require := require.New(t)
+
+	events := make(map[hash.Event]dag.Event)
+	var ordered dag.Events
+	table := memorydb.New()
+	tdag.ForEachRandEvent(tdag.GenNodes(5), 20, 3, rand.New(rand.NewSource(0)), tdag.ForEachEvent{ // nolint:gosec
+		Process: func(e dag.Event, name string) {
+			events[e.ID()] = e
+			ordered = append(ordered, e)
+			require.NoError(table.Put(e.ID().Bytes(), e.(*tdag.TestEvent).Bytes()))
+		},
+		Build: func(e dag.MutableEvent, name string) error {
+			e.SetEpoch(1)
+			return nil
+		},
+	})
+	sort.Slice(ordered, func(i, j int) bool {
+		return EventLocator(ordered[i].ID()).Compare(EventLocator(ordered[j].ID())) < 0
+	})
+	// a record which isn't decoded is skipped
+	skipped := ordered[10]
+	ordered = append(ordered[:10], ordered[11:]...)
+
+	forEachItem := EventsTableForEachItem(table, func(id hash.Event, b []byte) dag.Event {
+		require.NotEmpty(b)
+		if id == skipped.ID() {
+			return nil
+		}
+		return events[id]
+	})
+
+	// stream [lamport 3, lamport 10) in chunks of 7 events
+	stop := LamportLocator(1, 10)
+	var streamed dag.Events
+	for next := Locator(LamportLocator(1, 3)); ; {
+		payload := forEachItem(next, 0, func(key Locator) bool {
+			return key.Compare(stop) < 0
+		}, func(items Payload) bool {
+			return items.Len() < 7
+		})
+		require.LessOrEqual(payload.Len(), 7)
+		if payload.Len() == 0 {
+			break
+		}
+		require.Equal(payload.(*EventsPayload).Events.Metric().Size, payload.TotalSize())
+		streamed = append(streamed, payload.(*EventsPayload).Events...)
+		next = LastEventLocator(payload).Inc()
+	}
+
+	var expected dag.Events
+	for _, e := range ordered {
+		if e.Lamport() >= 3 && e.Lamport() < 10 {
+			expected = append(expected, e)
+		}
+	}
+	require.NotEmpty(expected)
+	require.Equal(expected, streamed)
+}
@@ -1,7 +1,9 @@
 package dagordering
 
 import (
+	"bytes"
 	"math"
+	"sort"
 	"sync"
 
 	"github.com/panoptisDev/lachesis-base/eventcheck"
@@ -19,6 +21,15 @@ type (
 		peer     string
 		err      error
 		released bool
+
+		// missing parents, which the event is indexed by in EventsBuffer.children
+		missing hash.Events
+		// number of missing parents which aren't connected yet
+		missingNum int
+		// number of missing parents which aren't connected yet and were requested
+		requestedNum int
+		// seq is the order of pushing, it's assigned by spill queues which need it
+		seq uint64
 	}
 
 	// Callback is a set of EventsBuffer()'s args.
@@ -32,17 +43,30 @@ type (
 )
 
 type EventsBuffer struct {
-	incompletes *wlru.Cache // event hash -> event
+	incompletes *wlru.Cache                 // event hash -> event
+	children    map[hash.Event][]hash.Event // missing parent hash -> incomplete children hashes
+	requested   hash.EventsSet              // missing parents which were requested
 	callback    Callback
 	mu          sync.Mutex
 
-	limit dag.Metric
+	limit  dag.Metric
+	policy SpillPolicy
+	spill  spillQueue
 }
 
 func New(limit dag.Metric, callback Callback) *EventsBuffer {
+	return NewWithSpillPolicy(limit, SpillOldest, callback)
+}
+
+// NewWithSpillPolicy creates an events buffer, which spills incomplete events according to the policy
+func NewWithSpillPolicy(limit dag.Metric, policy SpillPolicy, callback Callback) *EventsBuffer {
 	buf := &EventsBuffer{
-		callback: callback,
-		limit:    limit,
+		callback:  callback,
+		limit:     limit,
+		policy:    policy,
+		spill:     newSpillQueue(policy),
+		children:  make(map[hash.Event][]hash.Event),
+		requested: hash.EventsSet{},
 	}
 	buf.incompletes, _ = wlru.New(math.MaxInt32, math.MaxInt32)
 	return buf
@@ -63,72 +87,132 @@ func (buf *EventsBuffer) PushEvent(de dag.Event, peer string) (complete bool) {
 		buf.releaseEvent(e)
 		return false
 	}
-	complete = buf.pushEvent(e, nil, false)
+	complete = buf.pushEvent(e, false)
 	buf.spillIncompletes(buf.limit)
 	return complete
 }
 
-func (buf *EventsBuffer) pushEvent(e *event, incompleteEventsList []*event, recheck bool) bool {
+func (buf *EventsBuffer) pushEvent(e *event, recheck bool) bool {
 	if buf.callback.Exists(e.event.ID()) {
-		buf.incompletes.Remove(e.event.ID())
+		buf.removeIncomplete(e)
 		if !recheck {
 			buf.dropEvent(e, eventcheck.ErrAlreadyConnectedEvent)
 		}
 		buf.releaseEvent(e)
+		// event may be connected not via the buffer, so child events may become complete
+		buf.connected(e.event.ID())
 		return false
 	}
-	parents := buf.completeEventParents(e)
+	parents, missing := buf.completeEventParents(e)
 	if parents == nil {
+		buf.indexMissing(e, missing)
 		if !recheck {
 			buf.incompletes.Add(e.event.ID(), e, uint(e.event.Size()))
+			buf.spill.pushed(buf, e)
 		}
 		return false
 	}
 
 	ok := buf.processCompleteEvent(e, parents)
 	buf.releaseEvent(e)
+	buf.removeIncomplete(e)
 
 	if ok {
-		// now child events may become complete, check it again
-		eHash := e.event.ID()
-		if incompleteEventsList == nil {
-			incompleteEventsList = buf.getIncompleteEventsList()
-		}
-		for _, child := range incompleteEventsList {
-			for _, parent := range child.event.Parents() {
-				if parent == eHash {
-					buf.pushEvent(child, incompleteEventsList, true)
-					break
-				}
-			}
-		}
+		// now child events may become complete, check them again
+		buf.connected(e.event.ID())
 	}
-	buf.incompletes.Remove(e.event.ID())
 	return ok
 }
 
-func (buf *EventsBuffer) getIncompleteEventsList() []*event {
-	res := make([]*event, 0, buf.incompletes.Len())
-	for _, childID := range buf.incompletes.Keys() {
-		child, _ := buf.incompletes.Peek(childID)
-		if child == nil {
+// connected decrements missing parents counters of the children of a connected event,
+// and pushes the children which have no missing parents anymore.
+// Complexity is proportional to the number of affected events.
+func (buf *EventsBuffer) connected(id hash.Event) {
+	children := buf.children[id]
+	wasRequested := buf.requested.Contains(id)
+	delete(buf.children, id)
+	delete(buf.requested, id)
+	for _, childID := range children {
+		val, ok := buf.incompletes.Peek(childID)
+		if !ok {
 			continue
 		}
-		res = append(res, child.(*event))
+		child := val.(*event)
+		child.missingNum--
+		if wasRequested {
+			child.requestedNum--
+			if child.requestedNum == 0 && child.missingNum != 0 {
+				buf.spill.unrequested(buf, child)
+			}
+		}
+		if child.missingNum == 0 {
+			// all the missing parents are connected, so child isn't indexed anymore
+			child.missing = nil
+			buf.pushEvent(child, true)
+		}
 	}
-	return res
 }
 
-func (buf *EventsBuffer) completeEventParents(e *event) dag.Events {
+// indexMissing indexes the event by its missing parents
+func (buf *EventsBuffer) indexMissing(e *event, missing hash.Events) {
+	e.missing = missing
+	e.missingNum = len(missing)
+	e.requestedNum = 0
+	for _, p := range missing {
+		buf.children[p] = append(buf.children[p], e.event.ID())
+		if buf.requested.Contains(p) {
+			e.requestedNum++
+		}
+	}
+}
+
+// removeIncomplete removes the event from the buffer and from the children index
+func (buf *EventsBuffer) removeIncomplete(e *event) {
+	if buf.incompletes.Remove(e.event.ID()) {
+		buf.spill.removed(e)
+	}
+	buf.unindexMissing(e)
+}
+
+func (buf *EventsBuffer) unindexMissing(e *event) {
+	id := e.event.ID()
+	for _, p := range e.missing {
+		children := buf.children[p]
+		for i, child := range children {
+			if child == id {
+				children[i] = children[len(children)-1]
+				children = children[:len(children)-1]
+				break
+			}
+		}
+		if len(children) == 0 {
+			delete(buf.children, p)
+			delete(buf.requested, p)
+		} else {
+			buf.children[p] = children
+		}
+	}
+	e.missing = nil
+	e.missingNum = 0
+	e.requestedNum = 0
+}
+
+// completeEventParents returns event's parents if all of them are connected, or the list of missing parents otherwise
+func (buf *EventsBuffer) completeEventParents(e *event) (dag.Events, hash.Events) {
 	parents := make(dag.Events, len(e.event.Parents()))
+	var missing hash.Events
 	for i, p := range e.event.Parents() {
 		parent := buf.callback.Get(p)
 		if parent == nil {
-			return nil
+			missing = append(missing, p)
+			continue
 		}
 		parents[i] = parent
 	}
-	return parents
+	if len(missing) != 0 {
+		return nil, missing
+	}
+	return parents, nil
 }
 
 func (buf *EventsBuffer) processCompleteEvent(e *event, parents dag.Events) bool {
@@ -153,13 +237,55 @@ func (buf *EventsBuffer) processCompleteEvent(e *event, parents dag.Events) bool
 
 func (buf *EventsBuffer) spillIncompletes(limit dag.Metric) {
 	for idx.Event(buf.incompletes.Len()) > limit.Num || uint64(buf.incompletes.Weight()) > limit.Size {
-		_, val, ok := buf.incompletes.RemoveOldest()
+		id, ok := buf.spill.next(buf)
 		if !ok {
-			break
+			// shouldn't happen, fall back to the LRU order
+			key, _, ok := buf.incompletes.GetOldest()
+			if !ok {
+				break
+			}
+			id = key.(hash.Event)
+		}
+		buf.spillEvent(id, buf.spillError())
+	}
+}
+
+func (buf *EventsBuffer) spillEvent(id hash.Event, err error) {
+	val, ok := buf.incompletes.Peek(id)
+	if !ok {
+		return
+	}
+	e := val.(*event)
+	buf.removeIncomplete(e)
+	buf.dropEvent(e, err)
+	buf.releaseEvent(e)
+}
+
+// spillError returns an error for events spilled by the policy.
+// The default policy spills with the bare eventcheck.ErrSpilledEvent.
+func (buf *EventsBuffer) spillError() error {
+	if buf.policy == SpillOldest {
+		return eventcheck.ErrSpilledEvent
+	}
+	return &SpillError{Reason: buf.policy.String()}
+}
+
+// MarkRequested marks missing parents of buffered events as requested.
+// It's used by SpillUnrequested policy, which keeps events waiting for requested parents.
+func (buf *EventsBuffer) MarkRequested(ids hash.Events) {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	for _, id := range ids {
+		children, ok := buf.children[id]
+		if !ok || buf.requested.Contains(id) {
+			continue
+		}
+		buf.requested.Add(id)
+		for _, childID := range children {
+			if val, ok := buf.incompletes.Peek(childID); ok {
+				val.(*event).requestedNum++
+			}
 		}
-		e := val.(*event)
-		buf.dropEvent(e, eventcheck.ErrSpilledEvent)
-		buf.releaseEvent(e)
 	}
 }
 
@@ -184,7 +310,13 @@ func (buf *EventsBuffer) IsBuffered(id hash.Event) bool {
 func (buf *EventsBuffer) Clear() {
 	buf.mu.Lock()
 	defer buf.mu.Unlock()
-	buf.spillIncompletes(dag.Metric{})
+	for {
+		key, _, ok := buf.incompletes.GetOldest()
+		if !ok {
+			break
+		}
+		buf.spillEvent(key.(hash.Event), eventcheck.ErrSpilledEvent)
+	}
 }
 
 // Total returns the total weight and number of items in the cache.
@@ -196,3 +328,87 @@ func (buf *EventsBuffer) Total() dag.Metric {
 		Size: uint64(weight),
 	}
 }
+
+// MissingAncestor is a parent of buffered events, which is neither connected nor buffered
+type MissingAncestor struct {
+	ID hash.Event
+	// Unblocks is the number of buffered events which wait for the ancestor directly or indirectly
+	Unblocks int
+	// Peers which sent the waiting events, in order of first appearance
+	Peers []string
+}
+
+// MissingAncestors returns up to max missing ancestors of buffered events, deduplicated
+// and ranked by the number of buffered events each of them unblocks, including indirect descendants.
+// Ancestors which are buffered themselves aren't returned, because their own missing parents are.
+// Complexity is proportional to the number of missing ancestors multiplied by the number of their buffered descendants.
+func (buf *EventsBuffer) MissingAncestors(max int) []MissingAncestor {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+
+	res := make([]MissingAncestor, 0, len(buf.children))
+	for parent, children := range buf.children {
+		if buf.incompletes.Contains(parent) {
+			continue
+		}
+		m := MissingAncestor{
+			ID:       parent,
+			Unblocks: buf.descendantsNum(parent),
+		}
+		for _, childID := range children {
+			val, ok := buf.incompletes.Peek(childID)
+			if !ok {
+				continue
+			}
+			peer := val.(*event).peer
+			known := false
+			for _, p := range m.Peers {
+				if p == peer {
+					known = true
+					break
+				}
+			}
+			if !known {
+				m.Peers = append(m.Peers, peer)
+			}
+		}
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Unblocks != res[j].Unblocks {
+			return res[i].Unblocks > res[j].Unblocks
+		}
+		// older ancestors first
+		a, b := res[i].ID, res[j].ID
+		return bytes.Compare(a.Bytes(), b.Bytes()) < 0
+	})
+	if max >= 0 && len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+// descendantsNum returns the number of buffered events which descend from the event, found via the children index
+func (buf *EventsBuffer) descendantsNum(id hash.Event) int {
+	visited := hash.EventsSet{}
+	queue := hash.Events{id}
+	for len(queue) != 0 {
+		next := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, child := range buf.children[next] {
+			if !visited.Contains(child) {
+				visited.Add(child)
+				queue = append(queue, child)
+			}
+		}
+	}
+	return len(visited)
+}
+
+// IsMissing returns true if the event is a missing ancestor of a buffered event
+func (buf *EventsBuffer) IsMissing(id hash.Event) bool {
+	buf.mu.Lock()
+	defer buf.mu.Unlock()
+	_, ok := buf.children[id]
+	return ok && !buf.incompletes.Contains(id)
+}
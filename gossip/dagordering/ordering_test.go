@@ -2,12 +2,14 @@ package dagordering
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/panoptisDev/lachesis-base/eventcheck"
 	"github.com/panoptisDev/lachesis-base/hash"
 	"github.com/panoptisDev/lachesis-base/inter/dag"
 	"github.com/panoptisDev/lachesis-base/inter/dag/tdag"
@@ -102,12 +104,14 @@ func testEventsBuffer(t *testing.T, try int64) {
 }
 
 func TestEventsBufferReleasing(t *testing.T) {
-	for try := int64(0); try < 100; try++ {
-		testEventsBufferReleasing(t, 200, try)
+	for _, policy := range []SpillPolicy{SpillOldest, SpillHighestLamport, SpillBusiestPeer, SpillUnrequested} {
+		for try := int64(0); try < 100; try++ {
+			testEventsBufferReleasing(t, 200, policy, try)
+		}
 	}
 }
 
-func testEventsBufferReleasing(t *testing.T, maxEvents int, try int64) {
+func testEventsBufferReleasing(t *testing.T, maxEvents int, policy SpillPolicy, try int64) {
 	t.Helper()
 	nodes := tdag.GenNodes(5)
 	eventsPerNode := 1 + rand.Intn(maxEvents)/5 // nolint:gosec
@@ -132,7 +136,7 @@ func testEventsBufferReleasing(t *testing.T, maxEvents int, try int64) {
 		Num:  idx.Event(rand.Intn(maxEvents)),    // nolint:gosec
 		Size: uint64(rand.Intn(maxEvents * 100)), // nolint:gosec
 	}
-	buffer := New(limit, Callback{
+	buffer := NewWithSpillPolicy(limit, policy, Callback{
 		Process: func(e dag.Event) error {
 			mutex.Lock()
 			defer mutex.Unlock()
@@ -196,7 +200,11 @@ func testEventsBufferReleasing(t *testing.T, maxEvents int, try int64) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			buffer.PushEvent(e, "")
+			peer := fmt.Sprintf("peer%d", rand.Intn(3)) // nolint:gosec
+			buffer.PushEvent(e, peer)
+			if rand.Intn(10) == 0 { // nolint:gosec
+				buffer.MarkRequested(e.Parents())
+			}
 			if rand.Intn(10) == 0 { // nolint:gosec
 				buffer.Clear()
 			}
@@ -210,3 +218,280 @@ func testEventsBufferReleasing(t *testing.T, maxEvents int, try int64) {
 		t.Fatal("not all the events were released", len(ordered), released)
 	}
 }
+
+func BenchmarkEventsBuffer(b *testing.B) {
+	for _, eventsPerNode := range []int{200, 600, 2000, 6000} {
+		nodes := tdag.GenNodes(5)
+		var ordered dag.Events
+		_ = tdag.ForEachRandEvent(nodes, eventsPerNode, 3, rand.New(rand.NewSource(0)), tdag.ForEachEvent{ // nolint:gosec
+			Process: func(e dag.Event, name string) {
+				ordered = append(ordered, e)
+			},
+			Build: func(e dag.MutableEvent, name string) error {
+				e.SetEpoch(1)
+				e.SetFrame(idx.Frame(e.Seq()))
+				return nil
+			},
+		})
+		b.Run(fmt.Sprintf("reversed-%d", len(ordered)), func(b *testing.B) {
+			benchmarkEventsBuffer(b, ordered)
+		})
+	}
+}
+
+// benchmarkEventsBuffer pushes events in reversed order, so all of them are buffered until the first one arrives
+func benchmarkEventsBuffer(b *testing.B, ordered dag.Events) {
+	limit := dag.Metric{
+		Num:  idx.Event(len(ordered)),
+		Size: ordered.Metric().Size,
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		processed := make(map[hash.Event]dag.Event, len(ordered))
+		buffer := New(limit, Callback{
+			Process: func(e dag.Event) error {
+				processed[e.ID()] = e
+				return nil
+			},
+			Exists: func(id hash.Event) bool {
+				return processed[id] != nil
+			},
+			Get: func(id hash.Event) dag.Event {
+				return processed[id]
+			},
+		})
+		for j := len(ordered) - 1; j >= 0; j-- {
+			buffer.PushEvent(ordered[j], "")
+		}
+		if len(processed) != len(ordered) {
+			b.Fatal("not all the events were processed")
+		}
+	}
+}
+
+func TestEventsBufferMissingAncestors(t *testing.T) {
+	nodes := tdag.GenNodes(3)
+	var ordered dag.Events
+	_ = tdag.ForEachRandEvent(nodes, 10, 3, rand.New(rand.NewSource(0)), tdag.ForEachEvent{ // nolint:gosec
+		Process: func(e dag.Event, name string) {
+			ordered = append(ordered, e)
+		},
+		Build: func(e dag.MutableEvent, name string) error {
+			e.SetEpoch(1)
+			e.SetFrame(idx.Frame(e.Seq()))
+			return nil
+		},
+	})
+
+	processed := make(map[hash.Event]dag.Event)
+	buffer := New(dag.Metric{Num: 1000, Size: 1000000}, Callback{
+		Process: func(e dag.Event) error {
+			processed[e.ID()] = e
+			return nil
+		},
+		Exists: func(id hash.Event) bool {
+			return processed[id] != nil
+		},
+		Get: func(id hash.Event) dag.Event {
+			return processed[id]
+		},
+	})
+
+	// push all the events except the first one
+	first := ordered[0]
+	for i, e := range ordered[1:] {
+		buffer.PushEvent(e, fmt.Sprintf("peer%d", i%2))
+	}
+	if len(processed) != 0 {
+		t.Fatal("events were processed without the first one")
+	}
+
+	missing := buffer.MissingAncestors(-1)
+	if len(missing) != 1 || missing[0].ID != first.ID() || !buffer.IsMissing(first.ID()) {
+		t.Fatal("wrong missing ancestors", missing)
+	}
+	// all the other events descend from the first one
+	if missing[0].Unblocks != len(ordered)-1 || len(missing[0].Peers) == 0 {
+		t.Fatal("wrong missing ancestor rank", missing[0])
+	}
+	// buffered events aren't missing
+	if buffer.IsMissing(ordered[1].ID()) {
+		t.Fatal("buffered event is reported as missing")
+	}
+
+	buffer.PushEvent(first, "peer0")
+	if len(processed) != len(ordered) {
+		t.Fatal("not all the events were processed")
+	}
+	if len(buffer.MissingAncestors(-1)) != 0 {
+		t.Fatal("missing ancestors aren't cleared")
+	}
+
+	// indirect descendants are counted
+	buffer = New(dag.Metric{Num: 1000, Size: 1000000}, Callback{
+		Process: func(e dag.Event) error {
+			return nil
+		},
+		Exists: func(id hash.Event) bool {
+			return false
+		},
+		Get: func(id hash.Event) dag.Event {
+			return nil
+		},
+	})
+
+	newEvent := func(rID byte, lamport idx.Lamport, parents ...hash.Event) hash.Event {
+		e := &tdag.TestEvent{}
+		e.SetEpoch(1)
+		e.SetLamport(lamport)
+		e.SetParents(parents)
+		e.SetID([24]byte{rID})
+		buffer.PushEvent(e, "peer")
+		return e.ID()
+	}
+	x, y := hash.FakeEvent(), hash.FakeEvent()
+	// a chain of events, which wait for x, with a diamond which must be counted once
+	c1 := newEvent(1, 2, x)
+	c2 := newEvent(2, 3, c1)
+	c3 := newEvent(3, 4, c2)
+	newEvent(4, 5, c3)
+	newEvent(5, 5, c2, c3)
+	// two direct children of y
+	newEvent(6, 2, y)
+	newEvent(7, 2, y)
+
+	missing = buffer.MissingAncestors(-1)
+	if len(missing) != 2 {
+		t.Fatal("wrong missing ancestors", missing)
+	}
+	if missing[0].ID != x || missing[0].Unblocks != 5 {
+		t.Fatal("wrong rank of chain ancestor", missing[0])
+	}
+	if missing[1].ID != y || missing[1].Unblocks != 2 {
+		t.Fatal("wrong rank of ancestor with direct children", missing[1])
+	}
+}
+
+func fakeIncompleteEvent(lamport idx.Lamport, parent hash.Event, rID byte) dag.Event {
+	e := &tdag.TestEvent{}
+	e.SetEpoch(1)
+	e.SetLamport(lamport)
+	e.SetParents(hash.Events{parent})
+	e.SetID([24]byte{rID})
+	return e
+}
+
+func TestEventsBufferSpillPolicies(t *testing.T) {
+	parents := hash.FakeEvents(3)
+	events := []struct {
+		event dag.Event
+		peer  string
+	}{
+		{fakeIncompleteEvent(1, parents[0], 1), "a"},
+		{fakeIncompleteEvent(2, parents[1], 2), "b"},
+		{fakeIncompleteEvent(3, parents[2], 3), "b"},
+		{fakeIncompleteEvent(5, parents[0], 4), "b"},
+	}
+
+	for policy, expected := range map[SpillPolicy]int{
+		SpillOldest:         0,
+		SpillHighestLamport: 3,
+		SpillBusiestPeer:    1,
+		SpillUnrequested:    2,
+	} {
+		var spilled []hash.Event
+		buffer := NewWithSpillPolicy(dag.Metric{Num: 3, Size: 1000000}, policy, Callback{
+			Process: func(e dag.Event) error {
+				t.Fatal("incomplete event is processed")
+				return nil
+			},
+			Released: func(e dag.Event, peer string, err error) {
+				if policy == SpillOldest {
+					// the default policy keeps the bare error
+					if err != eventcheck.ErrSpilledEvent {
+						t.Fatal("unexpected error", err)
+					}
+				} else {
+					var spillErr *SpillError
+					if !errors.As(err, &spillErr) || !errors.Is(err, eventcheck.ErrSpilledEvent) {
+						t.Fatal("unexpected error", err)
+					}
+					if spillErr.Reason != policy.String() {
+						t.Fatal("wrong spill reason", spillErr.Reason)
+					}
+				}
+				spilled = append(spilled, e.ID())
+			},
+			Exists: func(hash.Event) bool {
+				return false
+			},
+			Get: func(hash.Event) dag.Event {
+				return nil
+			},
+		})
+		for i, e := range events[:3] {
+			buffer.PushEvent(e.event, e.peer)
+			if i == 1 {
+				buffer.MarkRequested(parents[:2])
+			}
+		}
+		buffer.PushEvent(events[3].event, events[3].peer)
+
+		if len(spilled) != 1 || spilled[0] != events[expected].event.ID() {
+			t.Fatalf("policy %s: expected to spill %s, got %v", policy, events[expected].event.ID(), spilled)
+		}
+		if buffer.IsBuffered(spilled[0]) || buffer.Total().Num != 3 {
+			t.Fatalf("policy %s: spilled event is still buffered", policy)
+		}
+	}
+}
+
+func TestEventsBufferSpillUnrequestedAgain(t *testing.T) {
+	newEvent := func(lamport idx.Lamport, parents hash.Events, rID byte) dag.Event {
+		e := &tdag.TestEvent{}
+		e.SetEpoch(1)
+		e.SetLamport(lamport)
+		e.SetParents(parents)
+		e.SetID([24]byte{rID})
+		return e
+	}
+	a := newEvent(1, nil, 1)
+	b := newEvent(1, nil, 2)
+	c := hash.FakeEvent()
+	waiting := newEvent(2, hash.Events{a.ID(), c}, 3)
+
+	processed := make(map[hash.Event]dag.Event)
+	var spilled hash.Events
+	buffer := NewWithSpillPolicy(dag.Metric{Num: 3, Size: 1000000}, SpillUnrequested, Callback{
+		Process: func(e dag.Event) error {
+			processed[e.ID()] = e
+			return nil
+		},
+		Released: func(e dag.Event, peer string, err error) {
+			if err != nil {
+				spilled.Add(e.ID())
+			}
+		},
+		Exists: func(id hash.Event) bool {
+			return processed[id] != nil
+		},
+		Get: func(id hash.Event) dag.Event {
+			return processed[id]
+		},
+	})
+	buffer.PushEvent(newEvent(2, hash.Events{b.ID()}, 4), "")
+	buffer.PushEvent(newEvent(2, hash.Events{a.ID()}, 5), "")
+	buffer.MarkRequested(hash.Events{a.ID(), b.ID()})
+	buffer.PushEvent(waiting, "")
+	// the requested parent arrives, so the event waits only for an unrequested parent
+	buffer.PushEvent(a, "")
+	if processed[a.ID()] == nil || !buffer.IsBuffered(waiting.ID()) || buffer.Total().Num != 2 {
+		t.Fatal("event isn't buffered")
+	}
+	buffer.PushEvent(newEvent(2, hash.Events{b.ID()}, 6), "")
+	buffer.PushEvent(newEvent(2, hash.Events{b.ID()}, 7), "")
+
+	if len(spilled) != 1 || spilled[0] != waiting.ID() {
+		t.Fatalf("expected to spill %s, got %v", waiting.ID(), spilled)
+	}
+}
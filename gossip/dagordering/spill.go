@@ -0,0 +1,293 @@
+package dagordering
+
+import (
+	"container/heap"
+
+	"github.com/panoptisDev/lachesis-base/eventcheck"
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+// SpillPolicy defines which incomplete events are evicted first when the buffer limit is exceeded
+type SpillPolicy uint8
+
+const (
+	// SpillOldest evicts the least recently pushed events first
+	SpillOldest SpillPolicy = iota
+	// SpillHighestLamport evicts the events with the highest Lamport time first,
+	// as they are the farthest from completion
+	SpillHighestLamport
+	// SpillBusiestPeer evicts the oldest events of the peer with the most buffered events first
+	SpillBusiestPeer
+	// SpillUnrequested evicts the oldest events which have no requested missing parents first,
+	// keeping the events which are likely to complete soon
+	SpillUnrequested
+)
+
+func (p SpillPolicy) String() string {
+	switch p {
+	case SpillOldest:
+		return "oldest"
+	case SpillHighestLamport:
+		return "highest lamport"
+	case SpillBusiestPeer:
+		return "busiest peer"
+	case SpillUnrequested:
+		return "unrequested"
+	default:
+		return "unknown"
+	}
+}
+
+// SpillError is passed to the Released callback for events spilled by a non-default policy.
+// It unwraps to eventcheck.ErrSpilledEvent, so it should be checked with errors.Is.
+// Events spilled by SpillOldest or by Clear are released with the bare eventcheck.ErrSpilledEvent.
+type SpillError struct {
+	// Reason is a policy which selected the event
+	Reason string
+}
+
+func (e *SpillError) Error() string {
+	if e.Reason == "" {
+		return eventcheck.ErrSpilledEvent.Error()
+	}
+	return eventcheck.ErrSpilledEvent.Error() + ": " + e.Reason
+}
+
+func (e *SpillError) Unwrap() error {
+	return eventcheck.ErrSpilledEvent
+}
+
+// spillQueue selects the next event to spill, according to a SpillPolicy.
+// Implementations may keep stale entries of already removed events, which are skipped lazily
+// and compacted once they outnumber the buffered events.
+type spillQueue interface {
+	pushed(buf *EventsBuffer, e *event)
+	removed(e *event)
+	// unrequested is called when none of the event's missing parents is requested anymore
+	unrequested(buf *EventsBuffer, e *event)
+	next(buf *EventsBuffer) (hash.Event, bool)
+}
+
+func newSpillQueue(policy SpillPolicy) spillQueue {
+	switch policy {
+	case SpillHighestLamport:
+		return &lamportSpillQueue{}
+	case SpillBusiestPeer:
+		return newPeerSpillQueue()
+	case SpillUnrequested:
+		return &unrequestedSpillQueue{}
+	default:
+		return oldestSpillQueue{}
+	}
+}
+
+type oldestSpillQueue struct{}
+
+func (oldestSpillQueue) pushed(*EventsBuffer, *event)      {}
+func (oldestSpillQueue) removed(*event)                    {}
+func (oldestSpillQueue) unrequested(*EventsBuffer, *event) {}
+
+func (oldestSpillQueue) next(buf *EventsBuffer) (hash.Event, bool) {
+	key, _, ok := buf.incompletes.GetOldest()
+	if !ok {
+		return hash.Event{}, false
+	}
+	return key.(hash.Event), true
+}
+
+// compactSlack is a number of stale entries which are allowed in a queue regardless of the buffer size
+const compactSlack = 64
+
+type lamportEntry struct {
+	lamport idx.Lamport
+	id      hash.Event
+}
+
+// lamportHeap is a max-heap by Lamport time
+type lamportHeap []lamportEntry
+
+func (h lamportHeap) Len() int            { return len(h) }
+func (h lamportHeap) Less(i, j int) bool  { return h[i].lamport > h[j].lamport }
+func (h lamportHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *lamportHeap) Push(x interface{}) { *h = append(*h, x.(lamportEntry)) }
+func (h *lamportHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+type lamportSpillQueue struct {
+	heap lamportHeap
+}
+
+func (q *lamportSpillQueue) pushed(buf *EventsBuffer, e *event) {
+	if len(q.heap) > 2*buf.incompletes.Len()+compactSlack {
+		live := q.heap[:0]
+		for _, entry := range q.heap {
+			if buf.incompletes.Contains(entry.id) {
+				live = append(live, entry)
+			}
+		}
+		q.heap = live
+		heap.Init(&q.heap)
+	}
+	heap.Push(&q.heap, lamportEntry{e.event.Lamport(), e.event.ID()})
+}
+
+func (q *lamportSpillQueue) removed(*event) {}
+
+func (q *lamportSpillQueue) unrequested(*EventsBuffer, *event) {}
+
+func (q *lamportSpillQueue) next(buf *EventsBuffer) (hash.Event, bool) {
+	for q.heap.Len() != 0 {
+		top := q.heap[0]
+		if buf.incompletes.Contains(top.id) {
+			return top.id, true
+		}
+		heap.Pop(&q.heap)
+	}
+	return hash.Event{}, false
+}
+
+type peerSpillQueue struct {
+	counts map[string]int
+	queues map[string][]hash.Event // FIFO of event IDs per peer
+}
+
+func newPeerSpillQueue() *peerSpillQueue {
+	return &peerSpillQueue{
+		counts: make(map[string]int),
+		queues: make(map[string][]hash.Event),
+	}
+}
+
+func (q *peerSpillQueue) pushed(buf *EventsBuffer, e *event) {
+	q.counts[e.peer]++
+	queue := q.queues[e.peer]
+	if len(queue) > 2*q.counts[e.peer]+compactSlack {
+		live := make([]hash.Event, 0, q.counts[e.peer])
+		for _, id := range queue {
+			if buf.incompletes.Contains(id) {
+				live = append(live, id)
+			}
+		}
+		queue = live
+	}
+	q.queues[e.peer] = append(queue, e.event.ID())
+}
+
+func (q *peerSpillQueue) removed(e *event) {
+	q.counts[e.peer]--
+	if q.counts[e.peer] <= 0 {
+		delete(q.counts, e.peer)
+		delete(q.queues, e.peer)
+	}
+}
+
+func (q *peerSpillQueue) unrequested(*EventsBuffer, *event) {}
+
+func (q *peerSpillQueue) next(buf *EventsBuffer) (hash.Event, bool) {
+	busiest, max := "", 0
+	for peer, count := range q.counts {
+		if count > max || count == max && peer < busiest {
+			busiest, max = peer, count
+		}
+	}
+	queue := q.queues[busiest]
+	for len(queue) != 0 {
+		id := queue[0]
+		// the event may have been removed and pushed again by another peer
+		if val, ok := buf.incompletes.Peek(id); ok && val.(*event).peer == busiest {
+			q.queues[busiest] = queue
+			return id, true
+		}
+		queue = queue[1:]
+	}
+	q.queues[busiest] = queue
+	return hash.Event{}, false
+}
+
+type seqEntry struct {
+	seq uint64
+	e   *event
+}
+
+// seqHeap is a min-heap by order of pushing
+type seqHeap []seqEntry
+
+func (h seqHeap) Len() int            { return len(h) }
+func (h seqHeap) Less(i, j int) bool  { return h[i].seq < h[j].seq }
+func (h seqHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *seqHeap) Push(x interface{}) { *h = append(*h, x.(seqEntry)) }
+func (h *seqHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = seqEntry{}
+	*h = old[:n-1]
+	return x
+}
+
+// unrequestedSpillQueue keeps the events which have no requested missing parents, in order of pushing.
+// Events which get a requested parent are skipped lazily, and are added again once they have no requested parents.
+type unrequestedSpillQueue struct {
+	seq  uint64
+	heap seqHeap
+}
+
+func (q *unrequestedSpillQueue) live(buf *EventsBuffer, entry seqEntry) bool {
+	val, ok := buf.incompletes.Peek(entry.e.event.ID())
+	return ok && val.(*event) == entry.e && entry.e.requestedNum == 0
+}
+
+func (q *unrequestedSpillQueue) push(buf *EventsBuffer, e *event) {
+	if len(q.heap) > 2*buf.incompletes.Len()+compactSlack {
+		live := q.heap[:0]
+		kept := make(map[*event]bool, len(q.heap))
+		for _, entry := range q.heap {
+			if !kept[entry.e] && q.live(buf, entry) {
+				kept[entry.e] = true
+				live = append(live, entry)
+			}
+		}
+		for i := len(live); i < len(q.heap); i++ {
+			q.heap[i] = seqEntry{}
+		}
+		q.heap = live
+		heap.Init(&q.heap)
+	}
+	heap.Push(&q.heap, seqEntry{e.seq, e})
+}
+
+func (q *unrequestedSpillQueue) pushed(buf *EventsBuffer, e *event) {
+	q.seq++
+	e.seq = q.seq
+	if e.requestedNum == 0 {
+		q.push(buf, e)
+	}
+}
+
+func (q *unrequestedSpillQueue) removed(*event) {}
+
+func (q *unrequestedSpillQueue) unrequested(buf *EventsBuffer, e *event) {
+	q.push(buf, e)
+}
+
+func (q *unrequestedSpillQueue) next(buf *EventsBuffer) (hash.Event, bool) {
+	for q.heap.Len() != 0 {
+		top := q.heap[0]
+		if q.live(buf, top) {
+			return top.e.event.ID(), true
+		}
+		heap.Pop(&q.heap)
+	}
+	// all the events are waiting for requested parents
+	key, _, ok := buf.incompletes.GetOldest()
+	if !ok {
+		return hash.Event{}, false
+	}
+	return key.(hash.Event), true
+}
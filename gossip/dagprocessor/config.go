@@ -5,26 +5,58 @@ import (
 
 	"github.com/syndtr/goleveldb/leveldb/opt"
 
+	"github.com/panoptisDev/lachesis-base/gossip/dagordering"
 	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
 	"github.com/panoptisDev/lachesis-base/utils/cachescale"
 )
 
 type Config struct {
 	EventsBufferLimit dag.Metric
+	// SpillPolicy defines which incomplete events are spilled first once EventsBufferLimit is exceeded
+	SpillPolicy dagordering.SpillPolicy
+	// MaxLamportDiff is the maximum distance of event's Lamport time ahead of the highest known Lamport time.
+	// Events which are further ahead are released, and missing parents are requested only for events
+	// which are ahead by no more than MaxLamportDiff/10. Zero means 1+EventsBufferLimit.Num.
+	MaxLamportDiff idx.Lamport
 
 	EventsSemaphoreTimeout time.Duration
 
+	// PeerEventsLimit limits events being processed or buffered, which were received from a single peer.
+	// Besides the limit, a peer is bounded by its fair share of the events semaphore if other peers are active.
+	// Zero disables the limit.
+	PeerEventsLimit dag.Metric
+
+	// NextEpochBufferLimit limits events of the next epoch, which are buffered until the current epoch is sealed.
+	// Zero disables buffering.
+	NextEpochBufferLimit dag.Metric
+
 	MaxTasks int
+
+	// CheckerWorkers is the number of goroutines which call CheckParentless.
+	// CheckParentless must be thread-safe if it's greater than 1.
+	CheckerWorkers int
+	// CheckerBatch is the maximum number of events which are checked in one task.
+	// Tasks of different peers are served in round-robin order, so a huge batch of one peer cannot starve others.
+	CheckerBatch int
 }
 
 func DefaultConfig(scale cachescale.Func) Config {
 	return Config{
 		EventsBufferLimit: dag.Metric{
-			// Shouldn't be too big because complexity is O(n) for each insertion in the EventsBuffer
-			Num:  3000,
+			// Complexity of an insertion in the EventsBuffer is proportional to the number of completed events
+			Num:  10000,
 			Size: scale.U64(10 * opt.MiB),
 		},
+		SpillPolicy:            dagordering.SpillOldest,
+		MaxLamportDiff:         3001,
 		EventsSemaphoreTimeout: 10 * time.Second,
-		MaxTasks:               128,
+		NextEpochBufferLimit: dag.Metric{
+			Num:  1000,
+			Size: scale.U64(2 * opt.MiB),
+		},
+		MaxTasks:       128,
+		CheckerWorkers: 1,
+		CheckerBatch:   32,
 	}
 }
@@ -0,0 +1,68 @@
+package dagprocessor
+
+import (
+	"sync"
+
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+)
+
+type peerEvent struct {
+	peer  string
+	event dag.Event
+}
+
+// nextEpochBuffer keeps events of the next epoch until the current epoch is sealed.
+// Buffered events hold their share of the events semaphore.
+type nextEpochBuffer struct {
+	mu     sync.Mutex
+	events []peerEvent
+	ids    hash.EventsSet
+	total  dag.Metric
+	limit  dag.Metric
+}
+
+func newNextEpochBuffer(limit dag.Metric) *nextEpochBuffer {
+	return &nextEpochBuffer{
+		ids:   hash.EventsSet{},
+		limit: limit,
+	}
+}
+
+// push returns false if event cannot be buffered because it's a duplicate or because the limit is reached
+func (b *nextEpochBuffer) push(peer string, e dag.Event) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.ids.Contains(e.ID()) {
+		return false
+	}
+	total := b.total
+	total.Num++
+	total.Size += uint64(e.Size())
+	if total.Num > b.limit.Num || total.Size > b.limit.Size {
+		return false
+	}
+	b.total = total
+	b.ids.Add(e.ID())
+	b.events = append(b.events, peerEvent{peer, e})
+	return true
+}
+
+// pop returns all the buffered events in arrival order, and empties the buffer
+func (b *nextEpochBuffer) pop() []peerEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := b.events
+	b.events = nil
+	b.ids = hash.EventsSet{}
+	b.total = dag.Metric{}
+	return events
+}
+
+func (b *nextEpochBuffer) Total() dag.Metric {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total
+}
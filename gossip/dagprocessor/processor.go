@@ -3,8 +3,10 @@ package dagprocessor
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/panoptisDev/lachesis-base/eventcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
 	"github.com/panoptisDev/lachesis-base/gossip/dagordering"
 	"github.com/panoptisDev/lachesis-base/hash"
 	"github.com/panoptisDev/lachesis-base/inter/dag"
@@ -26,10 +28,15 @@ type Processor struct {
 
 	callback Callback
 
-	checker         *workers.Workers
+	checker         *workers.FairWorkers
 	orderedInserter *workers.Workers
+	// checkerBatches is the number of enqueued batches, which have chunks waiting for the checker
+	checkerBatches int32
 
-	buffer *dagordering.EventsBuffer
+	buffer          *dagordering.EventsBuffer
+	nextEpochBuffer *nextEpochBuffer
+	// epoch is the last observed epoch, it's accessed only by the orderedInserter
+	epoch idx.Epoch
 
 	eventsSemaphore *datasemaphore.DataSemaphore
 }
@@ -43,9 +50,19 @@ type EventCallback struct {
 	CheckParentless func(e dag.Event, checked func(error))
 }
 
+// WithPipeline returns callbacks which validate events with the checkers pipeline
+func (cb EventCallback) WithPipeline(p *eventcheck.Pipeline) EventCallback {
+	cb.CheckParentless = p.CheckParentless
+	cb.CheckParents = p.CheckParents
+	return cb
+}
+
 type Callback struct {
 	Event          EventCallback
 	HighestLamport func() idx.Lamport
+	// CurrentEpoch returns the current epoch. Optional.
+	// If defined, then buffered events of the next epoch are released automatically once the epoch is sealed.
+	CurrentEpoch func() idx.Epoch
 }
 
 // New creates an event processor
@@ -57,28 +74,39 @@ func New(eventsSemaphore *datasemaphore.DataSemaphore, cfg Config, callback Call
 	}
 	released := callback.Event.Released
 	callback.Event.Released = func(e dag.Event, peer string, err error) {
-		f.eventsSemaphore.Release(dag.Metric{Num: 1, Size: uint64(e.Size())})
+		f.eventsSemaphore.ReleasePeer(peer, dag.Metric{Num: 1, Size: uint64(e.Size())})
 		if released != nil {
 			released(e, peer, err)
 		}
 	}
 	f.callback = callback
-	f.buffer = dagordering.New(cfg.EventsBufferLimit, dagordering.Callback{
+	if cfg.PeerEventsLimit != (dag.Metric{}) {
+		eventsSemaphore.SetPeerLimit(cfg.PeerEventsLimit)
+	}
+	f.buffer = dagordering.NewWithSpillPolicy(cfg.EventsBufferLimit, cfg.SpillPolicy, dagordering.Callback{
 		Process:  callback.Event.Process,
 		Released: callback.Event.Released,
 		Get:      callback.Event.Get,
 		Exists:   callback.Event.Exists,
 		Check:    callback.Event.CheckParents,
 	})
+	f.nextEpochBuffer = newNextEpochBuffer(cfg.NextEpochBufferLimit)
+	if callback.CurrentEpoch != nil {
+		f.epoch = callback.CurrentEpoch()
+	}
 	f.orderedInserter = workers.New(&f.wg, f.quit, cfg.MaxTasks)
-	f.checker = workers.New(&f.wg, f.quit, cfg.MaxTasks)
+	f.checker = workers.NewFair(&f.wg, f.quit, cfg.MaxTasks)
 	return f
 }
 
 // Start boots up the events processor.
 func (f *Processor) Start() {
 	f.orderedInserter.Start(1)
-	f.checker.Start(1)
+	checkerWorkers := f.cfg.CheckerWorkers
+	if checkerWorkers < 1 {
+		checkerWorkers = 1
+	}
+	f.checker.Start(checkerWorkers)
 }
 
 // Stop interrupts the processor, canceling all the pending operations.
@@ -88,11 +116,14 @@ func (f *Processor) Stop() {
 	f.eventsSemaphore.Terminate()
 	f.wg.Wait()
 	f.buffer.Clear()
+	for _, pe := range f.nextEpochBuffer.pop() {
+		f.callback.Event.Released(pe.event, pe.peer, eventcheck.ErrSpilledEvent)
+	}
 }
 
 // Overloaded returns true if too much events are being processed or requested
 func (f *Processor) Overloaded() bool {
-	return f.checker.TasksCount() > f.cfg.MaxTasks*3/4 ||
+	return int(atomic.LoadInt32(&f.checkerBatches)) > f.cfg.MaxTasks*3/4 ||
 		f.orderedInserter.TasksCount() > f.cfg.MaxTasks*3/4
 }
 
@@ -100,32 +131,67 @@ type checkRes struct {
 	e   dag.Event
 	err error
 	pos idx.Event
+	// epoch is the current epoch at the moment of the check
+	epoch idx.Epoch
 }
 
 func (f *Processor) Enqueue(peer string, events dag.Events, ordered bool, notifyAnnounces func(hash.Events), done func()) error {
-	if !f.eventsSemaphore.Acquire(events.Metric(), f.cfg.EventsSemaphoreTimeout) {
+	if !f.eventsSemaphore.AcquirePeer(peer, events.Metric(), f.cfg.EventsSemaphoreTimeout) {
 		return ErrBusy
 	}
+	return f.enqueue(peer, events, ordered, notifyAnnounces, done)
+}
 
+// enqueue processes events which already hold their share of the events semaphore
+func (f *Processor) enqueue(peer string, events dag.Events, ordered bool, notifyAnnounces func(hash.Events), done func()) error {
 	checkedC := make(chan *checkRes, len(events))
-	err := f.checker.Enqueue(func() {
-		for i, e := range events {
-			pos := idx.Event(i)
-			event := e
-			f.callback.Event.CheckParentless(event, func(err error) {
-				checkedC <- &checkRes{
-					e:   event,
-					err: err,
-					pos: pos,
-				}
-			})
+	batch := f.cfg.CheckerBatch
+	if batch < 1 {
+		batch = len(events)
+	}
+	// a batch is accounted as one task by Overloaded until all its chunks are started
+	chunks := int32((len(events) + batch - 1) / batch)
+	remaining := chunks
+	if chunks != 0 {
+		atomic.AddInt32(&f.checkerBatches, 1)
+	}
+	chunkStarted := func(n int32) {
+		if atomic.AddInt32(&remaining, -n) == 0 {
+			atomic.AddInt32(&f.checkerBatches, -1)
+		}
+	}
+	// split events into tasks, results are reordered by pos if needed
+	for queued, start := int32(0), 0; start < len(events); queued, start = queued+1, start+batch {
+		end := start + batch
+		if end > len(events) {
+			end = len(events)
+		}
+		offset, chunk := start, events[start:end]
+		err := f.checker.Enqueue(peer, func() {
+			chunkStarted(1)
+			for i, e := range chunk {
+				pos := idx.Event(offset + i)
+				event := e
+				epoch := f.currentEpoch()
+				f.callback.Event.CheckParentless(event, func(err error) {
+					checkedC <- &checkRes{
+						e:     event,
+						err:   err,
+						pos:   pos,
+						epoch: epoch,
+					}
+				})
+			}
+		})
+		if err != nil {
+			chunkStarted(chunks - queued)
+			// results of the queued chunks are never processed
+			f.release(peer, events, eventcheck.ErrSpilledEvent)
+			return err
 		}
-	})
-	if err != nil {
-		return err
 	}
 	eventsLen := len(events)
-	return f.orderedInserter.Enqueue(func() {
+	err := f.orderedInserter.Enqueue(func() {
 		if done != nil {
 			defer done()
 		}
@@ -143,12 +209,12 @@ func (f *Processor) Enqueue(peer string, events dag.Events, ordered bool, notify
 					orderedResults[res.pos] = res
 
 					for i := processed; processed < len(orderedResults) && orderedResults[i] != nil; i++ {
-						toRequest = append(toRequest, f.process(peer, orderedResults[i].e, orderedResults[i].err)...)
+						toRequest = append(toRequest, f.process(peer, orderedResults[i])...)
 						orderedResults[i] = nil // free the memory
 						processed++
 					}
 				} else {
-					toRequest = append(toRequest, f.process(peer, res.e, res.err)...)
+					toRequest = append(toRequest, f.process(peer, res)...)
 					processed++
 				}
 
@@ -162,9 +228,54 @@ func (f *Processor) Enqueue(peer string, events dag.Events, ordered bool, notify
 			notifyAnnounces(toRequest)
 		}
 	})
+	if err != nil {
+		f.release(peer, events, eventcheck.ErrSpilledEvent)
+	}
+	return err
+}
+
+// release releases the events which won't be processed
+func (f *Processor) release(peer string, events dag.Events, err error) {
+	for _, e := range events {
+		f.callback.Event.Released(e, peer, err)
+	}
+}
+
+func (f *Processor) currentEpoch() idx.Epoch {
+	if f.callback.CurrentEpoch == nil {
+		return 0
+	}
+	return f.callback.CurrentEpoch()
 }
 
-func (f *Processor) process(peer string, event dag.Event, resErr error) (toRequest hash.Events) {
+// checkEpochSealed releases the buffered events of the next epoch if the epoch was sealed since the last check.
+// checkedEpoch is the epoch at the moment when the just buffered event was checked,
+// so the event is released even if the epoch was sealed before the event got buffered.
+func (f *Processor) checkEpochSealed(checkedEpoch idx.Epoch) {
+	if f.callback.CurrentEpoch == nil {
+		return
+	}
+	epoch := f.callback.CurrentEpoch()
+	if epoch == f.epoch && epoch == checkedEpoch {
+		return
+	}
+	f.epoch = epoch
+	// events are re-enqueued asynchronously, because the orderedInserter cannot wait for its own tasks
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		_ = f.ReleaseNextEpoch()
+	}()
+}
+
+func (f *Processor) process(peer string, res *checkRes) (toRequest hash.Events) {
+	event, resErr := res.e, res.err
+	// buffer event if it's from the next epoch
+	if errors.Is(resErr, epochcheck.ErrNextEpoch) && f.nextEpochBuffer.push(peer, event) {
+		f.checkEpochSealed(res.epoch)
+		return hash.Events{}
+	}
+	defer f.checkEpochSealed(f.epoch)
 	// release event if failed validation
 	if resErr != nil {
 		f.callback.Event.Released(event, peer, resErr)
@@ -172,7 +283,10 @@ func (f *Processor) process(peer string, event dag.Event, resErr error) (toReque
 	}
 	// release event if it's too far in future
 	highestLamport := f.callback.HighestLamport()
-	maxLamportDiff := 1 + idx.Lamport(f.cfg.EventsBufferLimit.Num)
+	maxLamportDiff := f.cfg.MaxLamportDiff
+	if maxLamportDiff == 0 {
+		maxLamportDiff = 1 + idx.Lamport(f.cfg.EventsBufferLimit.Num)
+	}
 	if event.Lamport() > highestLamport+maxLamportDiff {
 		f.callback.Event.Released(event, peer, eventcheck.ErrSpilledEvent)
 		return hash.Events{}
@@ -180,9 +294,74 @@ func (f *Processor) process(peer string, event dag.Event, resErr error) (toReque
 	// push event to the ordering buffer
 	complete := f.buffer.PushEvent(event, peer)
 	if !complete && event.Lamport() <= highestLamport+maxLamportDiff/10 {
-		return event.Parents()
+		// request only parents which are neither connected nor buffered
+		for _, p := range event.Parents() {
+			if f.buffer.IsMissing(p) {
+				toRequest = append(toRequest, p)
+			}
+		}
+		f.buffer.MarkRequested(toRequest)
+	}
+	return toRequest
+}
+
+// MissingAncestors returns up to max missing parents of buffered events, ranked by the number of events each unblocks
+func (f *Processor) MissingAncestors(max int) []dagordering.MissingAncestor {
+	return f.buffer.MissingAncestors(max)
+}
+
+// RequestMissing requests up to max missing ancestors of buffered events from the peers which sent the buffered events.
+// Every ancestor is requested from the first peer, and ids passed to request are ordered by priority.
+func (f *Processor) RequestMissing(max int, request func(peer string, ids hash.Events)) {
+	var peers []string
+	byPeer := make(map[string]hash.Events)
+	for _, m := range f.buffer.MissingAncestors(max) {
+		if len(m.Peers) == 0 {
+			continue
+		}
+		peer := m.Peers[0]
+		if _, ok := byPeer[peer]; !ok {
+			peers = append(peers, peer)
+		}
+		byPeer[peer] = append(byPeer[peer], m.ID)
+	}
+	for _, peer := range peers {
+		f.buffer.MarkRequested(byPeer[peer])
+		request(peer, byPeer[peer])
 	}
-	return hash.Events{}
+}
+
+// ReleaseNextEpoch re-enqueues buffered events of the next epoch, so the events are validated against the new epoch.
+// It's called automatically if Callback.CurrentEpoch is defined, otherwise it should be called after the current epoch is sealed.
+func (f *Processor) ReleaseNextEpoch() error {
+	var peers []string
+	byPeer := make(map[string]dag.Events)
+	for _, pe := range f.nextEpochBuffer.pop() {
+		if _, ok := byPeer[pe.peer]; !ok {
+			peers = append(peers, pe.peer)
+		}
+		byPeer[pe.peer] = append(byPeer[pe.peer], pe.event)
+	}
+	for i, peer := range peers {
+		if err := f.enqueue(peer, byPeer[peer], true, nil, nil); err != nil {
+			// terminated, release the events of the remaining peers, the failed events are released by enqueue
+			for _, peer := range peers[i+1:] {
+				f.release(peer, byPeer[peer], eventcheck.ErrSpilledEvent)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// TotalNextEpochBuffered returns the total weight and number of buffered events of the next epoch
+func (f *Processor) TotalNextEpochBuffered() dag.Metric {
+	return f.nextEpochBuffer.Total()
+}
+
+// ForgetPeer drops the events semaphore state of a disconnected peer, including its weight
+func (f *Processor) ForgetPeer(peer string) {
+	f.eventsSemaphore.ForgetPeer(peer)
 }
 
 func (f *Processor) IsBuffered(id hash.Event) bool {
@@ -197,6 +376,11 @@ func (f *Processor) TotalBuffered() dag.Metric {
 	return f.buffer.Total()
 }
 
+// PeersProcessing returns the amount of events being processed or buffered, per peer
+func (f *Processor) PeersProcessing() map[string]dag.Metric {
+	return f.eventsSemaphore.PeersProcessing()
+}
+
 func (f *Processor) TasksCount() int {
 	return f.orderedInserter.TasksCount() + f.checker.TasksCount()
 }
@@ -8,10 +8,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/panoptisDev/lachesis-base/eventcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/gossip/dagordering"
 	"github.com/panoptisDev/lachesis-base/hash"
 	"github.com/panoptisDev/lachesis-base/inter/dag"
 	"github.com/panoptisDev/lachesis-base/inter/dag/tdag"
 	"github.com/panoptisDev/lachesis-base/inter/idx"
+	"github.com/panoptisDev/lachesis-base/inter/pos"
 	"github.com/panoptisDev/lachesis-base/utils/cachescale"
 	"github.com/panoptisDev/lachesis-base/utils/datasemaphore"
 )
@@ -73,6 +77,8 @@ func testProcessor(t *testing.T) {
 	})
 	config := DefaultConfig(cachescale.Identity)
 	config.EventsBufferLimit = limit
+	config.CheckerWorkers = 1 + rand.Intn(4) // nolint:gosec
+	config.CheckerBatch = 1 + rand.Intn(10)  // nolint:gosec
 
 	checked := 0
 
@@ -200,6 +206,9 @@ func testProcessorReleasing(t *testing.T, maxEvents int, try int64) {
 	})
 	config := DefaultConfig(cachescale.Identity)
 	config.EventsBufferLimit = limit
+	config.SpillPolicy = dagordering.SpillPolicy(rand.Intn(4)) // nolint:gosec
+	config.CheckerWorkers = 1 + rand.Intn(4)                   // nolint:gosec
+	config.CheckerBatch = 1 + rand.Intn(10)                    // nolint:gosec
 
 	released := uint32(0)
 
@@ -308,3 +317,296 @@ func testProcessorReleasing(t *testing.T, maxEvents int, try int64) {
 		t.Fatal("not all the events were released", len(ordered), released)
 	}
 }
+
+func TestProcessorPipeline(t *testing.T) {
+	nodes := tdag.GenNodes(5)
+	var ordered dag.Events
+	_ = tdag.ForEachRandEvent(nodes, 10, 3, rand.New(rand.NewSource(0)), tdag.ForEachEvent{ // nolint:gosec
+		Process: func(e dag.Event, name string) {
+			ordered = append(ordered, e)
+		},
+		Build: func(e dag.MutableEvent, name string) error {
+			e.SetEpoch(1)
+			e.SetFrame(idx.Frame(e.Seq()))
+			return nil
+		},
+	})
+	semaphore := datasemaphore.New(ordered.Metric(), func(received dag.Metric, processing dag.Metric, releasing dag.Metric) {
+		t.Fatal("events semaphore inconsistency")
+	})
+	config := DefaultConfig(cachescale.Identity)
+
+	errBanned := errors.New("banned creator")
+	banned := nodes[0]
+	pipeline := eventcheck.NewPipeline(true).
+		AddParentless("banned", eventcheck.CheckerFunc(func(e dag.Event) error {
+			if e.Creator() == banned {
+				return errBanned
+			}
+			return nil
+		})).
+		AddParents("frame", eventcheck.ParentsCheckerFunc(func(e dag.Event, parents dag.Events) error {
+			if e.Frame() != idx.Frame(e.Seq()) {
+				return errors.New("malformed event frame")
+			}
+			return nil
+		}))
+
+	processed := make(map[hash.Event]dag.Event)
+	releasedErrs := make(map[error]int)
+	mu := sync.RWMutex{}
+	processor := New(semaphore, config, Callback{
+		Event: EventCallback{
+			Process: func(e dag.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed[e.ID()] = e
+				return nil
+			},
+			Released: func(e dag.Event, peer string, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					releasedErrs[err]++
+				}
+			},
+			Exists: func(e hash.Event) bool {
+				mu.RLock()
+				defer mu.RUnlock()
+				return processed[e] != nil
+			},
+			Get: func(id hash.Event) dag.Event {
+				mu.RLock()
+				defer mu.RUnlock()
+				return processed[id]
+			},
+		}.WithPipeline(pipeline),
+		HighestLamport: func() idx.Lamport {
+			return 0
+		},
+	})
+
+	processor.Start()
+	done := make(chan struct{})
+	err := processor.Enqueue("", ordered, true, nil, func() {
+		close(done)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	processor.Stop()
+
+	bannedNum := 0
+	for _, e := range ordered {
+		if e.Creator() == banned {
+			bannedNum++
+		}
+	}
+	if releasedErrs[errBanned] != bannedNum {
+		t.Fatal("not all the events of banned creator were rejected", releasedErrs[errBanned], bannedNum)
+	}
+	stats := pipeline.Stats()
+	if stats["banned"].Checked != uint64(len(ordered)) || stats["banned"].Failed != uint64(bannedNum) {
+		t.Fatal("wrong parentless checker stats", stats["banned"])
+	}
+	if stats["frame"].Failed != 0 || stats["frame"].Checked == 0 {
+		t.Fatal("wrong parents checker stats", stats["frame"])
+	}
+}
+
+type testEpochReader struct {
+	validators *pos.Validators
+	epoch      idx.Epoch
+	mu         sync.RWMutex
+}
+
+func (r *testEpochReader) GetEpochValidators() (*pos.Validators, idx.Epoch) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.validators, r.epoch
+}
+
+func (r *testEpochReader) GetNextEpochValidators() *pos.Validators {
+	return nil
+}
+
+func TestProcessorNextEpoch(t *testing.T) {
+	nodes := tdag.GenNodes(5)
+	genEpoch := func(epoch idx.Epoch) dag.Events {
+		var ordered dag.Events
+		_ = tdag.ForEachRandEvent(nodes, 10, 3, rand.New(rand.NewSource(int64(epoch))), tdag.ForEachEvent{ // nolint:gosec
+			Process: func(e dag.Event, name string) {
+				ordered = append(ordered, e)
+			},
+			Build: func(e dag.MutableEvent, name string) error {
+				e.SetEpoch(epoch)
+				e.SetFrame(idx.Frame(e.Seq()))
+				return nil
+			},
+		})
+		return ordered
+	}
+	epoch1 := genEpoch(1)
+	epoch2 := genEpoch(2)
+
+	semaphore := datasemaphore.New(dag.Metric{Num: 10000, Size: 10000000}, func(received dag.Metric, processing dag.Metric, releasing dag.Metric) {
+		t.Fatal("events semaphore inconsistency")
+	})
+	config := DefaultConfig(cachescale.Identity)
+
+	vb := pos.NewBuilder()
+	for _, v := range nodes {
+		vb.Set(v, 1)
+	}
+	reader := &testEpochReader{validators: vb.Build(), epoch: 1}
+	checker := epochcheck.New(reader)
+
+	processed := make(map[hash.Event]dag.Event)
+	mu := sync.RWMutex{}
+	processor := New(semaphore, config, Callback{
+		Event: EventCallback{
+			Process: func(e dag.Event) error {
+				mu.Lock()
+				defer mu.Unlock()
+				processed[e.ID()] = e
+				if len(processed) == len(epoch1) {
+					// seal epoch
+					reader.mu.Lock()
+					reader.epoch = 2
+					reader.mu.Unlock()
+				}
+				return nil
+			},
+			Released: func(e dag.Event, peer string, err error) {
+				if err != nil {
+					t.Errorf("%s unexpectedly dropped with '%s'", e.String(), err)
+				}
+			},
+			Exists: func(e hash.Event) bool {
+				mu.RLock()
+				defer mu.RUnlock()
+				return processed[e] != nil
+			},
+			Get: func(id hash.Event) dag.Event {
+				mu.RLock()
+				defer mu.RUnlock()
+				return processed[id]
+			},
+			CheckParents: func(e dag.Event, parents dag.Events) error {
+				return nil
+			},
+			CheckParentless: func(e dag.Event, checked func(error)) {
+				checked(checker.Validate(e))
+			},
+		},
+		HighestLamport: func() idx.Lamport {
+			return 0
+		},
+		CurrentEpoch: func() idx.Epoch {
+			_, epoch := reader.GetEpochValidators()
+			return epoch
+		},
+	})
+	processor.Start()
+	defer processor.Stop()
+
+	enqueue := func(events dag.Events) {
+		done := make(chan struct{})
+		if err := processor.Enqueue("peer", events, true, nil, func() { close(done) }); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	}
+	enqueue(epoch2)
+	if processor.TotalNextEpochBuffered().Num != idx.Event(len(epoch2)) {
+		t.Fatal("next epoch events weren't buffered", processor.TotalNextEpochBuffered())
+	}
+	// next epoch events are released automatically once the epoch is sealed by the current epoch events
+	enqueue(epoch1)
+	for start := time.Now(); semaphore.Processing().Num != 0; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("next epoch events weren't released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(processed) != len(epoch1)+len(epoch2) {
+		t.Fatal("next epoch events weren't processed")
+	}
+	if processor.TotalNextEpochBuffered().Num != 0 {
+		t.Fatal("next epoch buffer isn't empty")
+	}
+}
+
+func TestProcessorOverloaded(t *testing.T) {
+	semaphore := datasemaphore.New(dag.Metric{Num: 1000, Size: 100000}, func(received dag.Metric, processing dag.Metric, releasing dag.Metric) {
+		t.Fatal("events semaphore inconsistency")
+	})
+	config := DefaultConfig(cachescale.Identity)
+	config.MaxTasks = 8
+	config.CheckerBatch = 1
+
+	released := 0
+	newProcessor := func() *Processor {
+		return New(semaphore, config, Callback{
+			Event: EventCallback{
+				Released: func(e dag.Event, peer string, err error) {
+					if err != eventcheck.ErrSpilledEvent {
+						t.Errorf("%s unexpectedly dropped with '%s'", e.String(), err)
+					}
+					released++
+				},
+				CheckParentless: func(e dag.Event, checked func(error)) {
+					checked(nil)
+				},
+			},
+		})
+	}
+
+	events := make(dag.Events, 7)
+	for i := range events {
+		e := &tdag.TestEvent{}
+		e.SetSeq(idx.Event(i + 1))
+		e.SetLamport(idx.Lamport(i + 1))
+		events[i] = e
+	}
+	// processors aren't started, so the tasks are kept in the queues
+	processor := newProcessor()
+	if err := processor.Enqueue("peer", events, true, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a batch is a single task, regardless of the number of its chunks
+	if processor.Overloaded() {
+		t.Fatal("processor is overloaded by a single batch")
+	}
+	processor = newProcessor()
+	for _, e := range events {
+		if err := processor.Enqueue("peer", dag.Events{e}, true, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !processor.Overloaded() {
+		t.Fatal("processor isn't overloaded")
+	}
+
+	// events of a batch which failed to be enqueued are released
+	processor = newProcessor()
+	processor.Start()
+	before := semaphore.PeerProcessing("peer")
+	if !semaphore.AcquirePeer("peer", events.Metric(), time.Second) {
+		t.Fatal("failed to acquire semaphore")
+	}
+	processor.Stop()
+	released = 0
+	if err := processor.enqueue("peer", events, true, nil, nil); err == nil {
+		t.Fatal("enqueued into a stopped processor")
+	}
+	if released != len(events) {
+		t.Fatal("not all the events were released", released)
+	}
+	if semaphore.PeerProcessing("peer") != before {
+		t.Fatal("semaphore weight of the failed batch isn't released", semaphore.PeerProcessing("peer"))
+	}
+}
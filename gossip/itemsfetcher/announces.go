@@ -0,0 +1,113 @@
+package itemsfetcher
+
+import (
+	"sync/atomic"
+)
+
+// announcesEntry is a node of the announcesCache eviction list
+type announcesEntry[K comparable] struct {
+	key        K
+	announces  []announceData[K]
+	prev, next *announcesEntry[K]
+}
+
+// announcesCache is a weighted LRU of announced items, specialized to avoid boxing of the keys.
+// It's not thread-safe, except for Len.
+type announcesCache[K comparable] struct {
+	items   map[K]*announcesEntry[K]
+	root    announcesEntry[K] // root.next is the newest entry, root.prev is the oldest
+	len     atomic.Int64
+	weight  uint
+	limit   int
+	onEvict func(key K)
+}
+
+func newAnnouncesCache[K comparable](limit int, onEvict func(key K)) *announcesCache[K] {
+	c := &announcesCache[K]{
+		items:   make(map[K]*announcesEntry[K]),
+		limit:   limit,
+		onEvict: onEvict,
+	}
+	c.root.next = &c.root
+	c.root.prev = &c.root
+	return c
+}
+
+func (c *announcesCache[K]) unlink(e *announcesEntry[K]) {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.prev, e.next = nil, nil
+}
+
+func (c *announcesCache[K]) pushFront(e *announcesEntry[K]) {
+	e.prev = &c.root
+	e.next = c.root.next
+	c.root.next.prev = e
+	c.root.next = e
+}
+
+// Get returns announces of the item and marks it as recently used
+func (c *announcesCache[K]) Get(key K) ([]announceData[K], bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.unlink(e)
+	c.pushFront(e)
+	return e.announces, true
+}
+
+// Add sets announces of the item, weighted by their number, and evicts the oldest items if the limit is exceeded
+func (c *announcesCache[K]) Add(key K, announces []announceData[K]) {
+	if e, ok := c.items[key]; ok {
+		c.weight += uint(len(announces)) - uint(len(e.announces))
+		e.announces = announces
+		c.unlink(e)
+		c.pushFront(e)
+	} else {
+		e = &announcesEntry[K]{
+			key:       key,
+			announces: announces,
+		}
+		c.items[key] = e
+		c.pushFront(e)
+		c.weight += uint(len(announces))
+		c.len.Add(1)
+	}
+	for c.weight > uint(c.limit) || len(c.items) > c.limit {
+		c.remove(c.root.prev)
+	}
+}
+
+// Remove deletes the item, returning true if it was present
+func (c *announcesCache[K]) Remove(key K) bool {
+	e, ok := c.items[key]
+	if ok {
+		c.remove(e)
+	}
+	return ok
+}
+
+func (c *announcesCache[K]) remove(e *announcesEntry[K]) {
+	c.unlink(e)
+	delete(c.items, e.key)
+	c.weight -= uint(len(e.announces))
+	c.len.Add(-1)
+	if c.onEvict != nil {
+		c.onEvict(e.key)
+	}
+}
+
+// Keys returns the items from oldest to newest
+func (c *announcesCache[K]) Keys() []K {
+	keys := make([]K, 0, len(c.items))
+	for e := c.root.prev; e != &c.root; e = e.prev {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// Len returns the number of items. It's thread-safe.
+func (c *announcesCache[K]) Len() int {
+	return int(c.len.Load())
+}
@@ -0,0 +1,45 @@
+package itemsfetcher
+
+import (
+	"testing"
+)
+
+func TestAnnouncesCache(t *testing.T) {
+	var evicted []int
+	c := newAnnouncesCache[int](4, func(key int) {
+		evicted = append(evicted, key)
+	})
+	ann := func(n int) []announceData[int] {
+		return make([]announceData[int], n)
+	}
+
+	c.Add(1, ann(1))
+	c.Add(2, ann(1))
+	c.Add(3, ann(1))
+	// 1 becomes the newest
+	if _, ok := c.Get(1); !ok {
+		t.Fatal("item not found")
+	}
+	// weight limit is exceeded, so the oldest item is evicted
+	c.Add(4, ann(2))
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Fatal("wrong eviction", evicted)
+	}
+	keys := c.Keys()
+	if len(keys) != 3 || keys[0] != 3 || keys[1] != 1 || keys[2] != 4 || c.Len() != 3 {
+		t.Fatal("wrong keys order", keys)
+	}
+
+	if !c.Remove(3) || c.Remove(3) || c.Len() != 2 {
+		t.Fatal("wrong removal")
+	}
+	// re-adding an item updates its weight
+	c.Add(1, ann(2))
+	if len(evicted) != 2 || c.Len() != 2 {
+		t.Fatal("unexpected eviction", evicted)
+	}
+	c.Add(1, ann(3))
+	if len(evicted) != 3 || evicted[2] != 4 || c.Len() != 1 {
+		t.Fatal("wrong eviction", evicted)
+	}
+}
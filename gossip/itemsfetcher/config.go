@@ -12,6 +12,12 @@ type Config struct {
 	GatherSlack   time.Duration // Interval used to collate almost-expired announces with fetches
 	HashLimit     int           // Maximum number of unique events a peer may have announced
 
+	// LatencyFactor enables adaptive per-peer arrive timeouts, which are set to the peer's average latency multiplied by the factor.
+	// ArriveTimeout is used for peers with no delivered items. Zero disables the adaptation.
+	LatencyFactor    float64
+	MinArriveTimeout time.Duration // Lower bound of an adaptive arrive timeout
+	MaxArriveTimeout time.Duration // Upper bound of an adaptive arrive timeout, zero means no bound
+
 	MaxBatch int // Maximum number of hashes in an announce batch (batch is divided if exceeded)
 
 	MaxParallelRequests int // Maximum number of parallel requests
@@ -26,6 +32,9 @@ func DefaultConfig(scale cachescale.Func) Config {
 		ForgetTimeout:       1 * time.Minute,
 		ArriveTimeout:       1000 * time.Millisecond,
 		GatherSlack:         100 * time.Millisecond,
+		LatencyFactor:       3,
+		MinArriveTimeout:    250 * time.Millisecond,
+		MaxArriveTimeout:    3 * time.Second,
 		HashLimit:           20000,
 		MaxBatch:            scale.I(512),
 		MaxQueuedBatches:    scale.I(32),
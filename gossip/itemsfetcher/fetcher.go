@@ -2,11 +2,9 @@ package itemsfetcher
 
 import (
 	"errors"
-	"math/rand"
 	"sync"
 	"time"
 
-	"github.com/panoptisDev/lachesis-base/utils/wlru"
 	"github.com/panoptisDev/lachesis-base/utils/workers"
 )
 
@@ -17,75 +15,82 @@ import (
  */
 
 var (
-	errTerminated = errors.New("terminated")
+	// ErrItemNotArrived indicates that a peer was requested an announced item, but didn't deliver it before ForgetTimeout
+	ErrItemNotArrived = errors.New("announced item didn't arrive")
+	errTerminated     = errors.New("terminated")
 )
 
-// ItemsRequesterFn is a callback type for sending an item retrieval request.
-type ItemsRequesterFn func([]interface{}) error
+// TypedItemsRequesterFn is a callback type for sending an item retrieval request.
+type TypedItemsRequesterFn[K comparable] func([]K) error
 
-type announceData struct {
+type announceData[K comparable] struct {
 	time       time.Time // Timestamp of the announcement
 	peer       string    // Identifier of the peer originating the notification
-	fetchItems ItemsRequesterFn
+	fetchItems TypedItemsRequesterFn[K]
 }
 
-type announcesBatch struct {
-	announceData
-	ids []interface{} // Hashes of the items being announced
+type announcesBatch[K comparable] struct {
+	announceData[K]
+	ids []K // Hashes of the items being announced
 }
 
-type fetchingItem struct {
-	announce     announceData
+type fetchingItem[K comparable] struct {
+	announce     announceData[K]
 	fetchingTime time.Time
+	timeout      time.Duration // Time allowance of the peer
 }
 
-// Fetcher is responsible for accumulating item announcements from various peers
+// TypedFetcher is responsible for accumulating item announcements from various peers
 // and scheduling them for retrieval.
-type Fetcher struct {
+type TypedFetcher[K comparable] struct {
 	cfg Config
 
 	// Various item channels
-	notifications chan announcesBatch
-	receivedItems chan []interface{}
-	quit          chan struct{}
+	notifications         chan announcesBatch[K]
+	priorityNotifications chan announcesBatch[K]
+	receivedItems         chan []K
+	quit                  chan struct{}
 
 	// Callbacks
-	callback Callback
+	callback TypedCallback[K]
 
 	// Announce states
-	announces *wlru.Cache // Announced items, scheduled for fetching
+	announces *announcesCache[K] // Announced items, scheduled for fetching
 
-	fetching map[interface{}]fetchingItem // Announced items, currently fetching
+	fetching map[K]fetchingItem[K] // Announced items, currently fetching
+	stats    *peersStats           // Delivery statistics of peers
 	wg       sync.WaitGroup
 
 	parallelTasks *workers.Workers
 }
 
-type Callback struct {
+type TypedCallback[K comparable] struct {
 	// FilterInterested returns only item which may be requested.
-	OnlyInterested func(ids []interface{}) []interface{}
+	OnlyInterested func(ids []K) []K
 	Suspend        func() bool
+	// Misbehaviour is called with a peer which didn't deliver a requested item. Optional.
+	Misbehaviour func(peer string, err error)
 }
 
-// New creates an item fetcher to retrieve items based on hash announcements.
-func New(cfg Config, callback Callback) *Fetcher {
-	f := &Fetcher{
-		cfg:           cfg,
-		notifications: make(chan announcesBatch, cfg.MaxQueuedBatches),
-		receivedItems: make(chan []interface{}, cfg.MaxQueuedBatches),
-		quit:          make(chan struct{}),
-		fetching:      make(map[interface{}]fetchingItem),
-		callback:      callback,
+// NewTyped creates an item fetcher to retrieve items of type K based on hash announcements.
+func NewTyped[K comparable](cfg Config, callback TypedCallback[K]) *TypedFetcher[K] {
+	f := &TypedFetcher[K]{
+		cfg:                   cfg,
+		notifications:         make(chan announcesBatch[K], cfg.MaxQueuedBatches),
+		priorityNotifications: make(chan announcesBatch[K], cfg.MaxQueuedBatches),
+		receivedItems:         make(chan []K, cfg.MaxQueuedBatches),
+		quit:                  make(chan struct{}),
+		fetching:              make(map[K]fetchingItem[K]),
+		stats:                 newPeersStats(),
+		callback:              callback,
 	}
-	f.announces, _ = wlru.NewWithEvict(uint(cfg.HashLimit), cfg.HashLimit, func(key interface{}, _ interface{}) {
-		delete(f.fetching, key)
-	})
+	f.announces = newAnnouncesCache[K](cfg.HashLimit, f.unfetch)
 	f.parallelTasks = workers.New(&f.wg, f.quit, f.cfg.MaxParallelRequests*2)
 	return f
 }
 
 // Start boots up the items fetcher.
-func (f *Fetcher) Start() {
+func (f *TypedFetcher[K]) Start() {
 	f.parallelTasks.Start(f.cfg.MaxParallelRequests)
 	f.wg.Add(1)
 	go func() {
@@ -96,30 +101,43 @@ func (f *Fetcher) Start() {
 
 // Stop interrupts the fetcher, canceling all the pending operations.
 // Stop waits until all the internal goroutines have finished.
-func (f *Fetcher) Stop() {
+func (f *TypedFetcher[K]) Stop() {
 	close(f.quit)
 	f.parallelTasks.Drain()
 	f.wg.Wait()
 }
 
 // Overloaded returns true if too many items are being requested.
-func (f *Fetcher) Overloaded() bool {
+func (f *TypedFetcher[K]) Overloaded() bool {
 	return len(f.receivedItems) > f.cfg.MaxQueuedBatches*3/4 ||
 		len(f.notifications) > f.cfg.MaxQueuedBatches*3/4 ||
+		len(f.priorityNotifications) > f.cfg.MaxQueuedBatches*3/4 ||
 		f.announces.Len() > f.cfg.HashLimit/2
 }
 
 // NotifyAnnounces announces the fetcher of the potential availability of a new item in
 // the network.
-func (f *Fetcher) NotifyAnnounces(peer string, ids []interface{}, time time.Time, fetchItems ItemsRequesterFn) error {
+func (f *TypedFetcher[K]) NotifyAnnounces(peer string, ids []K, time time.Time, fetchItems TypedItemsRequesterFn[K]) error {
+	return f.notifyAnnounces(f.notifications, peer, ids, time, fetchItems)
+}
+
+// NotifyPrioritized is similar to NotifyAnnounces, but the items are processed ahead of regular announces,
+// and are requested from the peer right away even if they are being fetched from another peer.
+// It's supposed to be used for items which block processing of other items, e.g. missing parents of buffered events.
+// The ids should be ordered by priority.
+func (f *TypedFetcher[K]) NotifyPrioritized(peer string, ids []K, time time.Time, fetchItems TypedItemsRequesterFn[K]) error {
+	return f.notifyAnnounces(f.priorityNotifications, peer, ids, time, fetchItems)
+}
+
+func (f *TypedFetcher[K]) notifyAnnounces(notifications chan announcesBatch[K], peer string, ids []K, time time.Time, fetchItems TypedItemsRequesterFn[K]) error {
 	// divide big batch into smaller ones
 	for start := 0; start < len(ids); start += f.cfg.MaxBatch {
 		end := len(ids)
 		if end > start+f.cfg.MaxBatch {
 			end = start + f.cfg.MaxBatch
 		}
-		op := announcesBatch{
-			announceData: announceData{
+		op := announcesBatch[K]{
+			announceData: announceData[K]{
 				time:       time,
 				peer:       peer,
 				fetchItems: fetchItems,
@@ -129,14 +147,14 @@ func (f *Fetcher) NotifyAnnounces(peer string, ids []interface{}, time time.Time
 		select {
 		case <-f.quit:
 			return errTerminated
-		case f.notifications <- op:
+		case notifications <- op:
 			continue
 		}
 	}
 	return nil
 }
 
-func (f *Fetcher) NotifyReceived(ids []interface{}) error {
+func (f *TypedFetcher[K]) NotifyReceived(ids []K) error {
 	// divide big batch into smaller ones
 	for start := 0; start < len(ids); start += f.cfg.MaxBatch {
 		end := len(ids)
@@ -153,15 +171,15 @@ func (f *Fetcher) NotifyReceived(ids []interface{}) error {
 	return nil
 }
 
-func (f *Fetcher) getAnnounces(id interface{}) []announceData {
+func (f *TypedFetcher[K]) getAnnounces(id K) []announceData[K] {
 	announces, ok := f.announces.Get(id)
 	if !ok {
-		return []announceData{}
+		return []announceData[K]{}
 	}
-	return announces.([]announceData)
+	return announces
 }
 
-func (f *Fetcher) processNotification(notification announcesBatch, fetchTimer *time.Timer) {
+func (f *TypedFetcher[K]) processNotification(notification announcesBatch[K], fetchTimer *time.Timer, prioritized bool) {
 	first := len(f.fetching) == 0
 
 	// filter only not known
@@ -172,19 +190,16 @@ func (f *Fetcher) processNotification(notification announcesBatch, fetchTimer *t
 
 	noFetching := f.callback.Suspend()
 
-	toFetch := make([]interface{}, 0, len(notification.ids))
+	toFetch := make([]K, 0, len(notification.ids))
 	now := time.Now()
 	for _, id := range notification.ids {
 		// add new announcement. other peers may already have announced it, so it's an array
 		anns := append(f.getAnnounces(id), notification.announceData)
-		f.announces.Add(id, anns, uint(len(anns)))
+		f.announces.Add(id, anns)
 		// if it wasn't announced before, then schedule for fetching this time
 		if !noFetching {
-			if _, ok := f.fetching[id]; !ok {
-				f.fetching[id] = fetchingItem{
-					announce:     notification.announceData,
-					fetchingTime: now,
-				}
+			if fetching, ok := f.fetching[id]; !ok || prioritized && now.Sub(fetching.fetchingTime) > f.cfg.GatherSlack {
+				f.fetch(id, notification.announceData, now)
 				toFetch = append(toFetch, id)
 			}
 		}
@@ -204,34 +219,49 @@ func (f *Fetcher) processNotification(notification announcesBatch, fetchTimer *t
 }
 
 // Loop is the main fetcher loop, checking and processing various notifications
-func (f *Fetcher) loop() {
+func (f *TypedFetcher[K]) loop() {
 	// Iterate the item fetching until a quit is requested
 	fetchTimer := time.NewTimer(0)
 	defer fetchTimer.Stop()
 
 	for {
+		// Serve prioritized announces first
+		select {
+		case notification := <-f.priorityNotifications:
+			f.processNotification(notification, fetchTimer, true)
+			continue
+		default:
+		}
+
 		// Wait for an outside item to occur
 		select {
 		case <-f.quit:
 			// Fetcher terminating, abort all operations
 			return
 
+		case notification := <-f.priorityNotifications:
+			f.processNotification(notification, fetchTimer, true)
+
 		case notification := <-f.notifications:
-			f.processNotification(notification, fetchTimer)
+			f.processNotification(notification, fetchTimer, false)
 
 		case ids := <-f.receivedItems:
+			now := time.Now()
 			for _, id := range ids {
+				if fetching, ok := f.fetching[id]; ok {
+					f.stats.delivered(fetching.announce.peer, now.Sub(fetching.fetchingTime))
+				}
 				f.forgetHash(id)
 			}
 
 		case <-fetchTimer.C:
 			now := time.Now()
 			// At least one item's timer ran out, check for needing retrieval
-			request := make(map[string][]interface{})
-			requestFns := make(map[string]ItemsRequesterFn)
+			request := make(map[string][]K)
+			requestFns := make(map[string]TypedItemsRequesterFn[K])
 
 			// Find not arrived items
-			all := append([]interface{}(nil), f.announces.Keys()...)
+			all := f.announces.Keys()
 			notArrived := f.callback.OnlyInterested(all)
 
 			for _, id := range notArrived {
@@ -244,23 +274,28 @@ func (f *Fetcher) loop() {
 				oldest := announces[0] // first is the oldest
 				if time.Since(oldest.time) > f.cfg.ForgetTimeout {
 					// Forget too old announces
+					if fetching, ok := f.fetching[id]; ok && f.callback.Misbehaviour != nil {
+						f.callback.Misbehaviour(fetching.announce.peer, ErrItemNotArrived)
+					}
 					f.forgetHash(id)
-				} else if time.Since(f.fetching[id].fetchingTime) > f.cfg.ArriveTimeout-f.cfg.GatherSlack {
-					// The item still didn't arrive, queue for fetching from a random peer
-					announce := announces[rand.Intn(len(announces))] // nolint:gosec
+				} else if fetching, ok := f.fetching[id]; !ok || now.Sub(fetching.fetchingTime) > fetching.timeout-f.cfg.GatherSlack {
+					// The item still didn't arrive, queue for fetching from the best alternative peer
+					previous := ""
+					if ok {
+						previous = fetching.announce.peer
+						f.stats.timedOut(previous)
+					}
+					announce := f.route(announces, previous)
 					request[announce.peer] = append(request[announce.peer], id)
 					requestFns[announce.peer] = announce.fetchItems
-					f.fetching[id] = fetchingItem{
-						announce:     announce,
-						fetchingTime: now,
-					}
+					f.fetch(id, announce, now)
 				}
 			}
 
 			// Forget arrived items.
 			// It's possible to get here only if item arrived out-of-fetcher, via another channel.
 			// Also may be possible after a change of an epoch.
-			notArrivedMap := make(map[interface{}]bool, len(notArrived))
+			notArrivedMap := make(map[K]bool, len(notArrived))
 			for _, id := range notArrived {
 				notArrivedMap[id] = true
 			}
@@ -292,18 +327,19 @@ func maxDuration(a, b time.Duration) time.Duration {
 }
 
 // rescheduleFetch resets the specified fetch timer to the next announce timeout.
-func (f *Fetcher) rescheduleFetch(fetch *time.Timer) {
+func (f *TypedFetcher[K]) rescheduleFetch(fetch *time.Timer) {
 	// Short circuit if no items are announced
 	if f.announces.Len() == 0 {
 		return
 	}
 	// Otherwise find the earliest expiring announcement
-	earliest := time.Now()
+	now := time.Now()
+	earliest := now.Add(f.cfg.ArriveTimeout)
 	i := 0
 	maxChecks := f.cfg.HashLimit / 32
 	for _, fetch := range f.fetching {
-		if earliest.After(fetch.fetchingTime) {
-			earliest = fetch.fetchingTime
+		if deadline := fetch.fetchingTime.Add(fetch.timeout); earliest.After(deadline) {
+			earliest = deadline
 		}
 		if i >= maxChecks {
 			// no need to scan all the entries
@@ -312,11 +348,29 @@ func (f *Fetcher) rescheduleFetch(fetch *time.Timer) {
 		i++
 	}
 	// limit minimum duration to prevent spinning too often
-	fetch.Reset(maxDuration(f.cfg.ArriveTimeout-time.Since(earliest), f.cfg.ArriveTimeout/8))
+	fetch.Reset(maxDuration(earliest.Sub(now), f.minArriveTimeout()/8))
+}
+
+// fetch marks the item as being fetched from the announcer
+func (f *TypedFetcher[K]) fetch(id K, announce announceData[K], now time.Time) {
+	f.unfetch(id)
+	f.stats.requested(announce.peer)
+	f.fetching[id] = fetchingItem[K]{
+		announce:     announce,
+		fetchingTime: now,
+		timeout:      f.arriveTimeout(f.stats.get(announce.peer)),
+	}
+}
+
+func (f *TypedFetcher[K]) unfetch(id K) {
+	if fetching, ok := f.fetching[id]; ok {
+		f.stats.finished(fetching.announce.peer)
+		delete(f.fetching, id)
+	}
 }
 
 // forgetHash removes all traces of a item announcement from the fetcher's
 // internal state.
-func (f *Fetcher) forgetHash(id interface{}) {
+func (f *TypedFetcher[K]) forgetHash(id K) {
 	f.announces.Remove(id) // f.fetching is deleted inside the evict callback
 }
@@ -2,6 +2,7 @@ package itemsfetcher_test
 
 import (
 	"github.com/panoptisDev/lachesis-base/gossip/itemsfetcher"
+	"github.com/panoptisDev/lachesis-base/hash"
 	"testing"
 	"time"
 )
@@ -58,3 +59,293 @@ func TestFetcher(t *testing.T) {
 		t.Errorf("unexpected fetchedIds: %v", fetchedIds)
 	}
 }
+
+func TestFetcherMisbehaviour(t *testing.T) {
+	misbehaved := make(chan string, 10)
+	fetcher := itemsfetcher.New(itemsfetcher.Config{
+		ForgetTimeout:       100 * time.Millisecond,
+		ArriveTimeout:       20 * time.Millisecond,
+		GatherSlack:         5 * time.Millisecond,
+		HashLimit:           10000,
+		MaxBatch:            2,
+		MaxParallelRequests: 1,
+		MaxQueuedBatches:    2,
+	}, itemsfetcher.Callback{
+		OnlyInterested: func(ids []interface{}) []interface{} {
+			return ids // item never arrives
+		},
+		Suspend: func() bool {
+			return false
+		},
+		Misbehaviour: func(peer string, err error) {
+			if err != itemsfetcher.ErrItemNotArrived {
+				t.Errorf("unexpected error: %v", err)
+			}
+			misbehaved <- peer
+		},
+	})
+	fetcher.Start()
+	defer fetcher.Stop()
+
+	err := fetcher.NotifyAnnounces("peer1", []interface{}{"eventA"}, time.Now(), func(ids []any) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peer := <-misbehaved:
+		if peer != "peer1" {
+			t.Errorf("unexpected peer: %s", peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("misbehaviour wasn't reported")
+	}
+}
+
+func TestFetcherPrioritized(t *testing.T) {
+	fetcher := itemsfetcher.New(itemsfetcher.Config{
+		ForgetTimeout:       1 * time.Minute,
+		ArriveTimeout:       1 * time.Minute,
+		GatherSlack:         10 * time.Millisecond,
+		HashLimit:           10000,
+		MaxBatch:            16,
+		MaxParallelRequests: 1,
+		MaxQueuedBatches:    2,
+	}, itemsfetcher.Callback{
+		OnlyInterested: func(ids []interface{}) []interface{} {
+			return ids
+		},
+		Suspend: func() bool {
+			return false
+		},
+	})
+	fetcher.Start()
+	defer fetcher.Stop()
+
+	requested := make(chan string, 10)
+	requester := func(peer string) itemsfetcher.ItemsRequesterFn {
+		return func(ids []interface{}) error {
+			requested <- peer
+			return nil
+		}
+	}
+
+	if err := fetcher.NotifyAnnounces("peer1", []interface{}{"eventA"}, time.Now(), requester("peer1")); err != nil {
+		t.Fatal(err)
+	}
+	if peer := <-requested; peer != "peer1" {
+		t.Fatalf("unexpected peer: %s", peer)
+	}
+	// a regular announce from another peer isn't requested until ArriveTimeout
+	time.Sleep(20 * time.Millisecond)
+	if err := fetcher.NotifyAnnounces("peer2", []interface{}{"eventA"}, time.Now(), requester("peer2")); err != nil {
+		t.Fatal(err)
+	}
+	// a prioritized one is requested right away
+	if err := fetcher.NotifyPrioritized("peer3", []interface{}{"eventA"}, time.Now(), requester("peer3")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peer := <-requested:
+		if peer != "peer3" {
+			t.Fatalf("unexpected peer: %s", peer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("prioritized item wasn't requested")
+	}
+}
+
+func TestFetcherRerouting(t *testing.T) {
+	fetcher := itemsfetcher.New(itemsfetcher.Config{
+		ForgetTimeout:       1 * time.Minute,
+		ArriveTimeout:       50 * time.Millisecond,
+		GatherSlack:         5 * time.Millisecond,
+		LatencyFactor:       3,
+		MinArriveTimeout:    10 * time.Millisecond,
+		MaxArriveTimeout:    100 * time.Millisecond,
+		HashLimit:           10000,
+		MaxBatch:            16,
+		MaxParallelRequests: 1,
+		MaxQueuedBatches:    2,
+	}, itemsfetcher.Callback{
+		OnlyInterested: func(ids []interface{}) []interface{} {
+			return ids
+		},
+		Suspend: func() bool {
+			return false
+		},
+	})
+	fetcher.Start()
+	defer fetcher.Stop()
+
+	requested := make(chan string, 10)
+	requester := func(peer string) itemsfetcher.ItemsRequesterFn {
+		return func(ids []interface{}) error {
+			requested <- peer
+			return nil
+		}
+	}
+	waitRequest := func() string {
+		select {
+		case peer := <-requested:
+			return peer
+		case <-time.After(5 * time.Second):
+			t.Fatal("item wasn't requested")
+			return ""
+		}
+	}
+
+	if err := fetcher.NotifyAnnounces("peer1", []interface{}{"eventA"}, time.Now(), requester("peer1")); err != nil {
+		t.Fatal(err)
+	}
+	if peer := waitRequest(); peer != "peer1" {
+		t.Fatalf("unexpected peer: %s", peer)
+	}
+	if err := fetcher.NotifyAnnounces("peer2", []interface{}{"eventA"}, time.Now(), requester("peer2")); err != nil {
+		t.Fatal(err)
+	}
+	// peer1 doesn't deliver the item, so it's re-routed to the alternative announcer
+	if peer := waitRequest(); peer != "peer2" {
+		t.Fatalf("unexpected peer: %s", peer)
+	}
+	if stats := fetcher.PeerStats("peer1"); stats.TimedOut != 1 || stats.Outstanding != 0 || stats.SuccessRatio() != 0 {
+		t.Fatalf("unexpected peer1 stats: %+v", stats)
+	}
+
+	if err := fetcher.NotifyReceived([]interface{}{"eventA"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := fetcher.PeerStats("peer2")
+		if stats.Delivered == 1 {
+			if stats.Outstanding != 0 || stats.Latency == 0 || stats.SuccessRatio() != 1 {
+				t.Fatalf("unexpected peer2 stats: %+v", stats)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("delivery wasn't accounted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	fetcher.ForgetPeer("peer1")
+	if len(fetcher.PeersStats()) != 1 {
+		t.Fatal("peer wasn't forgotten")
+	}
+}
+
+func TestTypedFetcher(t *testing.T) {
+	fetcher := itemsfetcher.NewTyped[hash.Event](itemsfetcher.Config{
+		ForgetTimeout:       1 * time.Minute,
+		ArriveTimeout:       1 * time.Minute,
+		GatherSlack:         10 * time.Millisecond,
+		HashLimit:           10000,
+		MaxBatch:            2,
+		MaxParallelRequests: 1,
+		MaxQueuedBatches:    2,
+	}, itemsfetcher.TypedCallback[hash.Event]{
+		OnlyInterested: func(ids []hash.Event) []hash.Event {
+			return ids
+		},
+		Suspend: func() bool {
+			return false
+		},
+	})
+	fetcher.Start()
+	defer fetcher.Stop()
+
+	announced := hash.FakeEvents(3)
+	fetched := make(chan hash.Event, len(announced))
+	err := fetcher.NotifyAnnounces("peer1", announced, time.Now(), func(ids []hash.Event) error {
+		for _, id := range ids {
+			fetched <- id
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := hash.EventsSet{}
+	for range announced {
+		select {
+		case id := <-fetched:
+			got.Add(id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("item wasn't requested")
+		}
+	}
+	for _, id := range announced {
+		if !got.Contains(id) {
+			t.Fatalf("%s wasn't requested", id)
+		}
+	}
+}
+
+func benchmarkConfig() itemsfetcher.Config {
+	return itemsfetcher.Config{
+		ForgetTimeout:       1 * time.Minute,
+		ArriveTimeout:       1 * time.Minute,
+		GatherSlack:         100 * time.Millisecond,
+		HashLimit:           20000,
+		MaxBatch:            64,
+		MaxParallelRequests: 4,
+		MaxQueuedBatches:    32,
+	}
+}
+
+func BenchmarkFetcherAnnounces(b *testing.B) {
+	ids := hash.FakeEvents(64)
+
+	b.Run("untyped", func(b *testing.B) {
+		fetcher := itemsfetcher.New(benchmarkConfig(), itemsfetcher.Callback{
+			OnlyInterested: func(ids []interface{}) []interface{} {
+				return ids
+			},
+			Suspend: func() bool {
+				return false
+			},
+		})
+		fetcher.Start()
+		defer fetcher.Stop()
+		requester := func([]interface{}) error {
+			return nil
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			boxed := make([]interface{}, len(ids))
+			for j, id := range ids {
+				boxed[j] = id
+			}
+			_ = fetcher.NotifyAnnounces("peer", boxed, time.Now(), requester)
+			_ = fetcher.NotifyReceived(boxed)
+		}
+	})
+
+	b.Run("typed", func(b *testing.B) {
+		fetcher := itemsfetcher.NewTyped[hash.Event](benchmarkConfig(), itemsfetcher.TypedCallback[hash.Event]{
+			OnlyInterested: func(ids []hash.Event) []hash.Event {
+				return ids
+			},
+			Suspend: func() bool {
+				return false
+			},
+		})
+		fetcher.Start()
+		defer fetcher.Stop()
+		requester := func([]hash.Event) error {
+			return nil
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = fetcher.NotifyAnnounces("peer", ids, time.Now(), requester)
+			_ = fetcher.NotifyReceived(ids)
+		}
+	})
+}
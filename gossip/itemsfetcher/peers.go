@@ -0,0 +1,183 @@
+package itemsfetcher
+
+import (
+	"sync"
+	"time"
+)
+
+// latencyWeight is the weight of a new latency sample in the moving average
+const latencyWeight = 0.2
+
+// PeerStats is a delivery statistics of a peer
+type PeerStats struct {
+	Requested   uint64        // Number of items requested from the peer
+	Delivered   uint64        // Number of requested items which arrived
+	TimedOut    uint64        // Number of requested items which didn't arrive in time
+	Outstanding int           // Number of items being fetched from the peer
+	Latency     time.Duration // Moving average of the delivery latency, zero if nothing was delivered
+}
+
+// SuccessRatio returns a share of delivered items among the finished requests, or 1 if there are none
+func (s PeerStats) SuccessRatio() float64 {
+	finished := s.Delivered + s.TimedOut
+	if finished == 0 {
+		return 1
+	}
+	return float64(s.Delivered) / float64(finished)
+}
+
+// peersStats is a thread-safe registry of peers statistics
+type peersStats struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStats
+}
+
+func newPeersStats() *peersStats {
+	return &peersStats{
+		peers: make(map[string]*PeerStats),
+	}
+}
+
+func (p *peersStats) peer(peer string) *PeerStats {
+	s := p.peers[peer]
+	if s == nil {
+		s = &PeerStats{}
+		p.peers[peer] = s
+	}
+	return s
+}
+
+func (p *peersStats) requested(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.peer(peer)
+	s.Requested++
+	s.Outstanding++
+}
+
+// finished is called once an item isn't fetched from the peer anymore, whatever the reason is
+func (p *peersStats) finished(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.peers[peer]; s != nil && s.Outstanding > 0 {
+		s.Outstanding--
+	}
+}
+
+func (p *peersStats) delivered(peer string, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.peer(peer)
+	s.Delivered++
+	if s.Latency == 0 {
+		s.Latency = latency
+	} else {
+		s.Latency = time.Duration(float64(s.Latency)*(1-latencyWeight) + float64(latency)*latencyWeight)
+	}
+}
+
+func (p *peersStats) timedOut(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peer(peer).TimedOut++
+}
+
+func (p *peersStats) get(peer string) PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.peers[peer]; s != nil {
+		return *s
+	}
+	return PeerStats{}
+}
+
+func (p *peersStats) all() map[string]PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make(map[string]PeerStats, len(p.peers))
+	for peer, s := range p.peers {
+		res[peer] = *s
+	}
+	return res
+}
+
+func (p *peersStats) forget(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.peers[peer]; s != nil && s.Outstanding == 0 {
+		delete(p.peers, peer)
+	}
+}
+
+// PeerStats returns the delivery statistics of a peer
+func (f *TypedFetcher[K]) PeerStats(peer string) PeerStats {
+	return f.stats.get(peer)
+}
+
+// PeersStats returns the delivery statistics of all the known peers
+func (f *TypedFetcher[K]) PeersStats() map[string]PeerStats {
+	return f.stats.all()
+}
+
+// ForgetPeer drops the statistics of a peer, unless items are being fetched from it.
+// It should be called after a peer is disconnected.
+func (f *TypedFetcher[K]) ForgetPeer(peer string) {
+	f.stats.forget(peer)
+}
+
+// arriveTimeout returns the time allowance for an item requested from the peer.
+// It adapts to the peer's observed latency if Config.LatencyFactor is set.
+func (f *TypedFetcher[K]) arriveTimeout(s PeerStats) time.Duration {
+	if f.cfg.LatencyFactor <= 0 || s.Latency == 0 {
+		return f.cfg.ArriveTimeout
+	}
+	timeout := time.Duration(float64(s.Latency) * f.cfg.LatencyFactor)
+	if timeout < f.cfg.MinArriveTimeout {
+		timeout = f.cfg.MinArriveTimeout
+	}
+	if f.cfg.MaxArriveTimeout != 0 && timeout > f.cfg.MaxArriveTimeout {
+		timeout = f.cfg.MaxArriveTimeout
+	}
+	return timeout
+}
+
+// minArriveTimeout returns the lowest possible time allowance
+func (f *TypedFetcher[K]) minArriveTimeout() time.Duration {
+	if f.cfg.LatencyFactor <= 0 || f.cfg.MinArriveTimeout == 0 || f.cfg.MinArriveTimeout > f.cfg.ArriveTimeout {
+		return f.cfg.ArriveTimeout
+	}
+	return f.cfg.MinArriveTimeout
+}
+
+// routingCost estimates how long it takes to fetch an item from the peer, the lower the better
+func (f *TypedFetcher[K]) routingCost(s PeerStats) float64 {
+	latency := s.Latency
+	if latency == 0 {
+		// unknown peers are assumed to be average
+		latency = f.cfg.ArriveTimeout / 2
+	}
+	// Laplace smoothing, so a single failure doesn't exclude a peer forever
+	ratio := (float64(s.Delivered) + 1) / (float64(s.Delivered+s.TimedOut) + 2)
+	load := 1 + float64(s.Outstanding)/float64(f.cfg.MaxBatch+1)
+	return float64(latency) * load / ratio
+}
+
+// route chooses an announcer to fetch an item from.
+// The previous peer, which didn't deliver the item in time, is skipped unless it's the only announcer.
+func (f *TypedFetcher[K]) route(announces []announceData[K], previous string) announceData[K] {
+	best := -1
+	bestCost := 0.0
+	for i, a := range announces {
+		if a.peer == previous {
+			continue
+		}
+		cost := f.routingCost(f.stats.get(a.peer))
+		if best < 0 || cost < bestCost {
+			best, bestCost = i, cost
+		}
+	}
+	if best < 0 {
+		return announces[len(announces)-1]
+	}
+	return announces[best]
+}
@@ -0,0 +1,16 @@
+package itemsfetcher
+
+// ItemsRequesterFn is a callback type for sending an item retrieval request.
+type ItemsRequesterFn = TypedItemsRequesterFn[interface{}]
+
+// Callback is a set of callbacks of Fetcher.
+type Callback = TypedCallback[interface{}]
+
+// Fetcher is a TypedFetcher of untyped items, kept for backward compatibility.
+// TypedFetcher avoids boxing of the ids and should be preferred by new code.
+type Fetcher = TypedFetcher[interface{}]
+
+// New creates an item fetcher to retrieve items based on hash announcements.
+func New(cfg Config, callback Callback) *Fetcher {
+	return NewTyped[interface{}](cfg, callback)
+}
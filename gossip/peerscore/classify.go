@@ -0,0 +1,109 @@
+package peerscore
+
+import (
+	"errors"
+
+	"github.com/panoptisDev/lachesis-base/eventcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/basiccheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/framecheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/parentscheck"
+	"github.com/panoptisDev/lachesis-base/gossip/basestream/basestreamseeder"
+	"github.com/panoptisDev/lachesis-base/gossip/itemsfetcher"
+)
+
+// Severity of a peer misbehaviour
+type Severity uint8
+
+const (
+	// SeverityNone isn't a ground for any penalty
+	SeverityNone Severity = iota
+	// SeverityMinor may be caused by an honest peer, e.g. by a network delay
+	SeverityMinor
+	// SeverityMajor cannot be caused by an honest peer normally, but isn't a proof of malice
+	SeverityMajor
+	// SeverityFatal is a proof of malice or of a broken node, peer is banned immediately
+	SeverityFatal
+)
+
+// ErrInvalidEvent marks errors of event checkers, see WrapEventCallback.
+// Marked errors which aren't known otherwise are SeverityMajor.
+var ErrInvalidEvent = errors.New("invalid event")
+
+type knownError struct {
+	err      error
+	severity Severity
+}
+
+// severities are checked in order, so an error which wraps a few known errors gets the severity of the first one
+var severities = []knownError{
+	// not grounds for banning
+	{eventcheck.ErrAlreadyConnectedEvent, SeverityNone},
+	{eventcheck.ErrSpilledEvent, SeverityNone},
+	{eventcheck.ErrDuplicateEvent, SeverityNone},
+	// malformed events
+	{basiccheck.ErrNoParents, SeverityFatal},
+	{basiccheck.ErrNotInited, SeverityFatal},
+	{basiccheck.ErrHugeValue, SeverityFatal},
+	{basiccheck.ErrDoubleParents, SeverityFatal},
+	{parentscheck.ErrWrongSeq, SeverityFatal},
+	{parentscheck.ErrWrongLamport, SeverityFatal},
+	{parentscheck.ErrWrongSelfParent, SeverityFatal},
+	{framecheck.ErrFrameTooHigh, SeverityFatal},
+	{framecheck.ErrFrameDecreased, SeverityFatal},
+	{framecheck.ErrWrongFirstFrame, SeverityFatal},
+	// bound is local configuration
+	{framecheck.ErrLamportGap, SeverityMajor},
+	// peer may be slightly behind or ahead around epoch sealing
+	{epochcheck.ErrNotRelevant, SeverityMinor},
+	{epochcheck.ErrNextEpoch, SeverityNone},
+	{epochcheck.ErrAuth, SeverityMajor},
+	// streaming and fetching
+	{basestreamseeder.ErrSelectorMismatch, SeverityMajor},
+	{basestreamseeder.ErrTooManyChunks, SeverityMajor},
+	{itemsfetcher.ErrItemNotArrived, SeverityMinor},
+	// unknown errors of event checkers
+	{ErrInvalidEvent, SeverityMajor},
+}
+
+// Classify returns a severity of known errors of eventcheck, basestreamseeder and itemsfetcher.
+// Wrapped errors are unwrapped. Unknown errors are SeverityNone, as they may be caused by a local fault,
+// unless they are marked with ErrInvalidEvent.
+func Classify(err error) Severity {
+	if err == nil {
+		return SeverityNone
+	}
+	for _, known := range severities {
+		if errors.Is(err, known.err) {
+			return known.severity
+		}
+	}
+	return SeverityNone
+}
+
+// invalidEventError marks an error of event checkers
+type invalidEventError struct {
+	err error
+}
+
+func (e *invalidEventError) Error() string {
+	return e.err.Error()
+}
+
+func (e *invalidEventError) Unwrap() []error {
+	return []error{e.err, ErrInvalidEvent}
+}
+
+func markInvalid(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &invalidEventError{err}
+}
+
+func unmarkInvalid(err error) error {
+	if marked, ok := err.(*invalidEventError); ok {
+		return marked.err
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package peerscore
+
+import (
+	"time"
+)
+
+type Config struct {
+	HalfLife time.Duration // Time after which an accumulated score is halved
+
+	MinorPenalty float64 // Score added for a misbehaviour of SeverityMinor
+	MajorPenalty float64 // Score added for a misbehaviour of SeverityMajor
+
+	DisconnectScore float64 // Score at which peer is disconnected
+	BanScore        float64 // Score at which peer is banned
+}
+
+func DefaultConfig() Config {
+	return Config{
+		HalfLife:        10 * time.Minute,
+		MinorPenalty:    1,
+		MajorPenalty:    20,
+		DisconnectScore: 50,
+		BanScore:        100,
+	}
+}
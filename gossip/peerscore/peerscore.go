@@ -0,0 +1,201 @@
+package peerscore
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/panoptisDev/lachesis-base/gossip/dagprocessor"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+)
+
+/*
+ * Scorer is a peers reputation tracker, which is shared by all the gossip components.
+ * Every misbehaviour adds a penalty to the peer's score according to its severity, and the score decays over time.
+ * Once the score reaches a threshold, a disconnect or ban decision is emitted.
+ */
+
+// Decision is an action to take against a peer
+type Decision uint8
+
+const (
+	DecisionNone Decision = iota
+	DecisionDisconnect
+	DecisionBan
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionDisconnect:
+		return "disconnect"
+	case DecisionBan:
+		return "ban"
+	default:
+		return "none"
+	}
+}
+
+type Callback struct {
+	// Classify returns a severity of a misbehaviour. Optional, Classify is used by default.
+	Classify func(err error) Severity
+	// OnDecision is called when a peer should be disconnected or banned.
+	// It's called under the Scorer's lock, so it must not call the Scorer.
+	OnDecision func(peer string, decision Decision, err error)
+}
+
+type peerScore struct {
+	score   float64
+	updated time.Time
+}
+
+// Scorer accumulates a decaying misbehaviour score per peer
+type Scorer struct {
+	cfg      Config
+	callback Callback
+
+	mu    sync.Mutex
+	peers map[string]*peerScore
+
+	now func() time.Time
+}
+
+// New creates a peers reputation tracker
+func New(cfg Config, callback Callback) *Scorer {
+	if callback.Classify == nil {
+		callback.Classify = Classify
+	}
+	return &Scorer{
+		cfg:      cfg,
+		callback: callback,
+		peers:    make(map[string]*peerScore),
+		now:      time.Now,
+	}
+}
+
+func (s *Scorer) decayed(p *peerScore, now time.Time) float64 {
+	if s.cfg.HalfLife <= 0 {
+		return p.score
+	}
+	elapsed := now.Sub(p.updated)
+	if elapsed <= 0 {
+		return p.score
+	}
+	return p.score * math.Exp2(-float64(elapsed)/float64(s.cfg.HalfLife))
+}
+
+func (s *Scorer) penalty(severity Severity) float64 {
+	switch severity {
+	case SeverityMinor:
+		return s.cfg.MinorPenalty
+	case SeverityMajor:
+		return s.cfg.MajorPenalty
+	case SeverityFatal:
+		// enough to be banned, but the score still decays eventually
+		return s.cfg.BanScore
+	default:
+		return 0
+	}
+}
+
+// Misbehaviour accounts a peer's misbehaviour and returns the resulting decision
+func (s *Scorer) Misbehaviour(peer string, err error) Decision {
+	if peer == "" || err == nil {
+		return DecisionNone
+	}
+	penalty := s.penalty(s.callback.Classify(err))
+	if penalty == 0 {
+		return DecisionNone
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	p, ok := s.peers[peer]
+	if !ok {
+		p = &peerScore{}
+		s.peers[peer] = p
+	}
+	p.score = s.decayed(p, now) + penalty
+	p.updated = now
+
+	decision := DecisionNone
+	if p.score >= s.cfg.BanScore {
+		decision = DecisionBan
+	} else if p.score >= s.cfg.DisconnectScore {
+		decision = DecisionDisconnect
+	}
+	if decision != DecisionNone && s.callback.OnDecision != nil {
+		s.callback.OnDecision(peer, decision, err)
+	}
+	return decision
+}
+
+// Score returns the current score of a peer
+func (s *Scorer) Score(peer string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[peer]
+	if !ok {
+		return 0
+	}
+	return s.decayed(p, s.now())
+}
+
+// Forget drops a peer's score if it has decayed below the minor penalty, to keep memory bounded.
+// It should be called after a peer is disconnected.
+func (s *Scorer) Forget(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.peers[peer]
+	if ok && s.decayed(p, s.now()) < s.cfg.MinorPenalty {
+		delete(s.peers, peer)
+	}
+}
+
+// PeerMisbehaviour returns a callback which is compatible with basestreamseeder.Peer.Misbehaviour
+func (s *Scorer) PeerMisbehaviour(peer string) func(error) {
+	return func(err error) {
+		s.Misbehaviour(peer, err)
+	}
+}
+
+// FetcherMisbehaviour is compatible with itemsfetcher.Callback.Misbehaviour
+func (s *Scorer) FetcherMisbehaviour(peer string, err error) {
+	s.Misbehaviour(peer, err)
+}
+
+// WrapReleased returns a callback which is compatible with dagprocessor.EventCallback.Released,
+// which accounts errors of released events before calling the original callback.
+// Only the errors known by Classify are accounted, as errors of the Process callback may be caused by a local fault.
+// Use WrapEventCallback to account unknown errors of event checkers as well.
+func (s *Scorer) WrapReleased(released func(e dag.Event, peer string, err error)) func(e dag.Event, peer string, err error) {
+	return func(e dag.Event, peer string, err error) {
+		s.Misbehaviour(peer, err)
+		if released != nil {
+			released(e, peer, unmarkInvalid(err))
+		}
+	}
+}
+
+// WrapEventCallback returns the dagprocessor callbacks, which account errors of released events.
+// Errors of CheckParentless and CheckParents are marked with ErrInvalidEvent, so they are accounted even if unknown,
+// whereas unknown errors of Process aren't accounted. The original Released callback receives unmarked errors.
+func (s *Scorer) WrapEventCallback(cb dagprocessor.EventCallback) dagprocessor.EventCallback {
+	if checkParentless := cb.CheckParentless; checkParentless != nil {
+		cb.CheckParentless = func(e dag.Event, checked func(error)) {
+			checkParentless(e, func(err error) {
+				checked(markInvalid(err))
+			})
+		}
+	}
+	if checkParents := cb.CheckParents; checkParents != nil {
+		cb.CheckParents = func(e dag.Event, parents dag.Events) error {
+			return markInvalid(checkParents(e, parents))
+		}
+	}
+	cb.Released = s.WrapReleased(cb.Released)
+	return cb
+}
@@ -0,0 +1,152 @@
+package peerscore
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/eventcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/parentscheck"
+	"github.com/panoptisDev/lachesis-base/gossip/dagprocessor"
+	"github.com/panoptisDev/lachesis-base/gossip/itemsfetcher"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+)
+
+func TestClassify(t *testing.T) {
+	require.Equal(t, SeverityNone, Classify(nil))
+	require.Equal(t, SeverityNone, Classify(eventcheck.ErrSpilledEvent))
+	require.Equal(t, SeverityMinor, Classify(epochcheck.ErrNotRelevant))
+	require.Equal(t, SeverityMinor, Classify(itemsfetcher.ErrItemNotArrived))
+	require.Equal(t, SeverityMajor, Classify(epochcheck.ErrAuth))
+	require.Equal(t, SeverityFatal, Classify(parentscheck.ErrWrongLamport))
+	require.Equal(t, SeverityFatal, Classify(fmt.Errorf("wrapped: %w", parentscheck.ErrWrongSeq)))
+	require.Equal(t, SeverityNone, Classify(errors.New("unknown")))
+	require.Equal(t, SeverityMajor, Classify(markInvalid(errors.New("unknown"))))
+	require.Equal(t, SeverityFatal, Classify(markInvalid(parentscheck.ErrWrongSeq)))
+	// the first known error wins, regardless of the wrapping order
+	for i := 0; i < 100; i++ {
+		require.Equal(t, SeverityNone, Classify(errors.Join(parentscheck.ErrWrongSeq, eventcheck.ErrSpilledEvent)))
+		require.Equal(t, SeverityNone, Classify(errors.Join(eventcheck.ErrSpilledEvent, parentscheck.ErrWrongSeq)))
+	}
+}
+
+func TestScorer(t *testing.T) {
+	now := time.Unix(0, 0)
+	decisions := make(map[string]Decision)
+	s := New(Config{
+		HalfLife:        time.Minute,
+		MinorPenalty:    1,
+		MajorPenalty:    10,
+		DisconnectScore: 20,
+		BanScore:        40,
+	}, Callback{
+		OnDecision: func(peer string, decision Decision, err error) {
+			decisions[peer] = decision
+		},
+	})
+	s.now = func() time.Time {
+		return now
+	}
+
+	// not grounds for banning
+	for i := 0; i < 100; i++ {
+		require.Equal(t, DecisionNone, s.Misbehaviour("a", eventcheck.ErrDuplicateEvent))
+	}
+	require.Zero(t, s.Score("a"))
+
+	// accumulation
+	require.Equal(t, DecisionNone, s.Misbehaviour("a", epochcheck.ErrAuth))
+	require.Equal(t, DecisionDisconnect, s.Misbehaviour("a", epochcheck.ErrAuth))
+	require.Equal(t, DecisionDisconnect, decisions["a"])
+	require.Equal(t, 20.0, s.Score("a"))
+
+	// decay
+	now = now.Add(time.Minute)
+	require.InDelta(t, 10.0, s.Score("a"), 1e-9)
+	require.Equal(t, DecisionNone, s.Misbehaviour("a", epochcheck.ErrNotRelevant))
+	require.InDelta(t, 11.0, s.Score("a"), 1e-9)
+
+	// fatal
+	require.Equal(t, DecisionBan, s.Misbehaviour("b", parentscheck.ErrWrongSelfParent))
+	require.Equal(t, DecisionBan, decisions["b"])
+
+	// forgetting
+	s.Forget("a")
+	require.InDelta(t, 11.0, s.Score("a"), 1e-9)
+	now = now.Add(time.Hour)
+	s.Forget("a")
+	require.Zero(t, s.Score("a"))
+}
+
+func TestScorerAdapters(t *testing.T) {
+	banned := make(map[string]bool)
+	s := New(DefaultConfig(), Callback{
+		OnDecision: func(peer string, decision Decision, err error) {
+			if decision == DecisionBan {
+				banned[peer] = true
+			}
+		},
+	})
+
+	released := 0
+	wrapped := s.WrapReleased(func(e dag.Event, peer string, err error) {
+		released++
+	})
+	wrapped(nil, "a", nil)
+	wrapped(nil, "a", eventcheck.ErrAlreadyConnectedEvent)
+	wrapped(nil, "d", errors.New("local fault"))
+	wrapped(nil, "a", parentscheck.ErrWrongSeq)
+	require.Equal(t, 4, released)
+
+	s.PeerMisbehaviour("b")(parentscheck.ErrWrongSeq)
+	for i := 0; i < 1000; i++ {
+		s.FetcherMisbehaviour("c", itemsfetcher.ErrItemNotArrived)
+	}
+	require.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, banned)
+}
+
+func TestScorerWrapEventCallback(t *testing.T) {
+	s := New(DefaultConfig(), Callback{})
+	now := time.Now()
+	s.now = func() time.Time {
+		return now
+	}
+
+	errSig := errors.New("bad signature")
+	errLocal := errors.New("local fault")
+	var releasedErrs []error
+	cb := s.WrapEventCallback(dagprocessor.EventCallback{
+		Released: func(e dag.Event, peer string, err error) {
+			releasedErrs = append(releasedErrs, err)
+		},
+		CheckParentless: func(e dag.Event, checked func(error)) {
+			checked(errSig)
+		},
+		CheckParents: func(e dag.Event, parents dag.Events) error {
+			return parentscheck.ErrWrongSeq
+		},
+	})
+
+	// unknown error of a checker is accounted
+	cb.CheckParentless(nil, func(err error) {
+		require.True(t, errors.Is(err, errSig))
+		cb.Released(nil, "a", err)
+	})
+	require.InDelta(t, DefaultConfig().MajorPenalty, s.Score("a"), 1e-9)
+
+	err := cb.CheckParents(nil, nil)
+	require.True(t, errors.Is(err, parentscheck.ErrWrongSeq))
+	cb.Released(nil, "b", err)
+	require.InDelta(t, DefaultConfig().BanScore, s.Score("b"), 1e-9)
+
+	// unknown error of Process isn't accounted
+	cb.Released(nil, "c", errLocal)
+	require.Zero(t, s.Score("c"))
+
+	// errors are unmarked for the original callback
+	require.Equal(t, []error{errSig, parentscheck.ErrWrongSeq, errLocal}, releasedErrs)
+}
@@ -0,0 +1,138 @@
+package testnet
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handler is called for every delivered message. Handlers are called concurrently.
+type Handler func(from string, msg interface{})
+
+// BusConfig defines the network conditions of a Bus
+type BusConfig struct {
+	Latency time.Duration // Minimum delivery delay
+	Jitter  time.Duration // Maximum random addition to the delivery delay, messages get reordered if it's non-zero
+	// LossProbability is the probability of a message to be silently dropped, in range [0, 1]
+	LossProbability float64
+	// ReorderProbability is the probability of a message to be delayed by extra Latency+Jitter,
+	// so it's delivered after the messages which were sent later
+	ReorderProbability float64
+	Seed               int64
+}
+
+// BusStats is the statistics of the delivered messages
+type BusStats struct {
+	Sent      uint64
+	Lost      uint64
+	Delivered uint64
+}
+
+// Bus is an in-memory message bus, which connects nodes with lossy links
+type Bus struct {
+	cfg BusConfig
+
+	mu       sync.RWMutex
+	rand     *rand.Rand
+	handlers map[string]Handler
+	closed   bool
+
+	wg sync.WaitGroup
+
+	sent      uint64
+	lost      uint64
+	delivered uint64
+}
+
+// NewBus creates a message bus
+func NewBus(cfg BusConfig) *Bus {
+	return &Bus{
+		cfg:      cfg,
+		rand:     rand.New(rand.NewSource(cfg.Seed)), // nolint:gosec
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Register connects a node to the bus
+func (b *Bus) Register(id string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[id] = handler
+}
+
+// Unregister disconnects a node from the bus, messages in flight to the node are dropped
+func (b *Bus) Unregister(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.handlers, id)
+}
+
+// Peers returns the sorted IDs of the connected nodes, except the specified one
+func (b *Bus) Peers(except string) []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	peers := make([]string, 0, len(b.handlers))
+	for id := range b.handlers {
+		if id != except {
+			peers = append(peers, id)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Send sends a message asynchronously. It returns false if the message was lost.
+func (b *Bus) Send(from, to string, msg interface{}) bool {
+	atomic.AddUint64(&b.sent, 1)
+
+	b.mu.Lock()
+	if b.closed || b.handlers[to] == nil || b.rand.Float64() < b.cfg.LossProbability {
+		b.mu.Unlock()
+		atomic.AddUint64(&b.lost, 1)
+		return false
+	}
+	delay := b.cfg.Latency
+	if b.cfg.Jitter > 0 {
+		delay += time.Duration(b.rand.Int63n(int64(b.cfg.Jitter)))
+	}
+	if b.rand.Float64() < b.cfg.ReorderProbability {
+		delay += b.cfg.Latency + b.cfg.Jitter
+	}
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		defer b.wg.Done()
+		b.mu.RLock()
+		handler := b.handlers[to]
+		closed := b.closed
+		b.mu.RUnlock()
+		if closed || handler == nil {
+			atomic.AddUint64(&b.lost, 1)
+			return
+		}
+		handler(from, msg)
+		atomic.AddUint64(&b.delivered, 1)
+	})
+	return true
+}
+
+// Stats returns the statistics of the messages
+func (b *Bus) Stats() BusStats {
+	return BusStats{
+		Sent:      atomic.LoadUint64(&b.sent),
+		Lost:      atomic.LoadUint64(&b.lost),
+		Delivered: atomic.LoadUint64(&b.delivered),
+	}
+}
+
+// Close stops delivering of messages, and waits until the handlers of the delivered messages have finished.
+// Nodes should be stopped before, so the handlers aren't blocked.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.wg.Wait()
+}
@@ -0,0 +1,70 @@
+package testnet
+
+import (
+	"time"
+
+	"github.com/panoptisDev/lachesis-base/gossip/basestream/basestreamleecher/basemultileecher"
+	"github.com/panoptisDev/lachesis-base/gossip/basestream/basestreamseeder"
+	"github.com/panoptisDev/lachesis-base/gossip/dagprocessor"
+	"github.com/panoptisDev/lachesis-base/gossip/itemsfetcher"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/utils/cachescale"
+)
+
+type NodeConfig struct {
+	Processor dagprocessor.Config
+	// EventsSemaphore limits events which are being processed
+	EventsSemaphore dag.Metric
+	Fetcher         itemsfetcher.Config
+	Seeder          basestreamseeder.Config
+	Leecher         basemultileecher.Config
+
+	// RecheckInterval is the interval of re-announcing recent events and requesting missing ancestors of buffered events.
+	// Lost messages are recovered by these routines.
+	RecheckInterval time.Duration
+	// ReannounceNum is the number of the most recent events which are re-announced
+	ReannounceNum int
+	// MissingRequestNum is the maximum number of missing ancestors which are requested at once
+	MissingRequestNum int
+	// EpochBlocks is the number of blocks after which the epoch is sealed. Zero disables sealing
+	EpochBlocks int
+}
+
+// LiteNodeConfig returns a config for tests, with short timeouts
+func LiteNodeConfig() NodeConfig {
+	processor := dagprocessor.DefaultConfig(cachescale.Identity)
+	// don't spill events which arrived far ahead of their ancestors, they're recovered by RecheckInterval
+	processor.EventsBufferLimit = dag.Metric{Num: 100000, Size: 100 * 1024 * 1024}
+
+	fetcher := itemsfetcher.DefaultConfig(cachescale.Identity)
+	fetcher.ForgetTimeout = 10 * time.Second
+	fetcher.ArriveTimeout = 200 * time.Millisecond
+	fetcher.GatherSlack = 10 * time.Millisecond
+	fetcher.MinArriveTimeout = 50 * time.Millisecond
+	fetcher.MaxArriveTimeout = 500 * time.Millisecond
+
+	leecher := basemultileecher.DefaultConfig()
+	leecher.RecheckInterval = 20 * time.Millisecond
+	leecher.StallTimeout = 200 * time.Millisecond
+	leecher.DefaultChunkItemsNum = 50
+	leecher.DefaultChunkItemsSize = 64 * 1024
+
+	return NodeConfig{
+		Processor:       processor,
+		EventsSemaphore: dag.Metric{Num: 100000, Size: 100 * 1024 * 1024},
+		Fetcher:         fetcher,
+		Seeder: basestreamseeder.Config{
+			SenderThreads:           2,
+			MaxSenderTasks:          128,
+			MaxPendingResponsesSize: 16 * 1024 * 1024,
+			MaxResponsePayloadNum:   1000,
+			MaxResponsePayloadSize:  1024 * 1024,
+			MaxResponseChunks:       16,
+			SessionIdleTimeout:      10 * time.Second,
+		},
+		Leecher:           leecher,
+		RecheckInterval:   100 * time.Millisecond,
+		ReannounceNum:     32,
+		MissingRequestNum: 256,
+	}
+}
@@ -0,0 +1,416 @@
+package testnet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/panoptisDev/lachesis-base/abft"
+	"github.com/panoptisDev/lachesis-base/eventcheck"
+	"github.com/panoptisDev/lachesis-base/eventcheck/epochcheck"
+	"github.com/panoptisDev/lachesis-base/gossip/basestream"
+	"github.com/panoptisDev/lachesis-base/gossip/basestream/basestreamleecher/basemultileecher"
+	"github.com/panoptisDev/lachesis-base/gossip/basestream/basestreamseeder"
+	"github.com/panoptisDev/lachesis-base/gossip/dagprocessor"
+	"github.com/panoptisDev/lachesis-base/gossip/itemsfetcher"
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+	"github.com/panoptisDev/lachesis-base/inter/pos"
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+	"github.com/panoptisDev/lachesis-base/lachesis"
+	"github.com/panoptisDev/lachesis-base/utils/adapters"
+	"github.com/panoptisDev/lachesis-base/utils/datasemaphore"
+	"github.com/panoptisDev/lachesis-base/vecfc"
+)
+
+/*
+ * Node wires the gossip components with IndexedLachesis over a Bus:
+ * - processed events are announced to all the peers, announced events are fetched by itemsfetcher;
+ * - events are streamed in order of their IDs by basestreamseeder and downloaded by basemultileecher;
+ * - received events are ordered and processed by dagprocessor.
+ * Lost messages are recovered by periodic re-announcing of recent events and requesting of missing ancestors.
+ */
+
+type (
+	announceMsg struct {
+		ids hash.Events
+	}
+	eventsRequestMsg struct {
+		ids hash.Events
+	}
+	eventsMsg struct {
+		events dag.Events
+	}
+	streamRequestMsg struct {
+		request basestream.Request
+	}
+	streamResponseMsg struct {
+		response basestream.Response
+	}
+)
+
+// peerPayload is a received chunk of the events stream, marked with its sender
+type peerPayload struct {
+	*basestream.EventsPayload
+	peer string
+}
+
+// Node is a gossip node, which runs IndexedLachesis
+type Node struct {
+	ID  string
+	cfg NodeConfig
+	bus *Bus
+
+	store       *eventsStore
+	consensusMu sync.Mutex
+	consensus   *abft.IndexedLachesis
+
+	mu      sync.RWMutex
+	atropoi hash.Events
+	epoch   idx.Epoch
+	recent  hash.Events // ring of recently processed events
+	recentI int
+	synced  chan struct{}
+
+	processor *dagprocessor.Processor
+	fetcher   *itemsfetcher.TypedFetcher[hash.Event]
+	seeder    *basestreamseeder.BaseSeeder
+	leecher   *basemultileecher.Leecher
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewConsensus creates IndexedLachesis with in-memory databases, which calls onAtropos for every decided block.
+// The epoch is sealed after the block if onAtropos returns true, the validators are kept.
+func NewConsensus(validators *pos.Validators, input abft.EventSource, onAtropos func(hash.Event) (sealEpoch bool)) *abft.IndexedLachesis {
+	crit := func(err error) {
+		panic(err)
+	}
+	openEDB := func(epoch idx.Epoch) kvdb.Store {
+		return memorydb.New()
+	}
+	store := abft.NewStore(memorydb.New(), openEDB, crit, abft.LiteStoreConfig())
+	err := store.ApplyGenesis(&abft.Genesis{
+		Validators: validators,
+		Epoch:      abft.FirstEpoch,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	dagIndexer := &adapters.VectorToDagIndexer{Index: vecfc.NewIndex(crit, vecfc.LiteConfig())}
+	lch := abft.NewIndexedLachesis(store, input, dagIndexer, crit, abft.LiteConfig())
+	err = lch.Bootstrap(lachesis.ConsensusCallbacks{
+		BeginBlock: func(block *lachesis.Block) lachesis.BlockCallbacks {
+			sealEpoch := onAtropos(block.Atropos)
+			return lachesis.BlockCallbacks{
+				EndBlock: func() *pos.Validators {
+					if sealEpoch {
+						return validators
+					}
+					return nil
+				},
+			}
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return lch
+}
+
+// NewNode creates a node and connects it to the bus
+func NewNode(id string, bus *Bus, validators *pos.Validators, cfg NodeConfig) *Node {
+	n := &Node{
+		ID:     id,
+		cfg:    cfg,
+		bus:    bus,
+		store:  newEventsStore(),
+		recent: make(hash.Events, 0, cfg.ReannounceNum),
+		epoch:  abft.FirstEpoch,
+		quit:   make(chan struct{}),
+	}
+	n.consensus = NewConsensus(validators, n.store, func(atropos hash.Event) bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.atropoi = append(n.atropoi, atropos)
+		if cfg.EpochBlocks != 0 && len(n.atropoi)%cfg.EpochBlocks == 0 {
+			n.epoch++
+			return true
+		}
+		return false
+	})
+
+	semaphore := datasemaphore.New(cfg.EventsSemaphore, func(received dag.Metric, processing dag.Metric, releasing dag.Metric) {
+		panic("events semaphore inconsistency")
+	})
+	n.processor = dagprocessor.New(semaphore, cfg.Processor, dagprocessor.Callback{
+		Event: dagprocessor.EventCallback{
+			Process: n.processEvent,
+			Get:     n.store.GetEvent,
+			Exists:  n.store.HasEvent,
+			CheckParents: func(e dag.Event, parents dag.Events) error {
+				return nil
+			},
+			CheckParentless: func(e dag.Event, checked func(error)) {
+				checked(n.checkEpoch(e))
+			},
+		},
+		HighestLamport: n.store.HighestLamport,
+		CurrentEpoch:   n.Epoch,
+	})
+
+	n.fetcher = itemsfetcher.NewTyped[hash.Event](cfg.Fetcher, itemsfetcher.TypedCallback[hash.Event]{
+		OnlyInterested: func(ids []hash.Event) []hash.Event {
+			interested := make([]hash.Event, 0, len(ids))
+			for _, id := range ids {
+				if !n.store.HasEvent(id) && !n.processor.IsBuffered(id) {
+					interested = append(interested, id)
+				}
+			}
+			return interested
+		},
+		Suspend: n.processor.Overloaded,
+	})
+
+	n.seeder = basestreamseeder.New(cfg.Seeder, basestreamseeder.Callbacks{
+		ForEachItem: func(start basestream.Locator, _ basestream.RequestType, onKey func(basestream.Locator) bool, onAppended func(basestream.Payload) bool) basestream.Payload {
+			res := &basestream.EventsPayload{}
+			n.store.ForEach(start.(basestream.EventLocator).ID(), func(e dag.Event) bool {
+				if !onKey(basestream.EventLocator(e.ID())) {
+					return false
+				}
+				res.AddEvent(e)
+				return onAppended(res)
+			})
+			return res
+		},
+	})
+
+	n.leecher = basemultileecher.New(cfg.Leecher, basemultileecher.Callbacks{
+		Split: basestream.SplitByLamport,
+		LastLocator: func(payload basestream.Payload) basestream.Locator {
+			return basestream.LastEventLocator(payload.(*peerPayload).EventsPayload)
+		},
+		RequestChunks: func(peer string, r basestream.Request) error {
+			n.bus.Send(n.ID, peer, &streamRequestMsg{r})
+			return nil
+		},
+		Deliver: func(payload basestream.Payload) {
+			p := payload.(*peerPayload)
+			_ = n.processor.Enqueue(p.peer, p.Events, true, n.requestMissing(p.peer), nil)
+		},
+		Done: func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.synced != nil {
+				close(n.synced)
+				n.synced = nil
+			}
+		},
+	})
+
+	bus.Register(id, n.handle)
+	return n
+}
+
+// Start boots up the node
+func (n *Node) Start() {
+	n.processor.Start()
+	n.fetcher.Start()
+	n.seeder.Start()
+	n.leecher.Start()
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		n.loop()
+	}()
+}
+
+// Stop disconnects the node from the bus and stops all the components
+func (n *Node) Stop() {
+	n.bus.Unregister(n.ID)
+	close(n.quit)
+	n.wg.Wait()
+	n.leecher.Stop()
+	n.seeder.Stop()
+	n.fetcher.Stop()
+	n.processor.Stop()
+}
+
+// Emit submits an own event of the node
+func (n *Node) Emit(e dag.Event) error {
+	return n.processor.Enqueue(n.ID, dag.Events{e}, true, nil, nil)
+}
+
+// StreamSync downloads all the events of the epoch up to the specified Lamport time (inclusive) from all the peers.
+// The returned channel is closed once the download is finished.
+func (n *Node) StreamSync(epoch idx.Epoch, lamport idx.Lamport) (<-chan struct{}, error) {
+	synced := make(chan struct{})
+	n.mu.Lock()
+	n.synced = synced
+	n.mu.Unlock()
+
+	for _, peer := range n.bus.Peers(n.ID) {
+		n.leecher.RegisterPeer(peer)
+	}
+	err := n.leecher.Download(basestream.LamportLocator(epoch, 0), basestream.LamportLocator(epoch, lamport+1), 0)
+	return synced, err
+}
+
+// Atropoi returns the decided atropoi
+func (n *Node) Atropoi() hash.Events {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.atropoi.Copy()
+}
+
+// Epoch returns the current epoch
+func (n *Node) Epoch() idx.Epoch {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.epoch
+}
+
+// checkEpoch tolerates events of the next epoch, which are buffered by the processor until the epoch is sealed
+func (n *Node) checkEpoch(e dag.Event) error {
+	epoch := n.Epoch()
+	if e.Epoch() == epoch+1 {
+		return epochcheck.ErrNextEpoch
+	}
+	if e.Epoch() != epoch {
+		return epochcheck.ErrNotRelevant
+	}
+	return nil
+}
+
+// HasEvent returns true if the event is processed
+func (n *Node) HasEvent(id hash.Event) bool {
+	return n.store.HasEvent(id)
+}
+
+// EventsNum returns the number of processed events
+func (n *Node) EventsNum() int {
+	return n.store.Len()
+}
+
+func (n *Node) processEvent(e dag.Event) error {
+	n.consensusMu.Lock()
+	defer n.consensusMu.Unlock()
+	if n.store.HasEvent(e.ID()) {
+		return eventcheck.ErrAlreadyConnectedEvent
+	}
+	// the epoch may be sealed after the event was checked
+	if e.Epoch() != n.Epoch() {
+		return epochcheck.ErrNotRelevant
+	}
+	// consensus may read the event from the store
+	n.store.SetEvent(e)
+	err := n.consensus.Process(e)
+	if err != nil {
+		n.store.DelEvent(e.ID())
+		return err
+	}
+
+	n.mu.Lock()
+	if len(n.recent) < n.cfg.ReannounceNum {
+		n.recent = append(n.recent, e.ID())
+	} else if len(n.recent) != 0 {
+		n.recent[n.recentI] = e.ID()
+		n.recentI = (n.recentI + 1) % len(n.recent)
+	}
+	n.mu.Unlock()
+
+	_ = n.fetcher.NotifyReceived([]hash.Event{e.ID()})
+	n.broadcast(&announceMsg{hash.Events{e.ID()}})
+	return nil
+}
+
+func (n *Node) broadcast(msg interface{}) {
+	for _, peer := range n.bus.Peers(n.ID) {
+		n.bus.Send(n.ID, peer, msg)
+	}
+}
+
+// requester returns a callback which requests events from the peer
+func (n *Node) requester(peer string) itemsfetcher.TypedItemsRequesterFn[hash.Event] {
+	return func(ids []hash.Event) error {
+		n.bus.Send(n.ID, peer, &eventsRequestMsg{ids})
+		return nil
+	}
+}
+
+// requestMissing returns a callback which fetches missing parents of events from the peer which sent the events.
+// Missing parents block the buffered events, so they are fetched ahead of announced events.
+func (n *Node) requestMissing(peer string) func(hash.Events) {
+	if peer == n.ID {
+		return nil
+	}
+	return func(ids hash.Events) {
+		_ = n.fetcher.NotifyPrioritized(peer, ids, time.Now(), n.requester(peer))
+	}
+}
+
+func (n *Node) handle(from string, msg interface{}) {
+	switch msg := msg.(type) {
+	case *announceMsg:
+		_ = n.fetcher.NotifyAnnounces(from, msg.ids, time.Now(), n.requester(from))
+	case *eventsRequestMsg:
+		events := make(dag.Events, 0, len(msg.ids))
+		for _, id := range msg.ids {
+			if e := n.store.GetEvent(id); e != nil {
+				events = append(events, e)
+			}
+		}
+		if len(events) != 0 {
+			n.bus.Send(n.ID, from, &eventsMsg{events})
+		}
+	case *eventsMsg:
+		_ = n.fetcher.NotifyReceived(msg.events.IDs())
+		_ = n.processor.Enqueue(from, msg.events, false, n.requestMissing(from), nil)
+	case *streamRequestMsg:
+		_, _ = n.seeder.NotifyRequestReceived(basestreamseeder.Peer{
+			ID: from,
+			SendChunk: func(resp basestream.Response) error {
+				n.bus.Send(n.ID, from, &streamResponseMsg{resp})
+				return nil
+			},
+			Misbehaviour: func(err error) {},
+		}, msg.request)
+	case *streamResponseMsg:
+		resp := msg.response
+		if resp.Payload != nil {
+			// mark the sender of the chunk, so missing parents are requested from it
+			resp.Payload = &peerPayload{
+				EventsPayload: resp.Payload.(*basestream.EventsPayload),
+				peer:          from,
+			}
+		}
+		_ = n.leecher.NotifyChunkReceived(from, resp)
+	}
+}
+
+func (n *Node) loop() {
+	ticker := time.NewTicker(n.cfg.RecheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+			n.mu.RLock()
+			recent := n.recent.Copy()
+			n.mu.RUnlock()
+			if len(recent) != 0 {
+				n.broadcast(&announceMsg{recent})
+			}
+			n.processor.RequestMissing(n.cfg.MissingRequestNum, func(peer string, ids hash.Events) {
+				if fn := n.requestMissing(peer); fn != nil {
+					fn(ids)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package testnet
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/panoptisDev/lachesis-base/abft"
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+var _ abft.EventSource = (*eventsStore)(nil)
+
+// eventsStore is a thread-safe in-memory events storage, which keeps the events sorted by ID
+type eventsStore struct {
+	mu      sync.RWMutex
+	events  map[hash.Event]dag.Event
+	sorted  hash.Events
+	lamport idx.Lamport
+}
+
+func newEventsStore() *eventsStore {
+	return &eventsStore{
+		events: make(map[hash.Event]dag.Event),
+	}
+}
+
+func (s *eventsStore) SetEvent(e dag.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.events[e.ID()]; ok {
+		return
+	}
+	s.events[e.ID()] = e
+	i := s.search(e.ID())
+	s.sorted = append(s.sorted, hash.Event{})
+	copy(s.sorted[i+1:], s.sorted[i:])
+	s.sorted[i] = e.ID()
+	if s.lamport < e.Lamport() {
+		s.lamport = e.Lamport()
+	}
+}
+
+func (s *eventsStore) DelEvent(id hash.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.events[id]; !ok {
+		return
+	}
+	delete(s.events, id)
+	i := s.search(id)
+	s.sorted = append(s.sorted[:i], s.sorted[i+1:]...)
+}
+
+func (s *eventsStore) GetEvent(id hash.Event) dag.Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.events[id]
+}
+
+func (s *eventsStore) HasEvent(id hash.Event) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.events[id]
+	return ok
+}
+
+func (s *eventsStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.events)
+}
+
+func (s *eventsStore) HighestLamport() idx.Lamport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lamport
+}
+
+// search returns the position of the first ID which isn't less than the specified one
+func (s *eventsStore) search(id hash.Event) int {
+	return sort.Search(len(s.sorted), func(i int) bool {
+		return bytes.Compare(s.sorted[i].Bytes(), id.Bytes()) >= 0
+	})
+}
+
+// ForEach iterates over the events in order of IDs, starting from the specified ID (inclusive)
+func (s *eventsStore) ForEach(start hash.Event, fn func(e dag.Event) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := s.search(start); i < len(s.sorted); i++ {
+		if !fn(s.events[s.sorted[i]]) {
+			return
+		}
+	}
+}
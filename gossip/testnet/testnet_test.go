@@ -0,0 +1,251 @@
+package testnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/abft"
+	"github.com/panoptisDev/lachesis-base/hash"
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/dag/tdag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+	"github.com/panoptisDev/lachesis-base/inter/pos"
+)
+
+type testDAG struct {
+	validators *pos.Validators
+	ordered    dag.Events
+	atropoi    hash.Events
+	epoch      idx.Epoch
+}
+
+// genDAG generates events of the validators, which are processed by a reference consensus
+func genDAG(t *testing.T, validatorsNum, eventsPerValidator int, seed int64) testDAG {
+	return genEpochsDAG(t, validatorsNum, eventsPerValidator, 1, 0, seed)
+}
+
+// genEpochsDAG generates events of a few epochs. The epoch is sealed after every epochBlocks blocks,
+// and the rest of events of the sealed epoch are dropped.
+func genEpochsDAG(t *testing.T, validatorsNum, eventsPerValidator, epochs, epochBlocks int, seed int64) testDAG {
+	nodes := tdag.GenNodes(validatorsNum)
+	res := testDAG{
+		validators: pos.EqualWeightValidators(nodes, 1),
+	}
+	store := newEventsStore()
+	epoch := abft.FirstEpoch
+	generator := NewConsensus(res.validators, store, func(atropos hash.Event) bool {
+		res.atropoi = append(res.atropoi, atropos)
+		if epochBlocks != 0 && len(res.atropoi)%epochBlocks == 0 {
+			epoch++
+			return true
+		}
+		return false
+	})
+	r := rand.New(rand.NewSource(seed)) // nolint:gosec
+	for i := 0; i < epochs; i++ {
+		genEpoch := abft.FirstEpoch + idx.Epoch(i)
+		require.Equal(t, genEpoch, epoch, "epoch isn't sealed")
+		tdag.ForEachRandEvent(nodes, eventsPerValidator, 3, r, tdag.ForEachEvent{
+			Process: func(e dag.Event, name string) {
+				store.SetEvent(e)
+				require.NoError(t, generator.Process(e))
+				res.ordered = append(res.ordered, e)
+			},
+			Build: func(e dag.MutableEvent, name string) error {
+				if epoch != genEpoch {
+					return errors.New("epoch is sealed")
+				}
+				e.SetEpoch(genEpoch)
+				return generator.Build(e)
+			},
+		})
+	}
+	require.NotEmpty(t, res.atropoi)
+	res.epoch = epoch
+	return res
+}
+
+func startNodes(bus *Bus, num int, validators *pos.Validators, cfg NodeConfig) []*Node {
+	nodes := make([]*Node, num)
+	for i := range nodes {
+		nodes[i] = NewNode(fmt.Sprintf("node%d", i), bus, validators, cfg)
+		nodes[i].Start()
+	}
+	return nodes
+}
+
+func stopNodes(bus *Bus, nodes []*Node) {
+	for _, n := range nodes {
+		n.Stop()
+	}
+	bus.Close()
+}
+
+func requireSynced(t *testing.T, nodes []*Node, d testDAG) {
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.EventsNum() != len(d.ordered) || len(n.Atropoi()) != len(d.atropoi) {
+				return false
+			}
+		}
+		return true
+	}, 30*time.Second, 10*time.Millisecond)
+	for _, n := range nodes {
+		require.Equal(t, d.atropoi, n.Atropoi(), n.ID)
+	}
+}
+
+func TestAnnounceFetchSync(t *testing.T) {
+	for _, busCfg := range []BusConfig{
+		{Latency: time.Millisecond},
+		{Latency: time.Millisecond, Jitter: 5 * time.Millisecond, LossProbability: 0.05, ReorderProbability: 0.1, Seed: 1},
+	} {
+		t.Run(fmt.Sprintf("loss=%v", busCfg.LossProbability), func(t *testing.T) {
+			testAnnounceFetchSync(t, busCfg)
+		})
+	}
+}
+
+func testAnnounceFetchSync(t *testing.T, busCfg BusConfig) {
+	const validatorsNum = 5
+	d := genDAG(t, validatorsNum, 40, busCfg.Seed)
+	bus := NewBus(busCfg)
+	nodes := startNodes(bus, validatorsNum, d.validators, LiteNodeConfig())
+	defer stopNodes(bus, nodes)
+
+	// every node emits its own events once it knows their parents
+	byCreator := make(map[int]dag.Events)
+	vIdx := d.validators.Idxs()
+	for _, e := range d.ordered {
+		i := int(vIdx[e.Creator()])
+		byCreator[i] = append(byCreator[i], e)
+	}
+	errs := make(chan error, validatorsNum)
+	for i, node := range nodes {
+		go func(node *Node, events dag.Events) {
+			for _, e := range events {
+				deadline := time.Now().Add(30 * time.Second)
+				for _, p := range e.Parents() {
+					for !node.HasEvent(p) {
+						if time.Now().After(deadline) {
+							errs <- fmt.Errorf("%s didn't receive parent %s", node.ID, p.String())
+							return
+						}
+						time.Sleep(time.Millisecond)
+					}
+				}
+				if err := node.Emit(e); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(node, byCreator[i])
+	}
+	for range nodes {
+		require.NoError(t, <-errs)
+	}
+
+	requireSynced(t, nodes, d)
+	if busCfg.LossProbability != 0 {
+		require.NotZero(t, bus.Stats().Lost)
+	}
+}
+
+func TestStreamSync(t *testing.T) {
+	for _, busCfg := range []BusConfig{
+		{Latency: time.Millisecond},
+		{Latency: time.Millisecond, Jitter: 5 * time.Millisecond, LossProbability: 0.05, ReorderProbability: 0.1, Seed: 2},
+	} {
+		t.Run(fmt.Sprintf("loss=%v", busCfg.LossProbability), func(t *testing.T) {
+			testStreamSync(t, busCfg)
+		})
+	}
+}
+
+func testStreamSync(t *testing.T, busCfg BusConfig) {
+	const validatorsNum = 4
+	d := genDAG(t, validatorsNum, 50, busCfg.Seed)
+	bus := NewBus(busCfg)
+	cfg := LiteNodeConfig()
+	seeders := startNodes(bus, validatorsNum, d.validators, cfg)
+	defer stopNodes(bus, seeders)
+
+	// seeders know the whole DAG
+	for _, node := range seeders {
+		for _, e := range d.ordered {
+			require.NoError(t, node.Emit(e))
+		}
+	}
+	requireSynced(t, seeders, d)
+
+	// a new node downloads the events from all the seeders
+	leecher := NewNode("leecher", bus, d.validators, cfg)
+	leecher.Start()
+	defer leecher.Stop()
+	synced, err := leecher.StreamSync(abft.FirstEpoch, seeders[0].store.HighestLamport())
+	require.NoError(t, err)
+	select {
+	case <-synced:
+	case <-time.After(30 * time.Second):
+		t.Fatal("stream sync isn't finished")
+	}
+	requireSynced(t, []*Node{leecher}, d)
+}
+
+func TestNextEpochSync(t *testing.T) {
+	for _, busCfg := range []BusConfig{
+		{Latency: time.Millisecond},
+		{Latency: time.Millisecond, Jitter: 5 * time.Millisecond, LossProbability: 0.05, ReorderProbability: 0.1, Seed: 3},
+	} {
+		t.Run(fmt.Sprintf("loss=%v", busCfg.LossProbability), func(t *testing.T) {
+			testNextEpochSync(t, busCfg)
+		})
+	}
+}
+
+func testNextEpochSync(t *testing.T, busCfg BusConfig) {
+	const (
+		validatorsNum = 5
+		epochBlocks   = 2
+	)
+	d := genEpochsDAG(t, validatorsNum, 40, 2, epochBlocks, busCfg.Seed)
+	bus := NewBus(busCfg)
+	cfg := LiteNodeConfig()
+	cfg.EpochBlocks = epochBlocks
+	nodes := startNodes(bus, validatorsNum, d.validators, cfg)
+	defer stopNodes(bus, nodes)
+
+	// the first node receives the next epoch events before the epoch is sealed,
+	// and other nodes receive them while they are still in the first epoch
+	var epoch1, epoch2 dag.Events
+	for _, e := range d.ordered {
+		if e.Epoch() == abft.FirstEpoch {
+			epoch1 = append(epoch1, e)
+		} else {
+			epoch2 = append(epoch2, e)
+		}
+	}
+	require.NotEmpty(t, epoch2)
+	for _, e := range append(epoch2, epoch1...) {
+		require.NoError(t, nodes[0].Emit(e))
+	}
+
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.Epoch() != d.epoch || len(n.Atropoi()) != len(d.atropoi) || n.processor.TotalNextEpochBuffered().Num != 0 {
+				return false
+			}
+		}
+		// the first node received all the events in order
+		return nodes[0].EventsNum() == len(d.ordered)
+	}, 30*time.Second, 10*time.Millisecond)
+	for _, n := range nodes {
+		require.Equal(t, d.atropoi, n.Atropoi(), n.ID)
+	}
+}
@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+/*
+ * Archive is a portable gzip-compressed stream of DBs.
+ *
+ * header: magic, version, flush ID
+ * for every DB, sorted by name:
+ *   dbTag, name
+ *   pairTag, key, value - for every pair, in order of keys
+ *   dbEndTag, pairs num, checksum of the DB pairs
+ * endTag, DBs num
+ *
+ * Numbers are uvarints, byte strings are prefixed with their uvarint length.
+ * The checksum is CRC32 (Castagnoli) of the length-prefixed keys and values of the DB.
+ */
+
+const (
+	magic   = "KVDBARCH"
+	version = 1
+)
+
+const (
+	endTag byte = iota
+	dbTag
+	pairTag
+	dbEndTag
+)
+
+// maxFieldSize limits size of a key, a value or a name, so a corrupted length doesn't lead to a huge allocation
+const maxFieldSize = 1 << 30
+
+var (
+	ErrNotArchive      = errors.New("not a DB archive")
+	ErrVersion         = errors.New("unsupported DB archive version")
+	ErrCorrupted       = errors.New("corrupted DB archive")
+	ErrChecksum        = errors.New("DB archive checksum mismatch")
+	ErrDBExists        = errors.New("DB already exists")
+	ErrFlushIDMismatch = errors.New("imported DBs flush ID mismatch")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
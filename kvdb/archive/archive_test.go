@@ -0,0 +1,142 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/flushable"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+)
+
+var flushIDKey = []byte("flushID")
+
+// noCloseStore keeps memory DB alive after Close, so it may be re-opened
+type noCloseStore struct {
+	kvdb.Store
+}
+
+func (s noCloseStore) Close() error {
+	return nil
+}
+
+// Drop closes the DB, which isn't closed by Close
+func (s noCloseStore) Drop() {
+	_ = s.Store.Close()
+	s.Store.Drop()
+}
+
+func newProducer() kvdb.IterableDBProducer {
+	return memorydb.NewProducer("", func(store kvdb.Store) kvdb.Store {
+		return noCloseStore{store}
+	})
+}
+
+// fillProducer writes the DBs through a SyncedPool, so they get the flush ID
+func fillProducer(t *testing.T, producer kvdb.IterableDBProducer, dbsNum, pairsNum int) {
+	pool := flushable.NewSyncedPool(producer, flushIDKey)
+	for i := 0; i < dbsNum; i++ {
+		db, err := pool.OpenDB(fmt.Sprintf("db%d", i))
+		require.NoError(t, err)
+		for j := 0; j < pairsNum; j++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", j)), bytes.Repeat([]byte{byte(i)}, j)))
+		}
+		require.NoError(t, db.Delete([]byte("key1")))
+	}
+	require.NoError(t, pool.Flush([]byte{1, 2, 3}))
+}
+
+func dumpProducer(t *testing.T, producer kvdb.IterableDBProducer) map[string]map[string]string {
+	res := make(map[string]map[string]string)
+	names := producer.Names()
+	sort.Strings(names)
+	for _, name := range names {
+		db, err := producer.OpenDB(name)
+		require.NoError(t, err)
+		pairs := make(map[string]string)
+		it := db.NewIterator(nil, nil)
+		for it.Next() {
+			pairs[string(it.Key())] = string(it.Value())
+		}
+		require.NoError(t, it.Error())
+		it.Release()
+		res[name] = pairs
+	}
+	return res
+}
+
+func TestExportImport(t *testing.T) {
+	require := require.New(t)
+
+	src := newProducer()
+	fillProducer(t, src, 3, 1000)
+
+	var archive bytes.Buffer
+	require.NoError(Export(src, &archive, flushIDKey))
+
+	dst := newProducer()
+	flushID, err := Import(bytes.NewReader(archive.Bytes()), dst, flushIDKey)
+	require.NoError(err)
+	require.Equal([]byte{flushable.CleanPrefix, 1, 2, 3}, flushID)
+	require.Equal(dumpProducer(t, src), dumpProducer(t, dst))
+
+	// DBs can't be overwritten
+	_, err = Import(bytes.NewReader(archive.Bytes()), dst, flushIDKey)
+	require.ErrorIs(err, ErrDBExists)
+
+	// without flush IDs
+	archive.Reset()
+	require.NoError(Export(src, &archive, nil))
+	dst = newProducer()
+	flushID, err = Import(bytes.NewReader(archive.Bytes()), dst, nil)
+	require.NoError(err)
+	require.Empty(flushID)
+	require.Equal(dumpProducer(t, src), dumpProducer(t, dst))
+}
+
+func TestExportDirty(t *testing.T) {
+	src := newProducer()
+	fillProducer(t, src, 2, 10)
+	db, err := src.OpenDB("db1")
+	require.NoError(t, err)
+	require.NoError(t, flushable.MarkFlushID(db, flushIDKey, flushable.DirtyPrefix, []byte{4}))
+
+	require.Error(t, Export(src, io.Discard, flushIDKey))
+}
+
+func TestImportCorrupted(t *testing.T) {
+	require := require.New(t)
+
+	src := newProducer()
+	fillProducer(t, src, 2, 100)
+	var archive bytes.Buffer
+	require.NoError(Export(src, &archive, flushIDKey))
+	valid := archive.Bytes()
+
+	_, err := Import(bytes.NewReader([]byte("not an archive")), newProducer(), flushIDKey)
+	require.ErrorIs(err, ErrNotArchive)
+
+	for _, size := range []int{len(valid) / 4, len(valid) / 2, len(valid) - 1} {
+		dst := newProducer()
+		_, err = Import(bytes.NewReader(valid[:size]), dst, flushIDKey)
+		require.Error(err, size)
+		// failed import leaves no DBs, so it may be retried
+		require.Empty(dst.Names(), size)
+		_, err = Import(bytes.NewReader(valid), dst, flushIDKey)
+		require.NoError(err, size)
+	}
+
+	for _, pos := range []int{len(valid) / 3, len(valid) / 2, len(valid) - 5} {
+		corrupted := append([]byte{}, valid...)
+		corrupted[pos] ^= 0xff
+		dst := newProducer()
+		_, err = Import(bytes.NewReader(corrupted), dst, flushIDKey)
+		require.Error(err, pos)
+		require.Empty(dst.Names(), pos)
+	}
+}
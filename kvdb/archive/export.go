@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/flushable"
+)
+
+type writer struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *writer) byte(b byte) {
+	if w.err == nil {
+		w.err = w.w.WriteByte(b)
+	}
+}
+
+func (w *writer) uvarint(v uint64, h hash.Hash32) {
+	if w.err != nil {
+		return
+	}
+	n := binary.PutUvarint(w.buf[:], v)
+	if h != nil {
+		_, _ = h.Write(w.buf[:n])
+	}
+	_, w.err = w.w.Write(w.buf[:n])
+}
+
+func (w *writer) bytes(b []byte, h hash.Hash32) {
+	w.uvarint(uint64(len(b)), h)
+	if w.err != nil {
+		return
+	}
+	if h != nil {
+		_, _ = h.Write(b)
+	}
+	_, w.err = w.w.Write(b)
+}
+
+// Export writes all the DBs of the producer into the archive.
+// If flushIDKey isn't nil, then the DBs must be synced, i.e. have the same clean flush ID, which is written into the archive.
+// The DBs must not be modified during the export.
+func Export(producer kvdb.IterableDBProducer, out io.Writer, flushIDKey []byte) error {
+	names := producer.Names()
+	sort.Strings(names)
+
+	var flushID []byte
+	if flushIDKey != nil {
+		var err error
+		flushID, err = checkSynced(producer, names, flushIDKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	gz := gzip.NewWriter(out)
+	w := &writer{
+		w: bufio.NewWriter(gz),
+	}
+	_, w.err = w.w.WriteString(magic)
+	w.uvarint(version, nil)
+	w.bytes(flushID, nil)
+
+	for _, name := range names {
+		err := exportDB(producer, name, w)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.byte(endTag)
+	w.uvarint(uint64(len(names)), nil)
+	if w.err != nil {
+		return w.err
+	}
+	err := w.w.Flush()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func exportDB(producer kvdb.IterableDBProducer, name string, w *writer) error {
+	db, err := producer.OpenDB(name)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w.byte(dbTag)
+	w.bytes([]byte(name), nil)
+
+	h := crc32.New(crcTable)
+	var pairs uint64
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+	for w.err == nil && it.Next() {
+		w.byte(pairTag)
+		w.bytes(it.Key(), h)
+		w.bytes(it.Value(), h)
+		pairs++
+	}
+	if it.Error() != nil {
+		return it.Error()
+	}
+
+	w.byte(dbEndTag)
+	w.uvarint(pairs, nil)
+	if w.err == nil {
+		_, w.err = w.w.Write(h.Sum(nil))
+	}
+	return w.err
+}
+
+func checkSynced(producer kvdb.DBProducer, names []string, flushIDKey []byte) ([]byte, error) {
+	dbs := make(map[string]kvdb.Store, len(names))
+	for _, name := range names {
+		db, err := producer.OpenDB(name)
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		dbs[name] = db
+	}
+	return flushable.CheckDBsSynced(dbs, flushIDKey, nil)
+}
@@ -0,0 +1,236 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/flushable"
+)
+
+type reader struct {
+	r *bufio.Reader
+}
+
+func corrupted(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *reader) uvarint(h hash.Hash32) (uint64, error) {
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return 0, corrupted(err)
+	}
+	if h != nil {
+		var buf [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(buf[:], v)
+		_, _ = h.Write(buf[:n])
+	}
+	return v, nil
+}
+
+func (r *reader) bytes(h hash.Hash32) ([]byte, error) {
+	size, err := r.uvarint(h)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFieldSize {
+		return nil, ErrCorrupted
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r.r, b)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	if h != nil {
+		_, _ = h.Write(b)
+	}
+	return b, nil
+}
+
+// Import writes the DBs from the archive into the producer. The DBs must not exist in the producer.
+// If the import fails, then the DBs created by it are dropped, so the import may be retried.
+// If flushIDKey isn't nil, then the flush IDs are written into the DBs only after all the DBs are imported and verified.
+// The flush ID of the imported DBs is returned.
+func Import(in io.Reader, producer kvdb.IterableDBProducer, flushIDKey []byte) (_ []byte, err error) {
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		if errors.Is(err, gzip.ErrHeader) {
+			return nil, ErrNotArchive
+		}
+		return nil, err
+	}
+	defer gz.Close()
+	r := &reader{
+		r: bufio.NewReader(gz),
+	}
+
+	header := make([]byte, len(magic))
+	_, err = io.ReadFull(r.r, header)
+	if err != nil || string(header) != magic {
+		return nil, ErrNotArchive
+	}
+	ver, err := r.uvarint(nil)
+	if err != nil {
+		return nil, err
+	}
+	if ver != version {
+		return nil, ErrVersion
+	}
+	flushID, err := r.bytes(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool)
+	for _, name := range producer.Names() {
+		existing[name] = true
+	}
+
+	imported := make(map[string]kvdb.Store)
+	defer func() {
+		for _, db := range imported {
+			_ = db.Close()
+			if err != nil {
+				db.Drop()
+			}
+		}
+	}()
+	// the flush IDs are written only when all the DBs are imported
+	marks := make(map[string][]byte)
+	for {
+		tag, err := r.r.ReadByte()
+		if err != nil {
+			return nil, corrupted(err)
+		}
+		if tag == endTag {
+			break
+		}
+		if tag != dbTag {
+			return nil, ErrCorrupted
+		}
+		name, err := r.bytes(nil)
+		if err != nil {
+			return nil, err
+		}
+		if existing[string(name)] {
+			return nil, ErrDBExists
+		}
+		if _, ok := imported[string(name)]; ok {
+			return nil, ErrCorrupted
+		}
+		db, err := producer.OpenDB(string(name))
+		if err != nil {
+			return nil, err
+		}
+		imported[string(name)] = db
+		mark, err := importDB(r, db, flushIDKey)
+		if err != nil {
+			return nil, err
+		}
+		if mark != nil {
+			marks[string(name)] = mark
+		}
+	}
+	dbsNum, err := r.uvarint(nil)
+	if err != nil {
+		return nil, err
+	}
+	if dbsNum != uint64(len(imported)) {
+		return nil, ErrCorrupted
+	}
+	// reading until EOF verifies the gzip checksum
+	_, err = io.Copy(io.Discard, r.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if flushIDKey == nil {
+		return flushID, nil
+	}
+	for name, mark := range marks {
+		err = imported[name].Put(flushIDKey, mark)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dbs := make(map[string]kvdb.Store, len(imported))
+	for name, db := range imported {
+		dbs[name] = db
+	}
+	syncedID, err := flushable.CheckDBsSynced(dbs, flushIDKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(syncedID, flushID) {
+		return nil, ErrFlushIDMismatch
+	}
+	return flushID, nil
+}
+
+// importDB writes the pairs of a DB, and returns the flush ID pair value, which isn't written
+func importDB(r *reader, db kvdb.Store, flushIDKey []byte) (mark []byte, err error) {
+	h := crc32.New(crcTable)
+	var pairs uint64
+	batch := db.NewBatch()
+	defer batch.Reset()
+	for {
+		tag, err := r.r.ReadByte()
+		if err != nil {
+			return nil, corrupted(err)
+		}
+		if tag == dbEndTag {
+			break
+		}
+		if tag != pairTag {
+			return nil, ErrCorrupted
+		}
+		key, err := r.bytes(h)
+		if err != nil {
+			return nil, err
+		}
+		val, err := r.bytes(h)
+		if err != nil {
+			return nil, err
+		}
+		pairs++
+		if flushIDKey != nil && bytes.Equal(key, flushIDKey) {
+			mark = val
+			continue
+		}
+		err = batch.Put(key, val)
+		if err != nil {
+			return nil, err
+		}
+		if batch.ValueSize() > kvdb.IdealBatchSize {
+			err = batch.Write()
+			if err != nil {
+				return nil, err
+			}
+			batch.Reset()
+		}
+	}
+
+	expectedPairs, err := r.uvarint(nil)
+	if err != nil {
+		return nil, err
+	}
+	checksum := make([]byte, crc32.Size)
+	_, err = io.ReadFull(r.r, checksum)
+	if err != nil {
+		return nil, corrupted(err)
+	}
+	if expectedPairs != pairs || !bytes.Equal(checksum, h.Sum(nil)) {
+		return nil, ErrChecksum
+	}
+	return mark, batch.Write()
+}
@@ -0,0 +1,29 @@
+package cached
+
+import (
+	"github.com/panoptisDev/lachesis-base/utils/cachescale"
+)
+
+// Config is the cache limits
+type Config struct {
+	// ValuesSize is the maximum total size of cached keys and values
+	ValuesSize uint
+	// ValuesNum is the maximum number of cached values
+	ValuesNum int
+	// MissesNum is the maximum number of cached missing keys
+	MissesNum int
+}
+
+// DefaultConfig returns default cache config
+func DefaultConfig(scale cachescale.Func) Config {
+	return Config{
+		ValuesSize: scale.U(16 * 1024 * 1024),
+		ValuesNum:  scale.I(100000),
+		MissesNum:  scale.I(20000),
+	}
+}
+
+// LiteConfig returns default cache config for tests
+func LiteConfig() Config {
+	return DefaultConfig(cachescale.Ratio{Base: 100, Target: 1})
+}
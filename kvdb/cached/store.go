@@ -0,0 +1,195 @@
+package cached
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/utils/wlru"
+)
+
+// keyOverhead is an estimation of memory, which is used by a cached key besides its bytes
+const keyOverhead = 64
+
+// Store is a kvdb.Store wrapper with read-through LRU cache of values and missing keys.
+// Writes are passed through to the underlying DB, and the written keys are evicted from the cache,
+// so iterators and snapshots, which are served by the underlying DB, are always consistent with the cache.
+type Store struct {
+	kvdb.Store
+
+	values *wlru.Cache // key -> value
+	misses *wlru.Cache // key -> struct{}
+
+	// mu protects the cache from being filled by a value, which was read before a concurrent write.
+	// writes counter is changed by every write, so a value is cached only if there were no writes during its reading.
+	mu     sync.Mutex
+	writes uint64
+}
+
+// Wrap makes a cached DB.
+func Wrap(store kvdb.Store, cfg Config) *Store {
+	if store == nil {
+		panic("nil store")
+	}
+	values, err := wlru.New(cfg.ValuesSize, cfg.ValuesNum)
+	if err != nil {
+		panic(err)
+	}
+	missesNum := cfg.MissesNum
+	if missesNum <= 0 {
+		missesNum = 1
+	}
+	misses, err := wlru.New(uint(missesNum), missesNum)
+	if err != nil {
+		panic(err)
+	}
+	return &Store{
+		Store:  store,
+		values: values,
+		misses: misses,
+	}
+}
+
+func (s *Store) writesCounter() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writes
+}
+
+// cache adds the read value into the cache, unless there were writes since the reading was started.
+// nil value means a missing key.
+func (s *Store) cache(key string, value []byte, writes uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writes != writes {
+		return
+	}
+	if value == nil {
+		s.misses.Add(key, struct{}{}, 1)
+	} else {
+		s.values.Add(key, value, uint(len(key)+len(value)+keyOverhead))
+	}
+}
+
+// evict removes the written keys from the cache
+func (s *Store) evict(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	for _, key := range keys {
+		s.values.Remove(key)
+		s.misses.Remove(key)
+	}
+}
+
+// Has retrieves if a key is present in the key-value data store.
+func (s *Store) Has(key []byte) (bool, error) {
+	if s.values.Contains(string(key)) {
+		return true, nil
+	}
+	if s.misses.Contains(string(key)) {
+		return false, nil
+	}
+
+	writes := s.writesCounter()
+	has, err := s.Store.Has(key)
+	if err != nil {
+		return false, err
+	}
+	if !has {
+		s.cache(string(key), nil, writes)
+	}
+	return has, nil
+}
+
+// Get retrieves the given key if it's present in the key-value data store.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	if val, ok := s.values.Get(string(key)); ok {
+		return common.CopyBytes(val.([]byte)), nil
+	}
+	if s.misses.Contains(string(key)) {
+		return nil, nil
+	}
+
+	writes := s.writesCounter()
+	val, err := s.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	s.cache(string(key), common.CopyBytes(val), writes)
+	return val, nil
+}
+
+// Put inserts the given value into the key-value data store.
+func (s *Store) Put(key []byte, value []byte) error {
+	defer s.evict(string(key))
+	return s.Store.Put(key, value)
+}
+
+// Delete removes the key from the key-value data store.
+func (s *Store) Delete(key []byte) error {
+	defer s.evict(string(key))
+	return s.Store.Delete(key)
+}
+
+// NewBatch creates a write-only database that buffers changes to its host db
+// until a final write is called.
+func (s *Store) NewBatch() kvdb.Batch {
+	return &batch{
+		Batch: s.Store.NewBatch(),
+		db:    s,
+	}
+}
+
+// Close purges the cache and closes the underlying DB.
+func (s *Store) Close() error {
+	s.Purge()
+	return s.Store.Close()
+}
+
+// Drop purges the cache and drops the underlying DB.
+func (s *Store) Drop() {
+	s.Purge()
+	s.Store.Drop()
+}
+
+// Purge drops all the cached values and missing keys.
+// It should be called if the underlying DB is modified bypassing the wrapper.
+func (s *Store) Purge() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writes++
+	s.values.Purge()
+	s.misses.Purge()
+}
+
+type batch struct {
+	kvdb.Batch
+	db   *Store
+	keys []string
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	b.keys = append(b.keys, string(key))
+	return b.Batch.Put(key, value)
+}
+
+// Delete inserts the key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.keys = append(b.keys, string(key))
+	return b.Batch.Delete(key)
+}
+
+// Write flushes any accumulated data to disk, and evicts the written keys from the cache.
+func (b *batch) Write() error {
+	defer b.db.evict(b.keys...)
+	return b.Batch.Write()
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	b.Batch.Reset()
+	b.keys = b.keys[:0]
+}
@@ -0,0 +1,169 @@
+package cached
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/common/bigendian"
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+)
+
+// countingStore counts the reads from the underlying DB
+type countingStore struct {
+	kvdb.Store
+	reads int64
+}
+
+func (s *countingStore) Has(key []byte) (bool, error) {
+	atomic.AddInt64(&s.reads, 1)
+	return s.Store.Has(key)
+}
+
+func (s *countingStore) Get(key []byte) ([]byte, error) {
+	atomic.AddInt64(&s.reads, 1)
+	return s.Store.Get(key)
+}
+
+func TestStoreCaching(t *testing.T) {
+	require := require.New(t)
+
+	underlying := &countingStore{Store: memorydb.New()}
+	db := Wrap(underlying, LiteConfig())
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	for i := 0; i < 3; i++ {
+		got, err := db.Get([]byte("a"))
+		require.NoError(err)
+		require.Equal([]byte("1"), got)
+		has, err := db.Has([]byte("a"))
+		require.NoError(err)
+		require.True(has)
+		got, err = db.Get([]byte("b"))
+		require.NoError(err)
+		require.Nil(got)
+		has, err = db.Has([]byte("b"))
+		require.NoError(err)
+		require.False(has)
+	}
+	require.Equal(int64(2), underlying.reads)
+
+	// returned values may be modified by the caller
+	got, err := db.Get([]byte("a"))
+	require.NoError(err)
+	got[0] = '0'
+
+	// writes evict the keys
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+	require.NoError(db.Delete([]byte("a")))
+	got, err = db.Get([]byte("a"))
+	require.NoError(err)
+	require.Nil(got)
+	got, err = db.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal([]byte("2"), got)
+
+	// batches evict the keys once written
+	batch := db.NewBatch()
+	require.NoError(batch.Put([]byte("a"), []byte("3")))
+	require.NoError(batch.Delete([]byte("b")))
+	got, err = db.Get([]byte("a"))
+	require.NoError(err)
+	require.Nil(got)
+	require.NoError(batch.Write())
+	got, err = db.Get([]byte("a"))
+	require.NoError(err)
+	require.Equal([]byte("3"), got)
+	has, err := db.Has([]byte("b"))
+	require.NoError(err)
+	require.False(has)
+
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+	require.True(it.Next())
+	require.Equal([]byte("a"), it.Key())
+	require.Equal([]byte("3"), it.Value())
+	require.False(it.Next())
+}
+
+func TestStoreRandom(t *testing.T) {
+	require := require.New(t)
+
+	expected := memorydb.New()
+	db := Wrap(memorydb.New(), Config{
+		ValuesSize: 1024,
+		ValuesNum:  10,
+		MissesNum:  10,
+	})
+	r := rand.New(rand.NewSource(0)) // nolint:gosec
+
+	batch := db.NewBatch()
+	expectedBatch := expected.NewBatch()
+	for i := 0; i < 10000; i++ {
+		key := bigendian.Uint32ToBytes(uint32(r.Intn(50)))
+		val := bigendian.Uint32ToBytes(uint32(i))
+		switch r.Intn(6) {
+		case 0:
+			require.NoError(db.Put(key, val))
+			require.NoError(expected.Put(key, val))
+		case 1:
+			require.NoError(db.Delete(key))
+			require.NoError(expected.Delete(key))
+		case 2:
+			require.NoError(batch.Put(key, val))
+			require.NoError(expectedBatch.Put(key, val))
+			if r.Intn(5) == 0 {
+				require.NoError(batch.Write())
+				require.NoError(expectedBatch.Write())
+				batch.Reset()
+				expectedBatch.Reset()
+			}
+		case 3:
+			has, err := db.Has(key)
+			require.NoError(err)
+			expectedHas, err := expected.Has(key)
+			require.NoError(err)
+			require.Equal(expectedHas, has)
+		default:
+			got, err := db.Get(key)
+			require.NoError(err)
+			expectedGot, err := expected.Get(key)
+			require.NoError(err)
+			require.Equal(expectedGot, got)
+		}
+	}
+}
+
+func TestStoreConcurrentWrites(t *testing.T) {
+	require := require.New(t)
+
+	db := Wrap(memorydb.New(), LiteConfig())
+	key := []byte("key")
+	const writes = 1000
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, _ = db.Get(key)
+		}
+	}()
+	for i := uint32(1); i <= writes; i++ {
+		require.NoError(db.Put(key, bigendian.Uint32ToBytes(i)))
+	}
+	done <- struct{}{}
+	<-done
+
+	// a value, which was read concurrently with a write, must not stay in the cache
+	got, err := db.Get(key)
+	require.NoError(err)
+	require.Equal(bigendian.Uint32ToBytes(writes), got)
+}
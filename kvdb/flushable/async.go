@@ -0,0 +1,216 @@
+package flushable
+
+import (
+	"sort"
+
+	rbt "github.com/emirpasic/gods/trees/redblacktree"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+/*
+ * Background flushes.
+ * The modified pairs are frozen and flushed in a background goroutine, while a new tree takes the writes.
+ * Until the frozen pairs are written, reads consult both the layers.
+ */
+
+// FlushAsync flushes current cache into parent DB in background.
+// Reads and writes aren't blocked during the background flush.
+// If there's another background flush, then the call waits for it first.
+// done is called once the flush is finished. If it's failed, then the not flushed pairs stay in the cache.
+func (w *Flushable) FlushAsync(done func(error)) error {
+	w.flushMu.Lock()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.flushAsync(w.underlying, done)
+}
+
+// flushAsync should be called under both flushMu and lock. flushMu is released once the background flush is finished.
+func (w *Flushable) flushAsync(underlying kvdb.Store, done func(error)) error {
+	if w.modified == nil {
+		w.flushMu.Unlock()
+		return errClosed
+	}
+	w.freeze()
+
+	go func() {
+		err := w.flushFrozen(underlying)
+		w.flushMu.Unlock()
+		if done != nil {
+			done(err)
+		}
+	}()
+	return nil
+}
+
+// freeze makes the modified pairs read-only, they should be flushed by flushFrozen.
+// Should be called under both flushMu and lock.
+func (w *Flushable) freeze() {
+	w.flushing = w.modified
+	w.modified = rbt.NewWithStringComparator()
+	*w.sizeEstimation = 0
+}
+
+// flushFrozen writes the frozen pairs into parent DB and drops them from the cache.
+// If writing is failed, then the frozen pairs are moved back into the modified pairs, unless they were overwritten.
+// Should be called under flushMu, but not under lock.
+func (w *Flushable) flushFrozen(underlying kvdb.Store) error {
+	// w.flushing isn't changed without flushMu, so it may be read without lock
+	err := writePairs(underlying, w.flushing)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err != nil {
+		for it := w.flushing.Iterator(); it.Next(); {
+			if _, ok := w.modified.Get(it.Key()); ok {
+				continue
+			}
+			key := []byte(it.Key().(string))
+			if it.Value() == nil {
+				w.delete(key)
+			} else {
+				w.put(key, it.Value().([]byte))
+			}
+		}
+	}
+	w.flushing = nil
+	return err
+}
+
+// FlushAsync flushes current cache into parent DB in background.
+// Real db is produced before the call returns.
+func (w *LazyFlushable) FlushAsync(done func(error)) error {
+	w.flushMu.Lock()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	underlying, err := w.initUnderlyingDb()
+	if err != nil {
+		w.flushMu.Unlock()
+		return err
+	}
+	return w.flushAsync(underlying, done)
+}
+
+// FlushAsync flushes all the DBs in background. The flush ID is marked as clean only after all the DBs are flushed.
+// The cached pairs of all the DBs are frozen atomically, reads and writes aren't blocked during the background flush.
+// Underlying DBs are blocked until the flush is finished, the same way as during Flush.
+// If there's another background flush, then the call waits for it first.
+// done is called once the flush is finished.
+func (p *SyncedPool) FlushAsync(id []byte, done func(error)) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.flushing.Lock()
+	p.asyncFlushes.Add(1)
+	flushes, walKey, err := p.startFlushAsync(id)
+	if err != nil {
+		p.asyncFlushes.Done()
+		p.flushing.Unlock()
+		return err
+	}
+
+	go func() {
+		err := p.finishFlushAsync(flushes, id, walKey)
+		p.asyncFlushes.Done()
+		p.flushing.Unlock()
+		if done != nil {
+			done(err)
+		}
+	}()
+	return nil
+}
+
+type frozenFlush struct {
+	db         *closeDropWrapped
+	underlying kvdb.Store
+}
+
+// startFlushAsync marks the DBs as dirty and freezes the cached pairs.
+// flushMu of every returned DB is held until finishFlushAsync.
+func (p *SyncedPool) startFlushAsync(id []byte) ([]frozenFlush, []byte, error) {
+	err := p.dropQueued()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, 0, len(p.wrappers))
+	for name := range p.wrappers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// block the writes, so all the DBs are frozen at the same state
+	for _, name := range names {
+		w := p.wrappers[name].Flushable
+		w.flushMu.Lock()
+		w.lock.Lock()
+		defer w.lock.Unlock()
+	}
+	unlockAll := func() {
+		for _, name := range names {
+			p.wrappers[name].Flushable.flushMu.Unlock()
+		}
+	}
+
+	var walKey []byte
+	if p.wal != nil {
+		walKey, err = p.writeWAL(names, id)
+		if err != nil {
+			unlockAll()
+			return nil, nil, err
+		}
+	}
+
+	flushes := make([]frozenFlush, 0, len(names))
+	for _, name := range names {
+		w := p.wrappers[name].Flushable
+		if w.modified == nil {
+			unlockAll()
+			return nil, nil, errClosed
+		}
+		db, err := w.initUnderlyingDb()
+		if err != nil {
+			unlockAll()
+			return nil, nil, err
+		}
+		err = MarkFlushID(db, p.flushIDKey, DirtyPrefix, id)
+		if err != nil {
+			unlockAll()
+			return nil, nil, err
+		}
+		flushes = append(flushes, frozenFlush{w, db})
+	}
+	for _, f := range flushes {
+		f.db.freeze()
+	}
+	return flushes, walKey, nil
+}
+
+// finishFlushAsync writes the frozen pairs and marks the DBs as clean.
+// All the DBs are processed even if a flush of some DB is failed, so all the flushMu are released.
+func (p *SyncedPool) finishFlushAsync(flushes []frozenFlush, id []byte, walKey []byte) error {
+	var firstErr error
+	for _, f := range flushes {
+		err := f.db.flushFrozen(f.underlying)
+		f.db.flushMu.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for _, f := range flushes {
+		err := MarkFlushID(f.underlying, p.flushIDKey, CleanPrefix, id)
+		if err != nil {
+			return err
+		}
+	}
+	if walKey != nil {
+		return p.deleteWAL(walKey)
+	}
+	return nil
+}
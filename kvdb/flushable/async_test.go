@@ -0,0 +1,131 @@
+package flushable
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+var errWrite = errors.New("write failed")
+
+// blockingStore blocks batch writes until release is closed, and fails them if fail is set
+type blockingStore struct {
+	kvdb.Store
+	release chan struct{}
+	fail    bool
+}
+
+func (s *blockingStore) NewBatch() kvdb.Batch {
+	return &blockingBatch{s.Store.NewBatch(), s}
+}
+
+type blockingBatch struct {
+	kvdb.Batch
+	s *blockingStore
+}
+
+func (b *blockingBatch) Write() error {
+	<-b.s.release
+	if b.s.fail {
+		return errWrite
+	}
+	return b.Batch.Write()
+}
+
+func collectPairs(t *testing.T, db kvdb.Iteratee) map[string]string {
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+	res := map[string]string{}
+	for it.Next() {
+		res[string(it.Key())] = string(it.Value())
+	}
+	require.NoError(t, it.Error())
+	return res
+}
+
+func TestFlushableAsync(t *testing.T) {
+	require := require.New(t)
+
+	parent := Wrap(devnull)
+	require.NoError(parent.Put([]byte("c"), []byte("parent")))
+	require.NoError(parent.Put([]byte("d"), []byte("parent")))
+	underlying := &blockingStore{
+		Store:   parent,
+		release: make(chan struct{}),
+	}
+	db := Wrap(underlying)
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("1")))
+	require.NoError(db.Delete([]byte("c")))
+
+	done := make(chan error, 1)
+	require.NoError(db.FlushAsync(func(err error) {
+		done <- err
+	}))
+	require.Equal(0, db.NotFlushedPairs())
+
+	// the flush is blocked, but reads and writes aren't
+	require.NoError(db.Put([]byte("a"), []byte("2")))
+	require.NoError(db.Delete([]byte("d")))
+	require.Equal(2, db.NotFlushedPairs())
+	got, err := db.Get([]byte("b"))
+	require.NoError(err)
+	require.Equal([]byte("1"), got)
+	has, err := db.Has([]byte("c"))
+	require.NoError(err)
+	require.False(has)
+	expected := map[string]string{"a": "2", "b": "1"}
+	require.Equal(expected, collectPairs(t, db))
+	snap, err := db.GetSnapshot()
+	require.NoError(err)
+	defer snap.Release()
+	require.Equal(expected, collectPairs(t, snap))
+
+	close(underlying.release)
+	require.NoError(<-done)
+	require.Equal(map[string]string{"a": "1", "b": "1", "d": "parent"}, collectPairs(t, parent))
+	require.Equal(expected, collectPairs(t, db))
+	require.Equal(expected, collectPairs(t, snap))
+
+	require.NoError(db.Flush())
+	require.Equal(expected, collectPairs(t, parent))
+}
+
+func TestFlushableAsyncFailed(t *testing.T) {
+	require := require.New(t)
+
+	parent := Wrap(devnull)
+	underlying := &blockingStore{
+		Store:   parent,
+		release: make(chan struct{}),
+		fail:    true,
+	}
+	db := Wrap(underlying)
+
+	require.NoError(db.Put([]byte("a"), []byte("1")))
+	require.NoError(db.Put([]byte("b"), []byte("1")))
+	require.NoError(db.Put([]byte("c"), []byte("1")))
+
+	done := make(chan error, 1)
+	require.NoError(db.FlushAsync(func(err error) {
+		done <- err
+	}))
+	require.NoError(db.Put([]byte("b"), []byte("2")))
+
+	close(underlying.release)
+	require.ErrorIs(<-done, errWrite)
+
+	// not flushed pairs stay in the cache, newer values aren't overwritten
+	expected := map[string]string{"a": "1", "b": "2", "c": "1"}
+	require.Equal(3, db.NotFlushedPairs())
+	require.Equal(expected, collectPairs(t, db))
+	require.Empty(collectPairs(t, parent))
+
+	underlying.fail = false
+	require.NoError(db.Flush())
+	require.Equal(expected, collectPairs(t, parent))
+}
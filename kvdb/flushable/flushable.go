@@ -24,12 +24,16 @@ type Flushable struct {
 	underlying kvdb.Store
 
 	sizeEstimation *int
+
+	// flushMu is held during a flush, including a background one. It's locked before lock
+	flushMu sync.Mutex
 }
 
 type flushableReader struct {
 	underlying kvdb.IteratedReader
 
 	modified *rbt.Tree // modified, comparing to parent, pairs. deleted values are nil
+	flushing *rbt.Tree // read-only pairs, which are being flushed in background. nil if there's no background flush
 
 	lock sync.RWMutex
 }
@@ -95,6 +99,12 @@ func (w *flushableReader) Has(key []byte) (bool, error) {
 	if ok {
 		return val != nil, nil
 	}
+	if w.flushing != nil {
+		val, ok = w.flushing.Get(string(key))
+		if ok {
+			return val != nil, nil
+		}
+	}
 
 	return w.underlying.Has(key)
 }
@@ -114,6 +124,14 @@ func (w *flushableReader) Get(key []byte) ([]byte, error) {
 		}
 		return common.CopyBytes(entry.([]byte)), nil
 	}
+	if w.flushing != nil {
+		if entry, ok := w.flushing.Get(string(key)); ok {
+			if entry == nil {
+				return nil, nil
+			}
+			return common.CopyBytes(entry.([]byte)), nil
+		}
+	}
 
 	return w.underlying.Get(key)
 }
@@ -134,7 +152,10 @@ func (w *Flushable) delete(key []byte) {
 
 // DropNotFlushed drops all the not flushed keys.
 // After this call, the state of parent DB is identical to the state of this DB.
+// Waits for a background flush, if any.
 func (w *Flushable) DropNotFlushed() {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
@@ -147,7 +168,10 @@ func (w *Flushable) dropNotFlushed() {
 }
 
 // Close leaves underlying database.
+// Waits for a background flush, if any.
 func (w *Flushable) Close() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
@@ -175,6 +199,7 @@ func (w *Flushable) Drop() {
 }
 
 // NotFlushedPairs returns num of not flushed keys, including deleted keys.
+// The keys which are being flushed in background aren't counted.
 func (w *Flushable) NotFlushedPairs() int {
 	w.lock.RLock()
 	defer w.lock.RUnlock()
@@ -183,6 +208,7 @@ func (w *Flushable) NotFlushedPairs() int {
 }
 
 // NotFlushedSizeEst returns estimation of not flushed data, including deleted keys.
+// The keys which are being flushed in background aren't counted.
 func (w *Flushable) NotFlushedSizeEst() int {
 	w.lock.RLock()
 	defer w.lock.RUnlock()
@@ -191,7 +217,10 @@ func (w *Flushable) NotFlushedSizeEst() int {
 }
 
 // Flush current cache into parent DB.
+// Waits for a background flush, if any.
 func (w *Flushable) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
@@ -203,9 +232,21 @@ func (w *Flushable) flush() error {
 		return errClosed
 	}
 
-	batch := w.underlying.NewBatch()
+	err := writePairs(w.underlying, w.modified)
+	if err != nil {
+		return err
+	}
+	w.modified.Clear()
+	*w.sizeEstimation = 0
+
+	return nil
+}
+
+// writePairs writes the tree of modified pairs into the DB
+func writePairs(db kvdb.Store, pairs *rbt.Tree) error {
+	batch := db.NewBatch()
 	defer batch.Reset()
-	for it := w.modified.Iterator(); it.Next(); {
+	for it := pairs.Iterator(); it.Next(); {
 		var err error
 
 		if it.Value() == nil {
@@ -226,8 +267,6 @@ func (w *Flushable) flush() error {
 			batch.Reset()
 		}
 	}
-	w.modified.Clear()
-	*w.sizeEstimation = 0
 
 	return batch.Write()
 }
@@ -259,7 +298,7 @@ func (w *Flushable) AncientDatadir() (string, error) {
  */
 
 type flushableIterator struct {
-	lock *sync.RWMutex
+	lock *sync.RWMutex // nil if the tree is read-only
 
 	tree *rbt.Tree
 
@@ -324,8 +363,10 @@ func (it *flushableIterator) init() {
 // Next scans key-value pair by key in lexicographic order. Looks in cache first,
 // then - in DB.
 func (it *flushableIterator) Next() bool {
-	it.lock.RLock()
-	defer it.lock.RUnlock()
+	if it.lock != nil {
+		it.lock.RLock()
+		defer it.lock.RUnlock()
+	}
 
 	if it.Error() != nil {
 		return false
@@ -430,6 +471,12 @@ func (w *Flushable) GetSnapshot() (kvdb.Snapshot, error) {
 		return nil, err
 	}
 	modifiedCopy := rbt.NewWithStringComparator()
+	if w.flushing != nil {
+		// parent snapshot may contain only a part of the pairs which are being flushed
+		for it := w.flushing.Iterator(); it.Next(); {
+			modifiedCopy.Put(it.Key(), it.Value())
+		}
+	}
 	for it := w.modified.Iterator(); it.Next(); {
 		modifiedCopy.Put(it.Key(), it.Value())
 	}
@@ -467,12 +514,25 @@ func (w *flushableReader) NewIterator(prefix []byte, start []byte) kvdb.Iterator
 		}
 	}
 
+	parentIt := w.underlying.NewIterator(prefix, start)
+	if w.flushing != nil {
+		// the pairs which are being flushed have priority over parent DB
+		flushingIt := &flushableIterator{
+			tree:     w.flushing,
+			start:    append(common.CopyBytes(prefix), start...),
+			prefix:   prefix,
+			parentIt: parentIt,
+		}
+		flushingIt.init()
+		parentIt = flushingIt
+	}
+
 	it := &flushableIterator{
 		lock:     &w.lock,
 		tree:     w.modified,
 		start:    append(common.CopyBytes(prefix), start...),
 		prefix:   prefix,
-		parentIt: w.underlying.NewIterator(prefix, start),
+		parentIt: parentIt,
 	}
 	it.init()
 	return it
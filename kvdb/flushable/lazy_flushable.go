@@ -55,9 +55,15 @@ func (w *LazyFlushable) initUnderlyingDb() (kvdb.Store, error) {
 // Flush current cache into parent DB.
 // Real db won't be produced until first .Flush() is called.
 func (w *LazyFlushable) Flush() (err error) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
+	return w.initAndFlush()
+}
+
+func (w *LazyFlushable) initAndFlush() (err error) {
 	w.underlying, err = w.initUnderlyingDb()
 	if err != nil {
 		return err
@@ -34,8 +34,13 @@ type SyncedPool struct {
 
 	flushIDKey []byte
 
+	// wal is an optional write-ahead log of flushes
+	wal    kvdb.Store
+	walSeq uint64
+
 	sync.Mutex
-	flushing sync.RWMutex
+	flushing     sync.RWMutex
+	asyncFlushes sync.WaitGroup
 }
 
 func NewSyncedPool(producer kvdb.DBProducer, flushIDKey []byte) *SyncedPool {
@@ -61,6 +66,12 @@ func (p *SyncedPool) Initialize(dbNames []string, flushID []byte) ([]byte, error
 			return flushID, err
 		}
 	}
+	if p.wal != nil {
+		err := p.replayWAL()
+		if err != nil {
+			return flushID, err
+		}
+	}
 	return p.checkDBsSynced(flushID)
 }
 
@@ -159,23 +170,12 @@ func (p *SyncedPool) Flush(id []byte) error {
 }
 
 func (p *SyncedPool) flush(id []byte) error {
-	queuedDropsList := p.popQueuedDrops()
-	// close and drop DBs
-	for _, name := range queuedDropsList {
-		w := p.wrappers[name]
-		delete(p.wrappers, name)
-		if w.Flushable == nil {
-			continue
-		}
-		err := w.Flushable.RealClose()
-		if err != nil {
-			return err
-		}
-		db := w.Flushable.underlying
-		if db == nil {
-			continue
-		}
-		db.Drop()
+	err := p.dropQueued()
+	if err != nil {
+		return err
+	}
+	if p.wal != nil {
+		return p.flushWithWAL(id)
 	}
 
 	// write dirty flags
@@ -214,6 +214,28 @@ func (p *SyncedPool) flush(id []byte) error {
 	return nil
 }
 
+// dropQueued closes and drops the DBs which were dropped since the last flush
+func (p *SyncedPool) dropQueued() error {
+	queuedDropsList := p.popQueuedDrops()
+	for _, name := range queuedDropsList {
+		w := p.wrappers[name]
+		delete(p.wrappers, name)
+		if w.Flushable == nil {
+			continue
+		}
+		err := w.Flushable.RealClose()
+		if err != nil {
+			return err
+		}
+		db := w.Flushable.underlying
+		if db == nil {
+			continue
+		}
+		db.Drop()
+	}
+	return nil
+}
+
 // NotFlushedSizeEst returns a total size of not flushed key pairs
 func (p *SyncedPool) NotFlushedSizeEst() int {
 	p.Lock()
@@ -288,6 +310,7 @@ func (p *SyncedPool) Names() []string {
 }
 
 func (p *SyncedPool) Close() error {
+	p.asyncFlushes.Wait()
 	for _, w := range p.wrappers {
 		err := w.Flushable.RealClose()
 		if err != nil {
@@ -0,0 +1,232 @@
+package flushable
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/panoptisDev/lachesis-base/common/bigendian"
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+/*
+ * Write-ahead log of SyncedPool flushes.
+ * A flush is serialized into the log before it's applied, and removed from the log once all the DBs are flushed.
+ * Records of earlier failed flushes are removed along with it, because the successful flush has overwritten their data.
+ * If a flush is interrupted (e.g. by a crash), then the newest record is replayed by Initialize,
+ * so all the DBs get the same data and flush ID.
+ */
+
+var errCorruptedWAL = errors.New("corrupted flushes WAL record")
+
+type walPair struct {
+	Key     []byte
+	Value   []byte
+	Deleted bool
+}
+
+type walDB struct {
+	Name  string
+	Pairs []walPair
+}
+
+type walRecord struct {
+	FlushID []byte
+	DBs     []walDB
+}
+
+// NewSyncedPoolWithWAL creates a SyncedPool, which writes every flush into the WAL before applying it.
+// The WAL must be a DB outside of the pool, it isn't closed by the pool.
+func NewSyncedPoolWithWAL(producer kvdb.DBProducer, flushIDKey []byte, wal kvdb.Store) *SyncedPool {
+	if wal == nil {
+		panic("nil WAL")
+	}
+	p := NewSyncedPool(producer, flushIDKey)
+	p.wal = wal
+	// continue the sequence of records, which may be left by an interrupted flush
+	it := wal.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		if len(it.Key()) == 8 {
+			p.walSeq = bigendian.BytesToUint64(it.Key()) + 1
+		}
+	}
+	return p
+}
+
+func (p *SyncedPool) flushWithWAL(id []byte) error {
+	names := make([]string, 0, len(p.wrappers))
+	for name := range p.wrappers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// block the writes, so exactly the logged data is flushed
+	for _, name := range names {
+		w := p.wrappers[name].Flushable
+		w.flushMu.Lock()
+		defer w.flushMu.Unlock()
+		w.lock.Lock()
+		defer w.lock.Unlock()
+	}
+
+	key, err := p.writeWAL(names, id)
+	if err != nil {
+		return err
+	}
+
+	// apply the flush
+	for _, name := range names {
+		w := p.wrappers[name].Flushable
+		db, err := w.initUnderlyingDb()
+		if err != nil {
+			return err
+		}
+		err = MarkFlushID(db, p.flushIDKey, DirtyPrefix, id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		err := p.wrappers[name].Flushable.initAndFlush()
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		err := MarkFlushID(p.wrappers[name].Flushable.underlying, p.flushIDKey, CleanPrefix, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.deleteWAL(key)
+}
+
+// deleteWAL removes the record of a successful flush, and the records of all the earlier flushes.
+// Records of earlier flushes are left only by failed flushes, and their data isn't recent anymore,
+// so replaying them would roll back the successful flush.
+func (p *SyncedPool) deleteWAL(upTo []byte) error {
+	batch := p.wal.NewBatch()
+	defer batch.Reset()
+	it := p.wal.NewIterator(nil, nil)
+	for it.Next() && bytes.Compare(it.Key(), upTo) <= 0 {
+		err := batch.Delete(common.CopyBytes(it.Key()))
+		if err != nil {
+			it.Release()
+			return err
+		}
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// writeWAL serializes the modified pairs of the DBs into a new WAL record, and returns the record key.
+// Should be called under lock of every DB.
+func (p *SyncedPool) writeWAL(names []string, id []byte) ([]byte, error) {
+	record := walRecord{
+		FlushID: id,
+		DBs:     make([]walDB, 0, len(names)),
+	}
+	for _, name := range names {
+		w := p.wrappers[name].Flushable
+		if w.modified == nil {
+			return nil, errClosed
+		}
+		db := walDB{
+			Name:  name,
+			Pairs: make([]walPair, 0, w.modified.Size()),
+		}
+		for it := w.modified.Iterator(); it.Next(); {
+			pair := walPair{
+				Key: []byte(it.Key().(string)),
+			}
+			if it.Value() == nil {
+				pair.Deleted = true
+			} else {
+				pair.Value = it.Value().([]byte)
+			}
+			db.Pairs = append(db.Pairs, pair)
+		}
+		record.DBs = append(record.DBs, db)
+	}
+	b, err := rlp.EncodeToBytes(&record)
+	if err != nil {
+		return nil, err
+	}
+	key := bigendian.Uint64ToBytes(p.walSeq)
+	p.walSeq++
+	return key, p.wal.Put(key, b)
+}
+
+// replayWAL applies the last interrupted flush.
+// Records of earlier flushes are left only by failed flushes. The data of a failed flush stays in memory,
+// so the next record contains it, and the DBs which were dropped since then aren't in the next record.
+// Hence only the newest record is replayed, and the older ones are deleted.
+func (p *SyncedPool) replayWAL() error {
+	p.Lock()
+	defer p.Unlock()
+
+	var key, b []byte
+	it := p.wal.NewIterator(nil, nil)
+	for it.Next() {
+		key = common.CopyBytes(it.Key())
+		b = common.CopyBytes(it.Value())
+	}
+	err := it.Error()
+	it.Release()
+	if err != nil || key == nil {
+		return err
+	}
+
+	var record walRecord
+	if err := rlp.DecodeBytes(b, &record); err != nil {
+		return errCorruptedWAL
+	}
+	for _, rdb := range record.DBs {
+		db, err := p.getDB(rdb.Name).InitUnderlyingDb()
+		if err != nil {
+			return err
+		}
+		err = replayPairs(db, rdb.Pairs)
+		if err != nil {
+			return err
+		}
+		err = MarkFlushID(db, p.flushIDKey, CleanPrefix, record.FlushID)
+		if err != nil {
+			return err
+		}
+	}
+	return p.deleteWAL(key)
+}
+
+func replayPairs(db kvdb.Store, pairs []walPair) error {
+	batch := db.NewBatch()
+	defer batch.Reset()
+	for _, pair := range pairs {
+		var err error
+		if pair.Deleted {
+			err = batch.Delete(pair.Key)
+		} else {
+			err = batch.Put(pair.Key, pair.Value)
+		}
+		if err != nil {
+			return err
+		}
+		if batch.ValueSize() > kvdb.IdealBatchSize {
+			err = batch.Write()
+			if err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return batch.Write()
+}
@@ -1,6 +1,8 @@
 package memorydb
 
 import (
+	"errors"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -76,3 +78,306 @@ func TestSyncedPoolUnderlying(t *testing.T) {
 	pool.Flush(nil)
 	checkConsistency()
 }
+
+var errCrash = errors.New("crash")
+
+// crashingProducer fails batch writes into the DB once crash is set, to interrupt a flush
+type crashingProducer struct {
+	kvdb.DBProducer
+	name  string
+	crash *int32
+}
+
+func (p crashingProducer) OpenDB(name string) (kvdb.Store, error) {
+	db, err := p.DBProducer.OpenDB(name)
+	if err != nil || name != p.name {
+		return db, err
+	}
+	return crashingStore{db, p.crash}, nil
+}
+
+type crashingStore struct {
+	kvdb.Store
+	crash *int32
+}
+
+func (s crashingStore) NewBatch() kvdb.Batch {
+	return crashingBatch{s.Store.NewBatch(), s.crash}
+}
+
+type crashingBatch struct {
+	kvdb.Batch
+	crash *int32
+}
+
+func (b crashingBatch) Write() error {
+	if atomic.LoadInt32(b.crash) != 0 {
+		return errCrash
+	}
+	return b.Batch.Write()
+}
+
+func TestSyncedPoolWAL(t *testing.T) {
+	for _, withWAL := range []bool{false, true} {
+		testSyncedPoolWAL(t, withWAL)
+	}
+}
+
+func testSyncedPoolWAL(t *testing.T, withWAL bool) {
+	require := require.New(t)
+	names := []string{"db1", "db2"}
+	flushIDKey := []byte("flushID")
+
+	crash := int32(0)
+	producer := crashingProducer{NewProducer(""), "db2", &crash}
+	wal := New()
+	newPool := func() *flushable.SyncedPool {
+		if withWAL {
+			return flushable.NewSyncedPoolWithWAL(producer, flushIDKey, wal)
+		}
+		return flushable.NewSyncedPool(producer, flushIDKey)
+	}
+	walLen := func() int {
+		it := wal.NewIterator(nil, nil)
+		defer it.Release()
+		n := 0
+		for it.Next() {
+			n++
+		}
+		return n
+	}
+	pushData := func(pool *flushable.SyncedPool, n uint32) {
+		for _, name := range names {
+			db, err := pool.OpenDB(name)
+			require.NoError(err)
+			for i := uint32(0); i < 10; i++ {
+				key := bigendian.Uint32ToBytes(n*10 + i)
+				require.NoError(db.Put(key, key))
+			}
+			if n > 0 {
+				require.NoError(db.Delete(bigendian.Uint32ToBytes(0)))
+			}
+		}
+	}
+
+	pool := newPool()
+	_, err := pool.Initialize(names, nil)
+	require.NoError(err)
+	pushData(pool, 0)
+	require.NoError(pool.Flush([]byte{1}))
+	require.Equal(0, walLen())
+
+	// the flush is interrupted after db1 is flushed
+	pushData(pool, 1)
+	atomic.StoreInt32(&crash, 1)
+	require.ErrorIs(pool.Flush([]byte{2}), errCrash)
+	atomic.StoreInt32(&crash, 0)
+
+	// restart
+	pool = newPool()
+	flushID, err := pool.Initialize(names, nil)
+	if !withWAL {
+		require.Error(err)
+		return
+	}
+	require.NoError(err)
+	require.Equal([]byte{flushable.CleanPrefix, 2}, flushID)
+	require.Equal(0, walLen())
+	for _, name := range names {
+		db, err := pool.GetUnderlying(name)
+		require.NoError(err)
+		for i := uint32(1); i < 20; i++ {
+			key := bigendian.Uint32ToBytes(i)
+			got, err := db.Get(key)
+			require.NoError(err)
+			require.Equal(key, got, name)
+		}
+		got, err := db.Get(bigendian.Uint32ToBytes(0))
+		require.NoError(err)
+		require.Nil(got, name)
+	}
+}
+
+func TestSyncedPoolWALFailedThenFlushed(t *testing.T) {
+	require := require.New(t)
+	names := []string{"db1", "db2"}
+	flushIDKey := []byte("flushID")
+	key := []byte("key")
+
+	crash := int32(0)
+	producer := crashingProducer{NewProducer(""), "db2", &crash}
+	wal := New()
+	put := func(pool *flushable.SyncedPool, value string) {
+		for _, name := range names {
+			db, err := pool.OpenDB(name)
+			require.NoError(err)
+			require.NoError(db.Put(key, []byte(value)))
+		}
+	}
+
+	pool := flushable.NewSyncedPoolWithWAL(producer, flushIDKey, wal)
+	_, err := pool.Initialize(names, nil)
+	require.NoError(err)
+
+	// the flush is interrupted after db1 is flushed, then the next flush succeeds
+	put(pool, "old")
+	atomic.StoreInt32(&crash, 1)
+	require.ErrorIs(pool.Flush([]byte{1}), errCrash)
+	atomic.StoreInt32(&crash, 0)
+	put(pool, "new")
+	require.NoError(pool.Flush([]byte{2}))
+	it := wal.NewIterator(nil, nil)
+	require.False(it.Next(), "stale WAL record is left")
+	it.Release()
+
+	// restart doesn't roll back the successful flush
+	pool = flushable.NewSyncedPoolWithWAL(producer, flushIDKey, wal)
+	flushID, err := pool.Initialize(names, nil)
+	require.NoError(err)
+	require.Equal([]byte{flushable.CleanPrefix, 2}, flushID)
+	for _, name := range names {
+		db, err := pool.GetUnderlying(name)
+		require.NoError(err)
+		got, err := db.Get(key)
+		require.NoError(err)
+		require.Equal([]byte("new"), got, name)
+	}
+}
+
+func TestSyncedPoolWALDroppedDB(t *testing.T) {
+	require := require.New(t)
+	flushIDKey := []byte("flushID")
+
+	crash := int32(0)
+	dbs := NewProducer("")
+	producer := crashingProducer{dbs, "db3", &crash}
+	wal := New()
+	put := func(pool *flushable.SyncedPool, names []string, n uint32) {
+		for _, name := range names {
+			db, err := pool.OpenDB(name)
+			require.NoError(err)
+			key := bigendian.Uint32ToBytes(n)
+			require.NoError(db.Put(key, key))
+		}
+	}
+
+	pool := flushable.NewSyncedPoolWithWAL(producer, flushIDKey, wal)
+	_, err := pool.Initialize([]string{"db1", "db2", "db3"}, nil)
+	require.NoError(err)
+	put(pool, []string{"db1", "db2", "db3"}, 1)
+	require.NoError(pool.Flush([]byte{1}))
+
+	// the flush is interrupted after db1 and db2 are flushed
+	put(pool, []string{"db1", "db2", "db3"}, 2)
+	atomic.StoreInt32(&crash, 1)
+	require.ErrorIs(pool.Flush([]byte{2}), errCrash)
+	atomic.StoreInt32(&crash, 0)
+
+	// db1 is dropped, and the next flush is interrupted too
+	db1, err := pool.OpenDB("db1")
+	require.NoError(err)
+	db1.Drop()
+	put(pool, []string{"db2", "db3"}, 3)
+	atomic.StoreInt32(&crash, 1)
+	require.ErrorIs(pool.Flush([]byte{3}), errCrash)
+	atomic.StoreInt32(&crash, 0)
+
+	// restart doesn't bring back the dropped DB
+	pool = flushable.NewSyncedPoolWithWAL(producer, flushIDKey, wal)
+	flushID, err := pool.Initialize([]string{"db2", "db3"}, nil)
+	require.NoError(err)
+	require.Equal([]byte{flushable.CleanPrefix, 3}, flushID)
+	require.NotContains(dbs.Names(), "db1")
+	for _, name := range []string{"db2", "db3"} {
+		db, err := pool.GetUnderlying(name)
+		require.NoError(err)
+		for i := uint32(1); i <= 3; i++ {
+			key := bigendian.Uint32ToBytes(i)
+			got, err := db.Get(key)
+			require.NoError(err)
+			require.Equal(key, got, name)
+		}
+	}
+}
+
+func TestSyncedPoolFlushAsync(t *testing.T) {
+	for _, withWAL := range []bool{false, true} {
+		testSyncedPoolFlushAsync(t, withWAL)
+	}
+}
+
+func testSyncedPoolFlushAsync(t *testing.T, withWAL bool) {
+	require := require.New(t)
+	names := []string{"db1", "db2"}
+	flushIDKey := []byte("flushID")
+
+	crash := int32(0)
+	producer := crashingProducer{NewProducer(""), "db2", &crash}
+	wal := New()
+	newPool := func() *flushable.SyncedPool {
+		if withWAL {
+			return flushable.NewSyncedPoolWithWAL(producer, flushIDKey, wal)
+		}
+		return flushable.NewSyncedPool(producer, flushIDKey)
+	}
+	pushData := func(pool *flushable.SyncedPool, n uint32) {
+		for _, name := range names {
+			db, err := pool.OpenDB(name)
+			require.NoError(err)
+			for i := uint32(0); i < 10; i++ {
+				key := bigendian.Uint32ToBytes(n*10 + i)
+				require.NoError(db.Put(key, key))
+			}
+		}
+	}
+	flushAsync := func(pool *flushable.SyncedPool, id byte) error {
+		done := make(chan error, 1)
+		require.NoError(pool.FlushAsync([]byte{id}, func(err error) {
+			done <- err
+		}))
+		// new writes don't get into the flush
+		pushData(pool, uint32(id)*100)
+		return <-done
+	}
+
+	pool := newPool()
+	_, err := pool.Initialize(names, nil)
+	require.NoError(err)
+	pushData(pool, 0)
+	require.NoError(flushAsync(pool, 1))
+	for _, name := range names {
+		db, err := pool.GetUnderlying(name)
+		require.NoError(err)
+		mark, err := db.Get(flushIDKey)
+		require.NoError(err)
+		require.Equal([]byte{flushable.CleanPrefix, 1}, mark)
+		got, err := db.Get(bigendian.Uint32ToBytes(9))
+		require.NoError(err)
+		require.NotNil(got, name)
+		got, err = db.Get(bigendian.Uint32ToBytes(100))
+		require.NoError(err)
+		require.Nil(got, name)
+	}
+	require.NotZero(pool.NotFlushedSizeEst())
+
+	// the flush of db2 fails, so the flush ID stays dirty
+	pushData(pool, 1)
+	atomic.StoreInt32(&crash, 1)
+	require.ErrorIs(flushAsync(pool, 2), errCrash)
+	atomic.StoreInt32(&crash, 0)
+	db2, err := pool.OpenDB("db2")
+	require.NoError(err)
+	got, err := db2.Get(bigendian.Uint32ToBytes(10))
+	require.NoError(err)
+	require.NotNil(got)
+
+	// restart
+	pool = newPool()
+	flushID, err := pool.Initialize(names, nil)
+	if !withWAL {
+		require.Error(err)
+		return
+	}
+	require.NoError(err)
+	require.Equal([]byte{flushable.CleanPrefix, 2}, flushID)
+}
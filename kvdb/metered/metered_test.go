@@ -0,0 +1,121 @@
+package metered
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+	"github.com/panoptisDev/lachesis-base/kvdb/table"
+)
+
+type testTables struct {
+	Roots   kvdb.Store `table:"r"`
+	Vectors kvdb.Store `table:"v"`
+	Manual  kvdb.Store `table:"-"`
+}
+
+func findStat(stats []Stat, db, table string, op Op) Stat {
+	for _, s := range stats {
+		if s.DB == db && s.Table == table && s.Op == op {
+			return s
+		}
+	}
+	return Stat{}
+}
+
+func TestMetered(t *testing.T) {
+	require := require.New(t)
+
+	metrics := NewMetrics()
+	producer := WrapProducer(memorydb.NewProducer(""), metrics)
+	db, err := producer.OpenDB("main")
+	require.NoError(err)
+
+	var tables testTables
+	table.MigrateTables(&tables, db)
+	metrics.RegisterTables("main", TablesOf(&tables, nil)...)
+	require.Equal([]Table{{"Roots", []byte("r")}, {"Vectors", []byte("v")}}, TablesOf(tables, nil))
+
+	require.NoError(tables.Roots.Put([]byte("k1"), []byte("value")))
+	require.NoError(tables.Roots.Put([]byte("k2"), []byte("value")))
+	require.NoError(tables.Vectors.Delete([]byte("k1")))
+	require.NoError(db.Put([]byte("x"), []byte("y")))
+	val, err := tables.Roots.Get([]byte("k1"))
+	require.NoError(err)
+	require.Equal([]byte("value"), val)
+	has, err := tables.Vectors.Has([]byte("k1"))
+	require.NoError(err)
+	require.False(has)
+
+	batch := db.NewBatch()
+	require.NoError(batch.Put([]byte("r3"), []byte("value")))
+	require.NoError(batch.Put([]byte("v3"), []byte("value")))
+	require.NoError(batch.Put([]byte("v4"), []byte("value")))
+	require.NoError(batch.Write())
+
+	it := tables.Roots.NewIterator(nil, nil)
+	n := 0
+	for it.Next() {
+		n++
+	}
+	it.Release()
+	require.Equal(3, n)
+
+	stats := metrics.Snapshot()
+	for _, s := range stats {
+		require.Equal("main", s.DB)
+		require.NotZero(s.Count)
+		require.Len(s.Latency.Counts, len(s.Latency.Bounds)+1)
+	}
+
+	put := findStat(stats, "main", "Roots", OpPut)
+	require.Equal(uint64(2), put.Count)
+	require.Equal(uint64(2*(3+5)), put.Bytes)
+	require.Equal(uint64(2), put.Latency.Counts[0]+put.Latency.Counts[1]+sum(put.Latency.Counts[2:]))
+
+	require.Equal(uint64(1), findStat(stats, "main", "Vectors", OpDelete).Count)
+	require.Equal(uint64(1), findStat(stats, "main", "Vectors", OpHas).Count)
+	require.Equal(uint64(1), findStat(stats, "main", "", OpPut).Count)
+	require.Equal(uint64(3+5), findStat(stats, "main", "Roots", OpGet).Bytes)
+
+	require.Equal(uint64(1), findStat(stats, "main", "Roots", OpBatchWrite).Count)
+	require.Equal(uint64(2+5), findStat(stats, "main", "Roots", OpBatchWrite).Bytes)
+	require.Equal(uint64(1), findStat(stats, "main", "Vectors", OpBatchWrite).Count)
+	require.Equal(uint64(2*(2+5)), findStat(stats, "main", "Vectors", OpBatchWrite).Bytes)
+
+	require.Equal(uint64(1), findStat(stats, "main", "Roots", OpIterator).Count)
+	// 3 steps and the last one
+	require.Equal(uint64(4), findStat(stats, "main", "Roots", OpNext).Count)
+}
+
+func sum(vv []uint64) uint64 {
+	var res uint64
+	for _, v := range vv {
+		res += v
+	}
+	return res
+}
+
+func TestHistogram(t *testing.T) {
+	require := require.New(t)
+
+	s := &opStats{}
+	s.observe(1, 500*time.Nanosecond)
+	s.observe(1, time.Microsecond)
+	s.observe(1, 3*time.Microsecond)
+	s.observe(1, time.Hour)
+	h := s.snapshot().Latency
+
+	require.Equal(uint64(2), h.Counts[0])
+	require.Equal(uint64(1), h.Counts[2])
+	require.Equal(uint64(1), h.Counts[latencyBuckets])
+	require.Equal(time.Hour+4500*time.Nanosecond, h.Sum)
+
+	require.Equal(time.Microsecond, h.Quantile(0.5))
+	require.Equal(4*time.Microsecond, h.Quantile(0.7))
+	require.Equal(h.Bounds[len(h.Bounds)-1], h.Quantile(1))
+	require.Equal(time.Duration(0), Histogram{}.Quantile(0.5))
+}
@@ -0,0 +1,329 @@
+package metered
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Op is a kind of DB operation
+type Op int
+
+const (
+	OpGet Op = iota
+	OpHas
+	OpPut
+	OpDelete
+	// OpIterator is a creation of iterator
+	OpIterator
+	// OpNext is a step of iterator
+	OpNext
+	// OpBatchWrite is a write of batch, which is accounted in every table modified by the batch
+	OpBatchWrite
+
+	opsNum
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "get"
+	case OpHas:
+		return "has"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpIterator:
+		return "iterator"
+	case OpNext:
+		return "next"
+	case OpBatchWrite:
+		return "batch_write"
+	}
+	return "unknown"
+}
+
+// Ops returns all the kinds of DB operations
+func Ops() []Op {
+	ops := make([]Op, opsNum)
+	for i := range ops {
+		ops[i] = Op(i)
+	}
+	return ops
+}
+
+// latencyBuckets is the number of bounded latency buckets. Upper bound of i-th bucket is 1us << i
+const latencyBuckets = 24
+
+// Histogram is a snapshot of latencies distribution
+type Histogram struct {
+	// Bounds are the upper bounds of buckets, inclusive. The last bucket in Counts is unbounded.
+	Bounds []time.Duration
+	// Counts are the numbers of observations in every bucket, len(Counts) == len(Bounds)+1
+	Counts []uint64
+	// Sum is the total latency of all the observations
+	Sum time.Duration
+}
+
+// Quantile returns an estimation of latencies quantile, i.e. upper bound of the bucket which contains the quantile.
+// It returns the last bound if the quantile is in the unbounded bucket.
+func (h Histogram) Quantile(q float64) time.Duration {
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+	// rank of the quantile observation, starting from 1
+	rank := uint64(math.Ceil(q * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+	var acc uint64
+	for i, c := range h.Counts {
+		acc += c
+		if acc >= rank && i < len(h.Bounds) {
+			return h.Bounds[i]
+		}
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// Stat is a snapshot of operations of one kind in a DB table
+type Stat struct {
+	DB    string
+	Table string
+	Op    Op
+	Count uint64
+	// Bytes is the total size of keys and values, which were read or written
+	Bytes   uint64
+	Latency Histogram
+}
+
+// Table is a named keys prefix
+type Table struct {
+	Name   string
+	Prefix []byte
+}
+
+// TablesOf returns the tables of struct fields with `table` tag, in the same way as table.MigrateTables opens them.
+// Tables are named after the fields. basePrefix is prepended to all the prefixes.
+func TablesOf(s interface{}, basePrefix []byte) []Table {
+	value := reflect.ValueOf(s)
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	var res []Table
+	for i := 0; i < value.NumField(); i++ {
+		if prefix := value.Type().Field(i).Tag.Get("table"); prefix != "" && prefix != "-" {
+			res = append(res, Table{
+				Name:   value.Type().Field(i).Name,
+				Prefix: append(append([]byte{}, basePrefix...), prefix...),
+			})
+		}
+	}
+	return res
+}
+
+type opStats struct {
+	count   uint64
+	bytes   uint64
+	latency uint64 // nanoseconds
+	buckets [latencyBuckets + 1]uint64
+}
+
+func (s *opStats) observe(size int, latency time.Duration) {
+	atomic.AddUint64(&s.count, 1)
+	atomic.AddUint64(&s.bytes, uint64(size))
+	if latency < 0 {
+		latency = 0
+	}
+	atomic.AddUint64(&s.latency, uint64(latency))
+	atomic.AddUint64(&s.buckets[bucketOf(latency)], 1)
+}
+
+func bucketOf(latency time.Duration) int {
+	if latency <= time.Microsecond {
+		return 0
+	}
+	i := bits.Len64(uint64((latency - 1) / time.Microsecond))
+	if i > latencyBuckets {
+		return latencyBuckets
+	}
+	return i
+}
+
+type tableStats struct {
+	name   string
+	prefix []byte
+	ops    [opsNum]opStats
+}
+
+// dbStats are the stats of a DB. Tables are sorted by prefix
+type dbStats struct {
+	mu      sync.RWMutex
+	tables  []*tableStats
+	unknown tableStats
+}
+
+// tableOf returns the table with the longest prefix of the key
+func (s *dbStats) tableOf(key []byte) *tableStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var res *tableStats
+	for _, t := range s.tables {
+		if bytes.HasPrefix(key, t.prefix) && (res == nil || len(t.prefix) > len(res.prefix)) {
+			res = t
+		}
+	}
+	if res == nil {
+		return &s.unknown
+	}
+	return res
+}
+
+func (s *dbStats) observe(op Op, key []byte, size int, start time.Time) {
+	s.tableOf(key).ops[op].observe(size, time.Since(start))
+}
+
+// Metrics collects the stats of DB operations, broken down by DBs and tables.
+// Metrics don't depend on any metrics library, the stats should be pulled with Snapshot.
+type Metrics struct {
+	mu  sync.RWMutex
+	dbs map[string]*dbStats
+}
+
+// NewMetrics creates an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		dbs: make(map[string]*dbStats),
+	}
+}
+
+func (m *Metrics) db(name string) *dbStats {
+	m.mu.RLock()
+	db := m.dbs[name]
+	m.mu.RUnlock()
+	if db != nil {
+		return db
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	db = m.dbs[name]
+	if db == nil {
+		db = &dbStats{}
+		m.dbs[name] = db
+	}
+	return db
+}
+
+// RegisterTables registers the tables of a DB, so the operations are accounted per table.
+// Operations with keys which don't belong to any registered table are accounted in a table with empty name.
+// Registering the same table again is a no-op, the previous stats of the table are kept.
+// Tables with the same name and different prefixes are summed up by Snapshot.
+func (m *Metrics) RegisterTables(dbName string, tables ...Table) {
+	db := m.db(dbName)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, t := range tables {
+		exists := false
+		for _, registered := range db.tables {
+			if registered.name == t.Name && bytes.Equal(registered.prefix, t.Prefix) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			db.tables = append(db.tables, &tableStats{
+				name:   t.Name,
+				prefix: append([]byte{}, t.Prefix...),
+			})
+		}
+	}
+	sort.SliceStable(db.tables, func(i, j int) bool {
+		return bytes.Compare(db.tables[i].prefix, db.tables[j].prefix) < 0
+	})
+}
+
+// Snapshot returns the stats of all the operations which happened at least once.
+// Stats are sorted by DB name, table prefix and operation. Stats of tables with the same name are summed up.
+func (m *Metrics) Snapshot() []Stat {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.dbs))
+	for name := range m.dbs {
+		names = append(names, name)
+	}
+	dbs := make([]*dbStats, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		dbs[i] = m.dbs[name]
+	}
+	m.mu.RUnlock()
+
+	var res []Stat
+	for i, db := range dbs {
+		db.mu.RLock()
+		tables := append([]*tableStats{&db.unknown}, db.tables...)
+		db.mu.RUnlock()
+
+		byName := make(map[string]int)
+		for _, t := range tables {
+			for op := Op(0); op < opsNum; op++ {
+				stat := t.ops[op].snapshot()
+				if stat.Count == 0 {
+					continue
+				}
+				stat.DB = names[i]
+				stat.Table = t.name
+				stat.Op = op
+				key := t.name + "/" + op.String()
+				if j, ok := byName[key]; ok {
+					res[j].merge(stat)
+					continue
+				}
+				byName[key] = len(res)
+				res = append(res, stat)
+			}
+		}
+	}
+	return res
+}
+
+func (s *opStats) snapshot() Stat {
+	stat := Stat{
+		Count: atomic.LoadUint64(&s.count),
+		Bytes: atomic.LoadUint64(&s.bytes),
+		Latency: Histogram{
+			Bounds: make([]time.Duration, latencyBuckets),
+			Counts: make([]uint64, latencyBuckets+1),
+			Sum:    time.Duration(atomic.LoadUint64(&s.latency)),
+		},
+	}
+	for i := range stat.Latency.Bounds {
+		stat.Latency.Bounds[i] = time.Microsecond << i
+	}
+	for i := range stat.Latency.Counts {
+		stat.Latency.Counts[i] = atomic.LoadUint64(&s.buckets[i])
+	}
+	return stat
+}
+
+func (s *Stat) merge(b Stat) {
+	s.Count += b.Count
+	s.Bytes += b.Bytes
+	s.Latency.Sum += b.Latency.Sum
+	for i := range s.Latency.Counts {
+		s.Latency.Counts[i] += b.Latency.Counts[i]
+	}
+}
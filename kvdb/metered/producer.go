@@ -0,0 +1,49 @@
+package metered
+
+import (
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+// DBProducer wraps every produced DB into a metered Store
+type DBProducer struct {
+	kvdb.DBProducer
+	metrics *Metrics
+}
+
+// WrapProducer wraps the producer, the DBs are accounted under their names.
+func WrapProducer(p kvdb.DBProducer, metrics *Metrics) *DBProducer {
+	return &DBProducer{
+		DBProducer: p,
+		metrics:    metrics,
+	}
+}
+
+func (p *DBProducer) OpenDB(name string) (kvdb.Store, error) {
+	return openDB(p.DBProducer, p.metrics, name)
+}
+
+// AllDBProducer is the same as DBProducer, for kvdb.FullDBProducer
+type AllDBProducer struct {
+	kvdb.FullDBProducer
+	metrics *Metrics
+}
+
+// WrapAllProducer wraps the producer, the DBs are accounted under their names.
+func WrapAllProducer(p kvdb.FullDBProducer, metrics *Metrics) *AllDBProducer {
+	return &AllDBProducer{
+		FullDBProducer: p,
+		metrics:        metrics,
+	}
+}
+
+func (p *AllDBProducer) OpenDB(name string) (kvdb.Store, error) {
+	return openDB(p.FullDBProducer, p.metrics, name)
+}
+
+func openDB(p kvdb.DBProducer, metrics *Metrics, name string) (kvdb.Store, error) {
+	store, err := p.OpenDB(name)
+	if err != nil {
+		return nil, err
+	}
+	return WrapStore(store, name, metrics), nil
+}
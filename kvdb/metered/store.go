@@ -0,0 +1,179 @@
+package metered
+
+import (
+	"time"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+// Store is a kvdb.Store wrapper, which records the stats of operations into Metrics
+type Store struct {
+	kvdb.Store
+	stats *dbStats
+}
+
+// WrapStore wraps the DB. name is the DB name in Metrics.
+func WrapStore(store kvdb.Store, name string, metrics *Metrics) *Store {
+	return &Store{
+		Store: store,
+		stats: metrics.db(name),
+	}
+}
+
+type reader struct {
+	kvdb.IteratedReader
+	stats *dbStats
+}
+
+type Snapshot struct {
+	reader
+	snap kvdb.Snapshot
+}
+
+// Has retrieves if a key is present in the key-value data store.
+func (s *Store) Has(key []byte) (bool, error) {
+	return reader{s.Store, s.stats}.Has(key)
+}
+
+// Get retrieves the given key if it's present in the key-value data store.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	return reader{s.Store, s.stats}.Get(key)
+}
+
+// NewIterator creates a binary-alphabetical iterator over a subset
+// of database content with a particular key prefix, starting at a particular
+// initial key (or after, if it does not exist).
+func (s *Store) NewIterator(prefix []byte, start []byte) kvdb.Iterator {
+	return reader{s.Store, s.stats}.NewIterator(prefix, start)
+}
+
+// Put inserts the given value into the key-value data store.
+func (s *Store) Put(key []byte, value []byte) error {
+	start := time.Now()
+	err := s.Store.Put(key, value)
+	s.stats.observe(OpPut, key, len(key)+len(value), start)
+	return err
+}
+
+// Delete removes the key from the key-value data store.
+func (s *Store) Delete(key []byte) error {
+	start := time.Now()
+	err := s.Store.Delete(key)
+	s.stats.observe(OpDelete, key, len(key), start)
+	return err
+}
+
+// NewBatch creates a write-only database that buffers changes to its host db
+// until a final write is called.
+func (s *Store) NewBatch() kvdb.Batch {
+	return &batch{
+		Batch: s.Store.NewBatch(),
+		stats: s.stats,
+	}
+}
+
+// GetSnapshot returns a latest snapshot of the underlying DB.
+// Reads from the snapshot are recorded as reads from the DB.
+func (s *Store) GetSnapshot() (kvdb.Snapshot, error) {
+	snap, err := s.Store.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		reader: reader{snap, s.stats},
+		snap:   snap,
+	}, nil
+}
+
+// Release releases associated resources.
+func (s *Snapshot) Release() {
+	s.snap.Release()
+}
+
+func (r reader) Has(key []byte) (bool, error) {
+	start := time.Now()
+	has, err := r.IteratedReader.Has(key)
+	r.stats.observe(OpHas, key, len(key), start)
+	return has, err
+}
+
+func (r reader) Get(key []byte) ([]byte, error) {
+	start := time.Now()
+	val, err := r.IteratedReader.Get(key)
+	r.stats.observe(OpGet, key, len(key)+len(val), start)
+	return val, err
+}
+
+func (r reader) NewIterator(prefix []byte, start []byte) kvdb.Iterator {
+	began := time.Now()
+	it := r.IteratedReader.NewIterator(prefix, start)
+	first := append(append([]byte{}, prefix...), start...)
+	r.stats.observe(OpIterator, first, len(first), began)
+	return &iterator{
+		Iterator: it,
+		stats:    r.stats,
+		first:    first,
+	}
+}
+
+type iterator struct {
+	kvdb.Iterator
+	stats *dbStats
+	first []byte
+}
+
+// Next moves the iterator to the next key/value pair.
+// A step is accounted in the table of the reached key, or in the table of the iterator's start if the iterator is exhausted.
+func (it *iterator) Next() bool {
+	start := time.Now()
+	ok := it.Iterator.Next()
+	if ok {
+		it.stats.observe(OpNext, it.Key(), len(it.Key())+len(it.Value()), start)
+	} else {
+		it.stats.observe(OpNext, it.first, 0, start)
+	}
+	return ok
+}
+
+type batch struct {
+	kvdb.Batch
+	stats *dbStats
+	// sizes are the sizes of the batched keys and values, per table
+	sizes map[*tableStats]int
+}
+
+func (b *batch) add(key []byte, size int) {
+	if b.sizes == nil {
+		b.sizes = make(map[*tableStats]int)
+	}
+	b.sizes[b.stats.tableOf(key)] += size
+}
+
+// Put inserts the given value into the batch for later committing.
+func (b *batch) Put(key, value []byte) error {
+	b.add(key, len(key)+len(value))
+	return b.Batch.Put(key, value)
+}
+
+// Delete inserts the key removal into the batch for later committing.
+func (b *batch) Delete(key []byte) error {
+	b.add(key, len(key))
+	return b.Batch.Delete(key)
+}
+
+// Write flushes any accumulated data to disk.
+func (b *batch) Write() error {
+	start := time.Now()
+	err := b.Batch.Write()
+	latency := time.Since(start)
+	for t, size := range b.sizes {
+		t.ops[OpBatchWrite].observe(size, latency)
+	}
+	return err
+}
+
+// Reset resets the batch for reuse.
+func (b *batch) Reset() {
+	b.Batch.Reset()
+	b.sizes = nil
+}
@@ -0,0 +1,429 @@
+package multidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+)
+
+/*
+ * Migration of tables between DBs when the routing table is changed.
+ * Every table is moved in steps: the data is copied into the new location, the tables lists are rewritten,
+ * and then the old data is deleted. Producers are flushed after every step,
+ * and the progress is saved into a separate DB, so an interrupted migration is resumed on the next run.
+ */
+
+var errMigrationConflict = errors.New("conflicting table move")
+
+// TableMove is a move of a table from its old location into a new one
+type TableMove struct {
+	Req  string
+	From Route
+	To   Route
+}
+
+func (m TableMove) String() string {
+	return fmt.Sprintf("%s: %s/%s:'%s' -> %s/%s:'%s'", m.Req, m.From.Type, m.From.Name, m.From.Table, m.To.Type, m.To.Name, m.To.Table)
+}
+
+// moveProgress is a state of a started table move
+type moveProgress struct {
+	Move TableMove
+	// Deleting is true if the data is copied and the tables lists are rewritten
+	Deleting bool
+	// LastKey is the last copied key of the old DB
+	LastKey []byte
+}
+
+// MigrationConfig is a configuration of tables migration
+type MigrationConfig struct {
+	Producers       map[TypeName]kvdb.FullDBProducer
+	OldRoutingTable map[string]Route
+	NewRoutingTable map[string]Route
+	TableRecordsKey []byte
+	// FlushIDKey is the key of the flush ID marker, which producers write into every DB.
+	// The marker belongs to the DB, so it's neither copied nor deleted with a table
+	FlushIDKey []byte
+	// FlushID is the flush ID, which producers write on every flush during the migration
+	FlushID []byte
+	// Progress is a DB for the migration progress. It must not be one of the migrated DBs
+	Progress kvdb.Store
+	// StepSize is the approx. size of data which is copied or deleted in a step. kvdb.IdealBatchSize is used if 0
+	StepSize int
+}
+
+// Migration moves the tables according to changes of the routing table
+type Migration struct {
+	cfg MigrationConfig
+	old *Producer
+	new *Producer
+}
+
+// NewMigration creates a migration from the old routing table to the new one.
+// The DBs must not be used by anyone else during the migration.
+func NewMigration(cfg MigrationConfig) (*Migration, error) {
+	if cfg.Progress == nil {
+		return nil, errors.New("progress DB must be defined")
+	}
+	if cfg.StepSize <= 0 {
+		cfg.StepSize = kvdb.IdealBatchSize
+	}
+	oldProducer, err := NewProducer(cfg.Producers, cfg.OldRoutingTable, cfg.TableRecordsKey)
+	if err != nil {
+		return nil, err
+	}
+	newProducer, err := NewProducer(cfg.Producers, cfg.NewRoutingTable, cfg.TableRecordsKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Migration{
+		cfg: cfg,
+		old: oldProducer,
+		new: newProducer,
+	}, nil
+}
+
+// Plan returns the tables which have to be moved, not including the moves which were interrupted.
+// Every table of the existing DBs must match to either old or new routing table.
+func (m *Migration) Plan() ([]TableMove, error) {
+	dbRecords, err := m.old.getRecords()
+	if err != nil {
+		return nil, err
+	}
+	var moves []TableMove
+	for loc, records := range dbRecords {
+		for _, rec := range records {
+			newRoute := m.new.RouteOf(rec.Req)
+			if loc.Type == newRoute.Type && loc.Name == newRoute.Name && rec.Table == newRoute.Table {
+				// already moved
+				continue
+			}
+			oldRoute := m.old.RouteOf(rec.Req)
+			if loc.Type != oldRoute.Type || loc.Name != oldRoute.Name || rec.Table != oldRoute.Table {
+				return nil, fmt.Errorf("table for '%s' doesn't match to neither old nor new routing table: %s/%s:'%s'", rec.Req, loc.Type, loc.Name, rec.Table)
+			}
+			moves = append(moves, TableMove{
+				Req:  rec.Req,
+				From: oldRoute,
+				To:   newRoute,
+			})
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].Req < moves[j].Req
+	})
+	return moves, nil
+}
+
+// Run finishes the interrupted moves, and then moves the planned tables.
+// onMove is called before every move, if not nil.
+func (m *Migration) Run(onMove func(TableMove)) error {
+	pending, err := m.readProgress()
+	if err != nil {
+		return err
+	}
+	for _, state := range pending {
+		if onMove != nil {
+			onMove(state.Move)
+		}
+		err = m.move(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	moves, err := m.Plan()
+	if err != nil {
+		return err
+	}
+	for _, move := range moves {
+		if onMove != nil {
+			onMove(move)
+		}
+		state := moveProgress{Move: move}
+		err = m.saveProgress(state)
+		if err != nil {
+			return err
+		}
+		err = m.move(state)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migration) readProgress() ([]moveProgress, error) {
+	var res []moveProgress
+	it := m.cfg.Progress.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		var state moveProgress
+		err := rlp.DecodeBytes(it.Value(), &state)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, state)
+	}
+	return res, it.Error()
+}
+
+func (m *Migration) saveProgress(state moveProgress) error {
+	b, err := rlp.EncodeToBytes(&state)
+	if err != nil {
+		return err
+	}
+	return m.cfg.Progress.Put([]byte(state.Move.Req), b)
+}
+
+func (m *Migration) flush() error {
+	for _, producer := range m.cfg.Producers {
+		err := producer.Flush(m.cfg.FlushID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Migration) openDB(route Route) (kvdb.Store, error) {
+	producer := m.cfg.Producers[route.Type]
+	if producer == nil {
+		return nil, fmt.Errorf("missing producer '%s'", route.Type)
+	}
+	return producer.OpenDB(route.Name)
+}
+
+func (m *Migration) move(state moveProgress) error {
+	move := state.Move
+	sameDB := DBLocatorOf(move.From) == DBLocatorOf(move.To)
+	if sameDB && tablesConflicting(move.From.Table, move.To.Table) {
+		return fmt.Errorf("%w %s", errMigrationConflict, move.String())
+	}
+
+	src, err := m.openDB(move.From)
+	if err != nil {
+		return err
+	}
+	srcDropped := false
+	defer func() {
+		if !srcDropped {
+			_ = src.Close()
+		}
+	}()
+	dst := src
+	if !sameDB {
+		dst, err = m.openDB(move.To)
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+	}
+
+	if !state.Deleting {
+		if sameDB {
+			// the table is re-assigned after the data is copied
+			err = m.checkRecord(dst, move.Req, move.To.Table)
+		} else {
+			// register the table in the new location before the data is copied
+			err = m.setRecord(dst, move.Req, move.To.Table)
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			pairs, err := m.readStep(src, []byte(move.From.Table), state.LastKey)
+			if err != nil {
+				return err
+			}
+			if len(pairs) == 0 {
+				break
+			}
+			err = m.copyStep(dst, pairs, len(move.From.Table), []byte(move.To.Table))
+			if err != nil {
+				return err
+			}
+			err = m.flush()
+			if err != nil {
+				return err
+			}
+			state.LastKey = pairs[len(pairs)-1][0]
+			err = m.saveProgress(state)
+			if err != nil {
+				return err
+			}
+		}
+
+		if sameDB {
+			err = m.setRecord(dst, move.Req, move.To.Table)
+		} else {
+			err = m.removeRecord(src, move.Req)
+		}
+		if err != nil {
+			return err
+		}
+		err = m.flush()
+		if err != nil {
+			return err
+		}
+		state.Deleting = true
+		state.LastKey = nil
+		err = m.saveProgress(state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the deleted keys aren't visited again, even if some of them are re-written by producers on flush
+	var last []byte
+	for {
+		pairs, err := m.readStep(src, []byte(move.From.Table), last)
+		if err != nil {
+			return err
+		}
+		if len(pairs) == 0 {
+			break
+		}
+		last = pairs[len(pairs)-1][0]
+		batch := src.NewBatch()
+		for _, pair := range pairs {
+			err = batch.Delete(pair[0])
+			if err != nil {
+				return err
+			}
+		}
+		err = batch.Write()
+		if err != nil {
+			return err
+		}
+		err = m.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	records, err := ReadTablesList(src, m.cfg.TableRecordsKey)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 && !move.From.NoDrop && !sameDB {
+		src.Drop()
+		srcDropped = true
+		err = m.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.cfg.Progress.Delete([]byte(move.Req))
+}
+
+// readStep reads the next pairs of the table after the last key. The tables list and the flush ID marker are skipped.
+func (m *Migration) readStep(db kvdb.Store, prefix []byte, last []byte) ([][2][]byte, error) {
+	var start []byte
+	if last != nil {
+		start = last[len(prefix):]
+	}
+	it := db.NewIterator(prefix, start)
+	defer it.Release()
+
+	var (
+		pairs [][2][]byte
+		size  int
+	)
+	for size < m.cfg.StepSize && it.Next() {
+		if bytes.Equal(it.Key(), last) || bytes.Equal(it.Key(), m.cfg.TableRecordsKey) || m.isFlushIDKey(it.Key()) {
+			continue
+		}
+		pairs = append(pairs, [2][]byte{common.CopyBytes(it.Key()), common.CopyBytes(it.Value())})
+		size += len(it.Key()) + len(it.Value())
+	}
+	return pairs, it.Error()
+}
+
+func (m *Migration) isFlushIDKey(key []byte) bool {
+	return len(m.cfg.FlushIDKey) != 0 && bytes.Equal(key, m.cfg.FlushIDKey)
+}
+
+// copyStep writes the pairs into the new table. oldPrefixLen is trimmed from the keys.
+func (m *Migration) copyStep(db kvdb.Store, pairs [][2][]byte, oldPrefixLen int, newPrefix []byte) error {
+	batch := db.NewBatch()
+	for _, pair := range pairs {
+		key := append(common.CopyBytes(newPrefix), pair[0][oldPrefixLen:]...)
+		if bytes.Equal(key, m.cfg.TableRecordsKey) {
+			return fmt.Errorf("key %x overwrites the tables list", key)
+		}
+		if m.isFlushIDKey(key) {
+			return fmt.Errorf("key %x overwrites the flush ID", key)
+		}
+		err := batch.Put(key, pair[1])
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Write()
+}
+
+// checkRecord checks that the table may be assigned to the req in the DB
+func (m *Migration) checkRecord(db kvdb.Store, req string, table string) error {
+	records, err := ReadTablesList(db, m.cfg.TableRecordsKey)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if rec.Req != req && tablesConflicting(rec.Table, table) {
+			return fmt.Errorf("%w, conflicting tables for reqs: new=%s:'%s'~old=%s:'%s'", errMigrationConflict, req, table, rec.Req, rec.Table)
+		}
+	}
+	return nil
+}
+
+// setRecord assigns the table to the req in the tables list of the DB
+func (m *Migration) setRecord(db kvdb.Store, req string, table string) error {
+	err := m.checkRecord(db, req, table)
+	if err != nil {
+		return err
+	}
+	records, err := ReadTablesList(db, m.cfg.TableRecordsKey)
+	if err != nil {
+		return err
+	}
+	for i, rec := range records {
+		if rec.Req == req {
+			if rec.Table == table {
+				return nil
+			}
+			records[i].Table = table
+			return WriteTablesList(db, m.cfg.TableRecordsKey, records)
+		}
+	}
+	records = append(records, TableRecord{
+		Req:   req,
+		Table: table,
+	})
+	return WriteTablesList(db, m.cfg.TableRecordsKey, records)
+}
+
+// removeRecord removes the req from the tables list of the DB
+func (m *Migration) removeRecord(db kvdb.Store, req string) error {
+	records, err := ReadTablesList(db, m.cfg.TableRecordsKey)
+	if err != nil {
+		return err
+	}
+	filtered := make([]TableRecord, 0, len(records))
+	for _, rec := range records {
+		if rec.Req != req {
+			filtered = append(filtered, rec)
+		}
+	}
+	if len(filtered) == len(records) {
+		return nil
+	}
+	return WriteTablesList(db, m.cfg.TableRecordsKey, filtered)
+}
@@ -0,0 +1,153 @@
+package multidb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/kvdb"
+	"github.com/panoptisDev/lachesis-base/kvdb/flushable"
+	"github.com/panoptisDev/lachesis-base/kvdb/memorydb"
+)
+
+var errFlush = errors.New("flush failed")
+
+// failingProducer fails flushes once failAfter flushes are done
+type failingProducer struct {
+	kvdb.FullDBProducer
+	flushes   int
+	failAfter int
+}
+
+func (p *failingProducer) Flush(id []byte) error {
+	if p.failAfter > 0 && p.flushes >= p.failAfter {
+		return errFlush
+	}
+	p.flushes++
+	return p.FullDBProducer.Flush(id)
+}
+
+func TestMigration(t *testing.T) {
+	for _, failAfter := range []int{0, 5, 30} {
+		t.Run(fmt.Sprintf("failAfter=%d", failAfter), func(t *testing.T) {
+			testMigration(t, failAfter)
+		})
+	}
+}
+
+func testMigration(t *testing.T, failAfter int) {
+	require := require.New(t)
+	tablesKey := []byte("tables")
+	flushID := []byte{1}
+
+	a := &failingProducer{FullDBProducer: flushable.NewSyncedPool(memorydb.NewProducer(""), []byte("flushID"))}
+	b := &failingProducer{FullDBProducer: flushable.NewSyncedPool(memorydb.NewProducer(""), []byte("flushID"))}
+	producers := map[TypeName]kvdb.FullDBProducer{
+		"a": a,
+		"b": b,
+	}
+	oldRouting := map[string]Route{
+		"":         {Type: "a"},
+		"gossip":   {Type: "a", Name: "main", Table: "g"},
+		"lachesis": {Type: "a", Name: "main", Table: "l"},
+		"evm":      {Type: "a", Name: "evm"},
+		"epoch":    {Type: "a", Name: "main", Table: "e"},
+	}
+	newRouting := map[string]Route{
+		"":         {Type: "a"},
+		"gossip":   {Type: "b", Name: "gossip"},
+		"lachesis": {Type: "a", Name: "main", Table: "L"},
+		"evm":      {Type: "b", Name: "evmdb", Table: "E"},
+		"epoch":    {Type: "a", Name: "main", Table: "e"},
+	}
+	reqs := []string{"gossip", "lachesis", "evm", "epoch"}
+	const keysNum = 20
+
+	oldProducer, err := NewProducer(producers, oldRouting, tablesKey)
+	require.NoError(err)
+	for _, req := range reqs {
+		db, err := oldProducer.OpenDB(req)
+		require.NoError(err)
+		for i := 0; i < keysNum; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("%s-%02d", req, i)), []byte(req)))
+		}
+	}
+	require.NoError(oldProducer.Flush(flushID))
+
+	newProducer, err := NewProducer(producers, newRouting, tablesKey)
+	require.NoError(err)
+	require.Error(newProducer.Verify())
+
+	a.failAfter = failAfter
+	b.failAfter = failAfter
+	cfg := MigrationConfig{
+		Producers:       producers,
+		OldRoutingTable: oldRouting,
+		NewRoutingTable: newRouting,
+		TableRecordsKey: tablesKey,
+		FlushIDKey:      []byte("flushID"),
+		FlushID:         flushID,
+		Progress:        memorydb.New(),
+		StepSize:        50,
+	}
+	migration, err := NewMigration(cfg)
+	require.NoError(err)
+	plan, err := migration.Plan()
+	require.NoError(err)
+	require.Len(plan, 3)
+	require.Equal("evm", plan[0].Req)
+	require.Equal("gossip", plan[1].Req)
+	require.Equal("lachesis", plan[2].Req)
+
+	err = migration.Run(nil)
+	if failAfter != 0 {
+		require.ErrorIs(err, errFlush)
+		// resume
+		a.failAfter = 0
+		b.failAfter = 0
+		migration, err = NewMigration(cfg)
+		require.NoError(err)
+		err = migration.Run(nil)
+	}
+	require.NoError(err)
+	plan, err = migration.Plan()
+	require.NoError(err)
+	require.Empty(plan)
+	require.NoError(newProducer.Verify())
+
+	for _, req := range reqs {
+		db, err := newProducer.OpenDB(req)
+		require.NoError(err)
+		it := db.NewIterator(nil, nil)
+		n := 0
+		for it.Next() {
+			if string(it.Key()) == string(tablesKey) {
+				continue
+			}
+			if newRouting[req].Table == "" && string(it.Key()) == "flushID" {
+				// own flush ID marker of the DB, it isn't copied from the old location
+				continue
+			}
+			require.Equal(fmt.Sprintf("%s-%02d", req, n), string(it.Key()), req)
+			require.Equal([]byte(req), it.Value())
+			n++
+		}
+		it.Release()
+		require.Equal(keysNum, n, req)
+	}
+
+	// the old data is deleted
+	mainDB, err := a.OpenDB("main")
+	require.NoError(err)
+	records, err := ReadTablesList(mainDB, tablesKey)
+	require.NoError(err)
+	require.ElementsMatch([]TableRecord{{"lachesis", "L"}, {"epoch", "e"}}, records)
+	for _, prefix := range []string{"g", "l"} {
+		it := mainDB.NewIterator([]byte(prefix), nil)
+		require.False(it.Next(), prefix)
+		it.Release()
+	}
+	require.NotContains(a.Names(), "evm")
+}
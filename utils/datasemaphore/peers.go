@@ -0,0 +1,165 @@
+package datasemaphore
+
+import (
+	"time"
+
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+	"github.com/panoptisDev/lachesis-base/inter/idx"
+)
+
+type peerState struct {
+	processing dag.Metric
+	weight     uint64
+}
+
+const defaultPeerWeight = 1
+
+// SetPeerLimit sets the maximum amount of data which may be acquired by a single peer.
+// Zero value of a field disables the limit.
+func (s *DataSemaphore) SetPeerLimit(limit dag.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peerLimit = limit
+	s.cond.Broadcast()
+}
+
+// SetPeerWeight sets a weight of a peer for the fair sharing. Default weight is 1.
+func (s *DataSemaphore) SetPeerWeight(peer string, weight uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peer(peer).weight = weight
+	s.cond.Broadcast()
+}
+
+// ForgetPeer drops the peer's weight. Data acquired by the peer is still accounted until it's released.
+func (s *DataSemaphore) ForgetPeer(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.peers[peer]; p != nil && isZero(p.processing) {
+		delete(s.peers, peer)
+	}
+}
+
+// forgetIdle drops the peer's state if it has no acquired data and the default weight, to keep memory bounded
+func (s *DataSemaphore) forgetIdle(peer string) {
+	if p := s.peers[peer]; p != nil && isZero(p.processing) && p.weight == defaultPeerWeight {
+		delete(s.peers, peer)
+	}
+}
+
+func isZero(m dag.Metric) bool {
+	return m.Num == 0 && m.Size == 0
+}
+
+func (s *DataSemaphore) peer(peer string) *peerState {
+	p := s.peers[peer]
+	if p == nil {
+		p = &peerState{weight: defaultPeerWeight}
+		s.peers[peer] = p
+	}
+	return p
+}
+
+// fairShare returns a share of maxProcessing for the peer, proportional to its weight among the peers with acquired data
+func (s *DataSemaphore) fairShare(peer string, p *peerState) dag.Metric {
+	totalWeight := p.weight
+	for id, other := range s.peers {
+		if id != peer && !isZero(other.processing) {
+			totalWeight += other.weight
+		}
+	}
+	if totalWeight == 0 {
+		return dag.Metric{}
+	}
+	return dag.Metric{
+		Num:  idx.Event(uint64(s.maxProcessing.Num) * p.weight / totalWeight),
+		Size: s.maxProcessing.Size / totalWeight * p.weight,
+	}
+}
+
+func (s *DataSemaphore) tryAcquirePeer(peer string, weight dag.Metric) bool {
+	p := s.peer(peer)
+	after := dag.Metric{
+		Num:  p.processing.Num + weight.Num,
+		Size: p.processing.Size + weight.Size,
+	}
+	if s.peerLimit.Num != 0 && after.Num > s.peerLimit.Num || s.peerLimit.Size != 0 && after.Size > s.peerLimit.Size {
+		return false
+	}
+	// a peer with no acquired data may always proceed, otherwise it cannot exceed its fair share
+	if !isZero(p.processing) {
+		share := s.fairShare(peer, p)
+		if after.Num > share.Num || after.Size > share.Size {
+			return false
+		}
+	}
+	if !s.tryAcquire(weight) {
+		return false
+	}
+	p.processing = after
+	return true
+}
+
+// AcquirePeer acquires the weight on behalf of the peer.
+// Besides the global limit, the peer is bounded by the per-peer limit and by its fair share of the global limit,
+// unless it has no acquired data.
+func (s *DataSemaphore) AcquirePeer(peer string, weight dag.Metric, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.tryAcquirePeer(peer, weight) {
+		if weight.Size > s.maxProcessing.Size || weight.Num > s.maxProcessing.Num || time.Now().After(deadline) {
+			s.forgetIdle(peer)
+			return false
+		}
+		if s.peerLimit.Num != 0 && weight.Num > s.peerLimit.Num || s.peerLimit.Size != 0 && weight.Size > s.peerLimit.Size {
+			s.forgetIdle(peer)
+			return false
+		}
+		s.cond.Wait()
+	}
+	return true
+}
+
+// ReleasePeer releases the weight acquired by AcquirePeer.
+// The peer's state is dropped once it has no acquired data, unless the peer has a non-default weight.
+func (s *DataSemaphore) ReleasePeer(peer string, weight dag.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.peers[peer]; p != nil {
+		if p.processing.Num < weight.Num || p.processing.Size < weight.Size {
+			if s.warning != nil {
+				s.warning(p.processing, p.processing, weight)
+			}
+			p.processing = dag.Metric{}
+		} else {
+			p.processing.Num -= weight.Num
+			p.processing.Size -= weight.Size
+		}
+		s.forgetIdle(peer)
+	}
+	s.release(weight)
+}
+
+// PeerProcessing returns the weight acquired by the peer
+func (s *DataSemaphore) PeerProcessing(peer string) dag.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p := s.peers[peer]; p != nil {
+		return p.processing
+	}
+	return dag.Metric{}
+}
+
+// PeersProcessing returns the weights acquired by all the peers with acquired data
+func (s *DataSemaphore) PeersProcessing() map[string]dag.Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]dag.Metric, len(s.peers))
+	for id, p := range s.peers {
+		if !isZero(p.processing) {
+			res[id] = p.processing
+		}
+	}
+	return res
+}
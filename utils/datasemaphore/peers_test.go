@@ -0,0 +1,83 @@
+package datasemaphore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/panoptisDev/lachesis-base/inter/dag"
+)
+
+func TestPeerFairShare(t *testing.T) {
+	s := New(dag.Metric{Num: 100, Size: 1000}, func(received dag.Metric, processing dag.Metric, releasing dag.Metric) {
+		t.Fatal("semaphore inconsistency")
+	})
+
+	// a single peer may use the whole limit
+	require.True(t, s.AcquirePeer("a", dag.Metric{Num: 60, Size: 600}, 0))
+	require.True(t, s.AcquirePeer("a", dag.Metric{Num: 20, Size: 200}, 0))
+	// another peer without acquired data may always proceed
+	require.True(t, s.AcquirePeer("b", dag.Metric{Num: 10, Size: 100}, 0))
+	// peer a is above its fair share now
+	require.False(t, s.AcquirePeer("a", dag.Metric{Num: 1, Size: 1}, 0))
+	// peer b is below its fair share
+	require.True(t, s.AcquirePeer("b", dag.Metric{Num: 10, Size: 100}, 0))
+	require.False(t, s.AcquirePeer("b", dag.Metric{Num: 1, Size: 1}, 0)) // global limit
+
+	require.Equal(t, map[string]dag.Metric{
+		"a": {Num: 80, Size: 800},
+		"b": {Num: 20, Size: 200},
+	}, s.PeersProcessing())
+
+	s.ReleasePeer("a", dag.Metric{Num: 40, Size: 400})
+	require.Equal(t, dag.Metric{Num: 40, Size: 400}, s.PeerProcessing("a"))
+	require.Equal(t, dag.Metric{Num: 60, Size: 600}, s.Processing())
+	require.True(t, s.AcquirePeer("a", dag.Metric{Num: 10, Size: 100}, 0))
+	require.False(t, s.AcquirePeer("a", dag.Metric{Num: 1, Size: 1}, 0))
+
+	// weights
+	s.SetPeerWeight("a", 3)
+	require.True(t, s.AcquirePeer("a", dag.Metric{Num: 20, Size: 200}, 0))
+
+	s.ReleasePeer("a", dag.Metric{Num: 70, Size: 700})
+	s.ReleasePeer("b", dag.Metric{Num: 20, Size: 200})
+	require.Empty(t, s.PeersProcessing())
+	require.Equal(t, dag.Metric{}, s.Processing())
+}
+
+func TestPeerLimit(t *testing.T) {
+	s := New(dag.Metric{Num: 100, Size: 1000}, nil)
+	s.SetPeerLimit(dag.Metric{Num: 10})
+
+	require.True(t, s.AcquirePeer("a", dag.Metric{Num: 10, Size: 100}, 0))
+	require.False(t, s.AcquirePeer("a", dag.Metric{Num: 1, Size: 1}, 0))
+	require.False(t, s.AcquirePeer("b", dag.Metric{Num: 11, Size: 1}, 0))
+	require.True(t, s.AcquirePeer("b", dag.Metric{Num: 10, Size: 900}, 0))
+	require.False(t, s.AcquirePeer("c", dag.Metric{Num: 1, Size: 1}, 0))
+
+	s.ReleasePeer("a", dag.Metric{Num: 10, Size: 100})
+	s.ForgetPeer("a")
+	require.Equal(t, map[string]dag.Metric{"b": {Num: 10, Size: 900}}, s.PeersProcessing())
+}
+
+func TestPeerStateDropped(t *testing.T) {
+	s := New(dag.Metric{Num: 100, Size: 1000}, nil)
+	s.SetPeerLimit(dag.Metric{Num: 10})
+
+	for i := 0; i < 100; i++ {
+		peer := fmt.Sprintf("peer%d", i)
+		require.True(t, s.AcquirePeer(peer, dag.Metric{Num: 1, Size: 10}, 0))
+		s.ReleasePeer(peer, dag.Metric{Num: 1, Size: 10})
+		require.False(t, s.AcquirePeer(peer, dag.Metric{Num: 11, Size: 10}, 0))
+	}
+	require.Empty(t, s.peers)
+
+	// non-default weight is kept
+	s.SetPeerWeight("a", 3)
+	require.True(t, s.AcquirePeer("a", dag.Metric{Num: 1, Size: 10}, 0))
+	s.ReleasePeer("a", dag.Metric{Num: 1, Size: 10})
+	require.Len(t, s.peers, 1)
+	s.ForgetPeer("a")
+	require.Empty(t, s.peers)
+}
@@ -14,6 +14,9 @@ type DataSemaphore struct {
 	mu   sync.Mutex
 	cond *sync.Cond
 
+	peers     map[string]*peerState
+	peerLimit dag.Metric
+
 	warning func(received dag.Metric, processing dag.Metric, releasing dag.Metric)
 }
 
@@ -21,6 +24,7 @@ func New(maxProcessing dag.Metric, warning func(received dag.Metric, processing
 	s := &DataSemaphore{
 		maxProcessing: maxProcessing,
 		warning:       warning,
+		peers:         make(map[string]*peerState),
 	}
 	s.cond = sync.NewCond(&s.mu)
 	return s
@@ -59,6 +63,10 @@ func (s *DataSemaphore) tryAcquire(metric dag.Metric) bool {
 func (s *DataSemaphore) Release(weight dag.Metric) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.release(weight)
+}
+
+func (s *DataSemaphore) release(weight dag.Metric) {
 	if s.processing.Num < weight.Num || s.processing.Size < weight.Size {
 		if s.warning != nil {
 			s.warning(s.processing, s.processing, weight)
@@ -0,0 +1,127 @@
+package workers
+
+import (
+	"sync"
+)
+
+// FairWorkers is a pool of workers which serves tasks of different keys in round-robin order,
+// so a key with many queued tasks cannot starve other keys.
+// Tasks of the same key are started in FIFO order.
+type FairWorkers struct {
+	quit <-chan struct{}
+	wg   *sync.WaitGroup
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queues   map[string][]func()
+	keys     []string // round-robin order of keys with queued tasks
+	tasks    int
+	maxTasks int
+	stopped  bool
+}
+
+func NewFair(wg *sync.WaitGroup, quit chan struct{}, maxTasks int) *FairWorkers {
+	w := &FairWorkers{
+		quit:     quit,
+		wg:       wg,
+		queues:   make(map[string][]func()),
+		maxTasks: maxTasks,
+	}
+	w.cond = sync.NewCond(&w.mu)
+	// wake up the waiters on quit, even if the workers aren't started
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		<-w.quit
+		w.mu.Lock()
+		w.stopped = true
+		w.mu.Unlock()
+		w.cond.Broadcast()
+	}()
+	return w
+}
+
+func (w *FairWorkers) Start(workersN int) {
+	for i := 0; i < workersN; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.worker()
+		}()
+	}
+}
+
+// Enqueue adds a task of the key. It blocks if maxTasks tasks are already queued.
+func (w *FairWorkers) Enqueue(key string, fn func()) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.tasks >= w.maxTasks && !w.stopped {
+		w.cond.Wait()
+	}
+	if w.stopped {
+		return errTerminated
+	}
+	// quit may be closed before the watcher sets stopped
+	select {
+	case <-w.quit:
+		return errTerminated
+	default:
+	}
+	if len(w.queues[key]) == 0 {
+		w.keys = append(w.keys, key)
+	}
+	w.queues[key] = append(w.queues[key], fn)
+	w.tasks++
+	w.cond.Broadcast()
+	return nil
+}
+
+// next pops a task of the next key in round-robin order
+func (w *FairWorkers) next() func() {
+	key := w.keys[0]
+	w.keys = w.keys[1:]
+	queue := w.queues[key]
+	fn := queue[0]
+	queue[0] = nil
+	if len(queue) == 1 {
+		delete(w.queues, key)
+	} else {
+		w.queues[key] = queue[1:]
+		w.keys = append(w.keys, key)
+	}
+	w.tasks--
+	return fn
+}
+
+func (w *FairWorkers) worker() {
+	for {
+		w.mu.Lock()
+		for w.tasks == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.mu.Unlock()
+			return
+		}
+		fn := w.next()
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		fn()
+	}
+}
+
+func (w *FairWorkers) Drain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queues = make(map[string][]func())
+	w.keys = nil
+	w.tasks = 0
+	w.cond.Broadcast()
+}
+
+func (w *FairWorkers) TasksCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.tasks
+}
@@ -0,0 +1,78 @@
+package workers
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairWorkersRoundRobin(t *testing.T) {
+	wg := sync.WaitGroup{}
+	quit := make(chan struct{})
+	w := NewFair(&wg, quit, 1000)
+
+	var (
+		mu    sync.Mutex
+		order []string
+		done  sync.WaitGroup
+	)
+	task := func(key string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, key)
+			mu.Unlock()
+			done.Done()
+		}
+	}
+	// a flooding key is enqueued first
+	done.Add(100 + 2)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, w.Enqueue("a", task("a")))
+	}
+	require.NoError(t, w.Enqueue("b", task("b")))
+	require.NoError(t, w.Enqueue("c", task("c")))
+	require.Equal(t, 102, w.TasksCount())
+
+	w.Start(1)
+	done.Wait()
+	require.Equal(t, []string{"a", "b", "c", "a"}, order[:4])
+
+	close(quit)
+	wg.Wait()
+	require.Error(t, w.Enqueue("a", task("a")))
+}
+
+func TestFairWorkersLimit(t *testing.T) {
+	wg := sync.WaitGroup{}
+	quit := make(chan struct{})
+	w := NewFair(&wg, quit, 2)
+	w.Start(2)
+
+	done := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		done.Add(1)
+		require.NoError(t, w.Enqueue("a", done.Done))
+	}
+	done.Wait()
+
+	close(quit)
+	wg.Wait()
+}
+
+func TestFairWorkersQuitNotStarted(t *testing.T) {
+	wg := sync.WaitGroup{}
+	quit := make(chan struct{})
+	w := NewFair(&wg, quit, 1)
+
+	require.NoError(t, w.Enqueue("a", func() {}))
+	// the queue is full, so Enqueue waits until quit
+	errs := make(chan error, 1)
+	go func() {
+		errs <- w.Enqueue("a", func() {})
+	}()
+	close(quit)
+	require.Error(t, <-errs)
+	require.Error(t, w.Enqueue("b", func() {}))
+	wg.Wait()
+}